@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
@@ -37,12 +38,18 @@ func main() {
 	}
 
 	cli := cmd.CLI{}
-	args := kong.Parse(&cli, kong.Configuration(kongyaml.Loader, "./.tko.yaml", "./.tko.yml"))
+	args := kong.Parse(&cli, kong.Configuration(kongyaml.Loader, cmd.ConfigFiles...))
 
 	err := args.Run(&cliContext)
 	if err != nil {
 		log.Println(err)
 		exitCleanWatcher.Close()
-		os.Exit(1)
+
+		code := 1
+		var exitErr *cmd.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.Code
+		}
+		os.Exit(code)
 	}
 }
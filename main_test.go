@@ -52,7 +52,7 @@ build:
 	assert.Equal(t, "/entrypoint", cli.Build.Entrypoint)
 	assert.Equal(t, "/destination", cli.Build.DestinationPath)
 	assert.Equal(t, false, cli.Build.DestinationChown)
-	assert.Equal(t, "repo/target", cli.Build.TargetRepo)
+	assert.DeepEqual(t, []string{"repo/target"}, cli.Build.TargetRepo)
 
 	assert.Equal(t, "me", cli.Build.Author)
 	assert.Equal(t, "value1", cli.Build.DefaultAnnotations["label1"])
@@ -126,7 +126,7 @@ func TestBuildArgs(t *testing.T) {
 	assert.Equal(t, "/entrypoint", cli.Build.Entrypoint)
 	assert.Equal(t, "/destination", cli.Build.DestinationPath)
 	assert.Equal(t, false, cli.Build.DestinationChown)
-	assert.Equal(t, "repo/target", cli.Build.TargetRepo)
+	assert.DeepEqual(t, []string{"repo/target"}, cli.Build.TargetRepo)
 
 	assert.Equal(t, "me", cli.Build.Author)
 	assert.Equal(t, "value1", cli.Build.DefaultAnnotations["label1"])
@@ -184,6 +184,331 @@ build:
 	assert.Equal(t, "linux/amd64,linux/arm64", cli.Build.Platforms)
 }
 
+func TestLockUpdateArgs(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	args, err := parser.Parse([]string{"lock", "update", "-b", "alpine:3", "-p", "linux/arm64", "--lockfile", "custom.lock"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "lock update", args.Command())
+	assert.Equal(t, "alpine:3", cli.Lock.Update.BaseRef)
+	assert.Equal(t, "linux/arm64", cli.Lock.Update.Platforms)
+	assert.Equal(t, "custom.lock", cli.Lock.Update.Lockfile)
+}
+
+func TestLockUpdateArgsRegistryMirrors(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"lock", "update", "--registry-mirrors", "docker.io=mirror.corp/dockerhub"})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"mirror.corp/dockerhub"}, cli.Lock.Update.RegistryMirrors["docker.io"])
+}
+
+func TestBuildArgsCache(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source",
+		"-t", "repo/target",
+		"--cache-dir", "/cache",
+		"--cache-max-size", "1GiB",
+		"--offline",
+	})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "/cache", cli.Build.CacheDir)
+	assert.Equal(t, "1GiB", cli.Build.CacheMaxSize)
+	assert.Equal(t, true, cli.Build.Offline)
+}
+
+func TestBuildArgsRegistryMirrors(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source",
+		"-t", "repo/target",
+		"--registry-mirrors", "docker.io=mirror.corp/dockerhub,mirror2.corp/dockerhub;ghcr.io=mirror.corp/ghcr",
+	})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"mirror.corp/dockerhub,mirror2.corp/dockerhub"}, cli.Build.RegistryMirrors["docker.io"])
+	assert.DeepEqual(t, []string{"mirror.corp/ghcr"}, cli.Build.RegistryMirrors["ghcr.io"])
+}
+
+func TestYamlRegistryMirrors(t *testing.T) {
+	yaml := `
+build:
+  target-repo: repo/target
+  registry-mirrors:
+    docker.io:
+      - mirror.corp/dockerhub
+      - mirror2.corp/dockerhub
+`
+
+	r, err := kongyaml.Loader(strings.NewReader(yaml))
+	assert.NilError(t, err)
+
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli, kong.Resolvers(r))
+	_, err = parser.Parse([]string{"build", "/source"})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"mirror.corp/dockerhub", "mirror2.corp/dockerhub"}, cli.Build.RegistryMirrors["docker.io"])
+}
+
+func TestYamlSignatureKeys(t *testing.T) {
+	yaml := `
+build:
+  target-repo: repo/target
+  signature-keys:
+    - keys/security.pub
+    - keys/security-next.pub
+`
+
+	r, err := kongyaml.Loader(strings.NewReader(yaml))
+	assert.NilError(t, err)
+
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli, kong.Resolvers(r))
+	_, err = parser.Parse([]string{"build", "/source"})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"keys/security.pub", "keys/security-next.pub"}, cli.Build.SignatureKeys)
+}
+
+func TestYamlWithPolicySection(t *testing.T) {
+	yaml := `
+build:
+  target-repo: repo/target
+policy:
+  allow:
+    - docker.io/library/*
+  require-digest: true
+  max-age: 30d
+`
+
+	r, err := kongyaml.Loader(strings.NewReader(yaml))
+	assert.NilError(t, err)
+
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli, kong.Resolvers(r))
+	_, err = parser.Parse([]string{"build", "/source"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "", cli.Build.PolicyFile)
+}
+
+func TestBaseOutdatedArgs(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	args, err := parser.Parse([]string{"base", "outdated", "ghcr.io/org/app:latest", "-b", "debian:bookworm-slim"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "base outdated <image>", args.Command())
+	assert.Equal(t, "ghcr.io/org/app:latest", cli.Base.Outdated.Image)
+	assert.Equal(t, "debian:bookworm-slim", cli.Base.Outdated.BaseRef)
+}
+
+func TestRebaseArgs(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	args, err := parser.Parse([]string{"rebase", "ghcr.io/org/app:latest", "--new-base", "debian:bookworm-slim", "-t", "ghcr.io/org/app:rebased"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "rebase <image>", args.Command())
+	assert.Equal(t, "ghcr.io/org/app:latest", cli.Rebase.Image)
+	assert.Equal(t, "debian:bookworm-slim", cli.Rebase.NewBase)
+	assert.Equal(t, "ghcr.io/org/app:rebased", cli.Rebase.TargetRepo)
+}
+
+func TestBaseVendorArgs(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	args, err := parser.Parse([]string{"base", "vendor", "debian:bookworm-slim", "--to", "registry.corp/base/debian", "-p", "all", "--update-config"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "base vendor <ref>", args.Command())
+	assert.Equal(t, "debian:bookworm-slim", cli.Base.Vendor.Ref)
+	assert.Equal(t, "registry.corp/base/debian", cli.Base.Vendor.To)
+	assert.Equal(t, "all", cli.Base.Vendor.Platforms)
+	assert.Equal(t, true, cli.Base.Vendor.UpdateConfig)
+}
+
+func TestBuildArgsTags(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source",
+		"-t", "repo/target",
+		"--tag", "sha-{{.Git.ShortCommit}}",
+		"--tag", "{{.Env.BRANCH}}",
+		"--tag", "1.4.2",
+	})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"sha-{{.Git.ShortCommit}}", "{{.Env.BRANCH}}", "1.4.2"}, cli.Build.Tags)
+}
+
+func TestBuildArgsSemverAliases(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "--auto-version-annotation", "git", "--semver-aliases"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, true, cli.Build.SemverAliases)
+	assert.Equal(t, false, cli.Build.SemverPrerelease)
+}
+
+func TestBuildArgsOutput(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "-T", "OCI_LAYOUT", "--output", "./dist/layout"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "OCI_LAYOUT", cli.Build.TargetType)
+	assert.Equal(t, "./dist/layout", cli.Build.Output)
+}
+
+func TestBuildArgsDaemonPlatform(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "-T", "LOCAL_DAEMON", "-p", "linux/amd64,linux/arm64", "--daemon-platform", "linux/arm64"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "linux/arm64", cli.Build.DaemonPlatform)
+}
+
+func TestBuildArgsDaemonHost(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "-T", "LOCAL_DAEMON", "--daemon-host", "ssh://me@build-host"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "ssh://me@build-host", cli.Build.DaemonHost)
+}
+
+func TestBuildArgsMultipleTargets(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source",
+		"-t", "ghcr.io/org/app",
+		"-t", "registry.corp/app",
+		"-t", "app,type=LOCAL_FILE,output=app.tar",
+		"--allow-partial-failure",
+	})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"ghcr.io/org/app", "registry.corp/app", "app,type=LOCAL_FILE,output=app.tar"}, cli.Build.TargetRepo)
+	assert.Equal(t, true, cli.Build.AllowPartialFailure)
+}
+
+func TestYamlMultipleTargets(t *testing.T) {
+	yaml := `
+build:
+  target-repo:
+    - ghcr.io/org/app
+    - app,type=OCI_LAYOUT,output=dist/layout
+`
+
+	r, err := kongyaml.Loader(strings.NewReader(yaml))
+	assert.NilError(t, err)
+
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli, kong.Resolvers(r))
+	_, err = parser.Parse([]string{"build", "/source"})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"ghcr.io/org/app", "app,type=OCI_LAYOUT,output=dist/layout"}, cli.Build.TargetRepo)
+}
+
+func TestBuildArgsResultFile(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "--result-file", "/out/result.json"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, "/out/result.json", cli.Build.ResultFile)
+}
+
+func TestBuildArgsDryRun(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "--dry-run"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, true, cli.Build.DryRun)
+}
+
+func TestBuildArgsFailIfChanged(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "--fail-if-changed"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, true, cli.Build.FailIfChanged)
+}
+
+func TestYamlImmutableTags(t *testing.T) {
+	yaml := `
+build:
+  target-repo: repo/target
+  immutable-tags:
+    - v*
+    - "[0-9]*.[0-9]*.[0-9]*"
+`
+
+	r, err := kongyaml.Loader(strings.NewReader(yaml))
+	assert.NilError(t, err)
+
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli, kong.Resolvers(r))
+	_, err = parser.Parse([]string{"build", "/source"})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"v*", "[0-9]*.[0-9]*.[0-9]*"}, cli.Build.ImmutableTags)
+}
+
+func TestBuildArgsSBOM(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target"})
+	assert.NilError(t, err)
+	assert.Equal(t, "none", cli.Build.SBOM)
+
+	_, err = parser.Parse([]string{"build", "/source", "-t", "repo/target", "--sbom", "cyclonedx"})
+	assert.NilError(t, err)
+	assert.Equal(t, "cyclonedx", cli.Build.SBOM)
+
+	_, err = parser.Parse([]string{"build", "/source", "-t", "repo/target", "--sbom", "swid"})
+	assert.ErrorContains(t, err, "--sbom")
+}
+
+func TestBuildArgsProvenance(t *testing.T) {
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli)
+	_, err := parser.Parse([]string{"build", "/source", "-t", "repo/target", "--provenance", "--provenance-key", "/keys/provenance.pem"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, true, cli.Build.Provenance)
+	assert.Equal(t, "/keys/provenance.pem", cli.Build.ProvenanceKey)
+}
+
+func TestYamlSkipPlatformCheck(t *testing.T) {
+	yaml := `
+build:
+  target-repo: repo/target
+  skip-platform-check: true
+`
+
+	r, err := kongyaml.Loader(strings.NewReader(yaml))
+	assert.NilError(t, err)
+
+	cli := cmd.CLI{}
+	parser := mustNew(t, &cli, kong.Resolvers(r))
+	_, err = parser.Parse([]string{"build", "/source"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, true, cli.Build.SkipPlatformCheck)
+}
+
 func mustNew(t *testing.T, cli any, options ...kong.Option) *kong.Kong {
 	t.Helper()
 	options = append([]kong.Option{
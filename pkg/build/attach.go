@@ -0,0 +1,113 @@
+package build
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Attachment is a document about a platform image, such as an SBOM. It is
+// pushed as an OCI referrer of the image to registries and written next to
+// the output of local targets.
+type Attachment struct {
+	// ArtifactType is the referrer's artifact type, e.g. application/spdx+json.
+	ArtifactType string
+	// MediaType is the media type of Data. Empty means ArtifactType.
+	MediaType string
+	Data      []byte
+	// Annotations are set on the referrer's layer along with its title.
+	Annotations map[string]string
+	// Extension names the file written for local targets, e.g. .spdx.json.
+	Extension string
+}
+
+// referrer wraps the attachment in an OCI artifact manifest whose subject is the image.
+func (a Attachment) referrer(subject v1.Descriptor) (v1.Image, error) {
+	mediaType := a.MediaType
+	if mediaType == "" {
+		mediaType = a.ArtifactType
+	}
+	annotations := map[string]string{"org.opencontainers.image.title": "attachment" + a.Extension}
+	maps.Copy(annotations, a.Annotations)
+	img, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer:       static.NewLayer(a.Data, types.MediaType(mediaType)),
+		Annotations: annotations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Registries and clients fall back to the config media type for the artifact type
+	img = mutate.ConfigMediaType(img, types.MediaType(a.ArtifactType))
+	subject = v1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	referrer, ok := mutate.Subject(img, subject).(v1.Image)
+	if !ok {
+		return nil, fmt.Errorf("failed to set referrer subject")
+	}
+	return referrer, nil
+}
+
+// publishAttachments pushes the attachments of the published platform images
+// to a REMOTE target's repository, or writes them as files for local targets.
+func publishAttachments(ctx BuildContext, platforms []PlatformResult, target BuildSpecTarget) error {
+	refs, err := target.Refs()
+	if err != nil {
+		return err
+	}
+	repo := refs[0].Context()
+	multiPlatform := len(platforms) > 1
+
+	for _, platform := range platforms {
+		for _, a := range platform.Attachments {
+			if target.Type != REMOTE {
+				file := attachmentPath(target, platform.Platform, multiPlatform, a.Extension)
+				if err := os.WriteFile(file, a.Data, 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %w", a.ArtifactType, err)
+				}
+				log.Printf("Wrote %s: %s", a.ArtifactType, file)
+				continue
+			}
+
+			referrer, err := a.referrer(platform.Descriptor)
+			if err != nil {
+				return fmt.Errorf("failed to create %s referrer: %w", a.ArtifactType, err)
+			}
+			digest, err := referrer.Digest()
+			if err != nil {
+				return fmt.Errorf("failed to retrieve referrer digest: %w", err)
+			}
+			ref := repo.Digest(digest.String())
+			if err := remote.Write(ref, referrer, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain)); err != nil {
+				return fmt.Errorf("failed to push %s referrer: %w", a.ArtifactType, err)
+			}
+			log.Printf("Attached %s: %s", a.ArtifactType, ref)
+		}
+	}
+	return nil
+}
+
+// attachmentPath names the file an attachment is written to for a local
+// target: next to its output, or named after the repository in the working
+// directory for the daemon.
+// Multi-platform builds write one file per platform, e.g. out.tar.linux-arm64.spdx.json.
+func attachmentPath(target BuildSpecTarget, platform string, multiPlatform bool, extension string) string {
+	base := target.OutputPath()
+	if target.Type == LOCAL_DAEMON {
+		if refs, err := target.Refs(); err == nil {
+			base = path.Base(refs[0].Context().RepositoryStr())
+		}
+	}
+	if multiPlatform {
+		base += "." + strings.ReplaceAll(platform, "/", "-")
+	}
+	return base + extension
+}
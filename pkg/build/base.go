@@ -3,12 +3,14 @@ package build
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 type BaseImageMetadata struct {
@@ -16,46 +18,46 @@ type BaseImageMetadata struct {
 	imageDigest string
 }
 
-func getBaseImage(ctx BuildContext, baseRef string, platform Platform, keychain authn.Keychain) (v1.Image, BaseImageMetadata, error) {
+func getBaseImage(ctx BuildContext, baseRef string, platform Platform, scratchFormat ImageFormat, keychain authn.Keychain) (v1.Image, BaseImageMetadata, error) {
 	if baseRef == "scratch" {
-		return empty.Image, BaseImageMetadata{
+		img, err := getScratchImage(scratchFormat)
+		if err != nil {
+			return nil, BaseImageMetadata{}, err
+		}
+		return img, BaseImageMetadata{
 			name: "scratch",
 		}, nil
 	}
 
-	ref, err := name.ParseReference(baseRef)
-	if err != nil {
-		return nil, BaseImageMetadata{}, fmt.Errorf("failed to parse base image reference: %w", err)
+	var violations []string
+	if ctx.Policy != nil {
+		var allowed bool
+		var err error
+		violations, allowed, err = ctx.Policy.checkRef(ctx, baseRef)
+		if err != nil {
+			return nil, BaseImageMetadata{}, err
+		}
+		if !allowed {
+			return nil, BaseImageMetadata{}, policyError(baseRef, violations)
+		}
 	}
 
-	desc, err := remote.Get(ref, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(keychain))
+	src, err := resolveBaseSource(ctx, baseRef, keychain)
 	if err != nil {
-		return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image: %w", err)
+		return nil, BaseImageMetadata{}, err
 	}
 
-	log.Println("Using base image:", ref.Context().Digest(desc.Digest.String()))
-
 	var img v1.Image
-	switch {
-	case desc.MediaType.IsIndex():
-		index, err := desc.ImageIndex()
-		if err != nil {
-			return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image index: %w", err)
-		}
-		img, err = getImageForPlatform(index, platform)
+	if src.index != nil {
+		img, err = getImageForPlatform(src.index, platform)
 		if err != nil {
 			return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image for platform: %w", err)
 		}
-	case desc.MediaType.IsImage():
-		img, err = desc.Image()
-		if err != nil {
-			return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image: %w", err)
-		}
+	} else {
+		img = src.image
 		if err := verifyImagePlatform(img, platform); err != nil {
 			return nil, BaseImageMetadata{}, err
 		}
-	default:
-		return nil, BaseImageMetadata{}, fmt.Errorf("unsupported base image media type: %s", desc.MediaType)
 	}
 
 	imgDigest, err := img.Digest()
@@ -63,12 +65,144 @@ func getBaseImage(ctx BuildContext, baseRef string, platform Platform, keychain
 		return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image digest: %w", err)
 	}
 
+	if err := verifyLockedPlatform(ctx, baseRef, platform, imgDigest.String()); err != nil {
+		return nil, BaseImageMetadata{}, err
+	}
+
+	// Evaluated on the manifest and config only, before any layer is pulled
+	if ctx.Policy != nil {
+		imageViolations, err := ctx.Policy.checkImage(img, time.Now())
+		if err != nil {
+			return nil, BaseImageMetadata{}, err
+		}
+		violations = append(violations, imageViolations...)
+		if len(violations) > 0 {
+			return nil, BaseImageMetadata{}, policyError(baseRef, violations)
+		}
+	}
+
+	if ctx.Verifier != nil {
+		if src.repo == nil {
+			return nil, BaseImageMetadata{}, fmt.Errorf("cannot verify the signature of %s: signatures are only read from registries", baseRef)
+		}
+		digests := []v1.Hash{imgDigest}
+		if src.index != nil {
+			indexDigest, err := src.index.Digest()
+			if err != nil {
+				return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image index digest: %w", err)
+			}
+			digests = append(digests, indexDigest)
+		}
+		if err := verifyBaseSignature(ctx, *src.repo, digests); err != nil {
+			return nil, BaseImageMetadata{}, err
+		}
+	}
+
+	if ctx.Cache != nil && isLockable(baseRef) {
+		var indexDigests []v1.Hash
+		if src.index != nil {
+			indexDigest, err := src.index.Digest()
+			if err != nil {
+				return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image index digest: %w", err)
+			}
+			indexDigests = append(indexDigests, indexDigest)
+		}
+		if err := ctx.Cache.fill(img, indexDigests...); err != nil {
+			return nil, BaseImageMetadata{}, fmt.Errorf("failed to cache base image: %w", err)
+		}
+	}
+
 	return img, BaseImageMetadata{
-		name:        ref.Context().Name(),
+		name:        src.name,
 		imageDigest: imgDigest.String(),
 	}, nil
 }
 
+// baseSource is a base image reference resolved to either an index or a single image.
+type baseSource struct {
+	// name is recorded in the org.opencontainers.image.base.name label. Empty
+	// for local bases that don't name their repository.
+	name  string
+	index v1.ImageIndex
+	image v1.Image
+	// repo is the registry repository the image was resolved from, or nil for local bases
+	repo *name.Repository
+}
+
+func resolveBaseSource(ctx BuildContext, baseRef string, keychain authn.Keychain) (baseSource, error) {
+	if isLocalBaseRef(baseRef) {
+		return resolveLocalBaseSource(ctx, baseRef)
+	}
+
+	ref, err := name.ParseReference(baseRef)
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to parse base image reference: %w", err)
+	}
+
+	ref, err = lockedBaseRef(ctx, ref, baseRef)
+	if err != nil {
+		return baseSource{}, err
+	}
+
+	fetch := func() (baseSource, error) {
+		return fetchRemoteBaseSource(ctx, ref, keychain)
+	}
+	var src baseSource
+	switch {
+	case ctx.Cache != nil:
+		src, err = resolveCachedBaseSource(ctx, ref, fetch)
+	case ctx.Offline:
+		return baseSource{}, fmt.Errorf("offline builds need a cache directory to read %s from", ref)
+	default:
+		src, err = fetch()
+	}
+	if err != nil {
+		return baseSource{}, err
+	}
+	repo := ref.Context()
+	src.repo = &repo
+	return src, nil
+}
+
+func fetchRemoteBaseSource(ctx BuildContext, ref name.Reference, keychain authn.Keychain) (baseSource, error) {
+	desc, err := remoteGet(ctx, ref, keychain)
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to retrieve base image: %w", err)
+	}
+
+	log.Println("Using base image:", ref.Context().Digest(desc.Digest.String()))
+
+	src := baseSource{name: ref.Context().Name()}
+	switch {
+	case desc.MediaType.IsIndex():
+		src.index, err = desc.ImageIndex()
+		if err != nil {
+			return baseSource{}, fmt.Errorf("failed to retrieve base image index: %w", err)
+		}
+	case desc.MediaType.IsImage():
+		src.image, err = desc.Image()
+		if err != nil {
+			return baseSource{}, fmt.Errorf("failed to retrieve base image: %w", err)
+		}
+	default:
+		return baseSource{}, fmt.Errorf("unsupported base image media type: %s", desc.MediaType)
+	}
+	return src, nil
+}
+
+// getScratchImage returns an empty image using the manifest and config media types of format.
+func getScratchImage(format ImageFormat) (v1.Image, error) {
+	switch format {
+	case FORMAT_DOCKER:
+		return empty.Image, nil
+	case FORMAT_OCI:
+		img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+		return mutate.ConfigMediaType(img, types.OCIConfigJSON), nil
+	default:
+		return nil, fmt.Errorf("unknown scratch image format: %d", format)
+	}
+}
+
 func getImageForPlatform(index v1.ImageIndex, platform Platform) (v1.Image, error) {
 	digest, err := getDigestForPlatform(index, platform)
 	if err != nil {
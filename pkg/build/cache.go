@@ -0,0 +1,846 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// BlobCache is a content-addressed on-disk cache of base image manifests, configs and layers.
+//
+//	<dir>/blobs/sha256/<hex>        raw manifest, config or compressed layer bytes
+//	<dir>/media-types/sha256/<hex>  media type of a cached manifest
+//	<dir>/signatures/sha256/<hex>   digests of verified signature manifests of a manifest, one per line
+//
+// Blobs are evicted least-recently-used first once the blobs exceed maxSize.
+type BlobCache struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+	// size is the running total of the blobs, or -1 until they were first counted
+	size int64
+	// inUse are the manifests this build read or wrote and the blobs of the
+	// images it filled, which eviction leaves alone
+	inUse map[v1.Hash]bool
+}
+
+// NewBlobCache opens (creating if needed) a cache in dir. A maxSize of 0 disables eviction.
+func NewBlobCache(dir string, maxSize int64) (*BlobCache, error) {
+	c := &BlobCache{dir: dir, maxSize: maxSize, size: -1, inUse: make(map[v1.Hash]bool)}
+	for _, sub := range []string{"blobs", "media-types", "signatures"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub, "sha256"), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *BlobCache) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+func (c *BlobCache) mediaTypePath(h v1.Hash) string {
+	return filepath.Join(c.dir, "media-types", h.Algorithm, h.Hex)
+}
+
+func (c *BlobCache) signaturesPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "signatures", h.Algorithm, h.Hex)
+}
+
+// open returns the cached blob for h, marking it as recently used.
+func (c *BlobCache) open(h v1.Hash) (*os.File, error) {
+	p := c.blobPath(h)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	c.touch(h)
+	return f, nil
+}
+
+// touch marks the cached blob for h as recently used.
+func (c *BlobCache) touch(h v1.Hash) {
+	now := time.Now()
+	_ = os.Chtimes(c.blobPath(h), now, now)
+}
+
+func (c *BlobCache) bytes(h v1.Hash) ([]byte, error) {
+	f, err := c.open(h)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (c *BlobCache) putBytes(h v1.Hash, data []byte) error {
+	return c.put(h, io.NopCloser(bytes.NewReader(data)))
+}
+
+// put stores the contents of rc under h, verifying the digest before the blob becomes visible.
+func (c *BlobCache) put(h v1.Hash, rc io.ReadCloser) error {
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.blobPath(h)), h.Hex+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hasher), rc)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != h.Hex {
+		return fmt.Errorf("cached blob digest mismatch: expected %s, got sha256:%s", h, got)
+	}
+	if err := os.Rename(tmp.Name(), c.blobPath(h)); err != nil {
+		return err
+	}
+	return c.added(h, n)
+}
+
+func (c *BlobCache) putManifest(h v1.Hash, mediaType types.MediaType, raw []byte) error {
+	c.pin(h)
+	if err := c.putBytes(h, raw); err != nil {
+		return err
+	}
+	return os.WriteFile(c.mediaTypePath(h), []byte(mediaType), 0o644)
+}
+
+// manifest returns a cached manifest and its media type. ok is false when it is not cached.
+func (c *BlobCache) manifest(h v1.Hash) ([]byte, types.MediaType, bool, error) {
+	mt, err := os.ReadFile(c.mediaTypePath(h))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	raw, err := c.bytes(h)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	c.pin(h)
+	return raw, types.MediaType(mt), true, nil
+}
+
+// pin keeps the blobs hs from eviction for the rest of the build.
+func (c *BlobCache) pin(hs ...v1.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range hs {
+		c.inUse[h] = true
+	}
+}
+
+// added accounts for a blob of n bytes just stored under h. The cache directory
+// is only scanned the first time and once the running total crosses maxSize.
+func (c *BlobCache) added(h v1.Hash, n int64) error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size >= 0 {
+		c.size += n
+		if c.size <= c.maxSize {
+			return nil
+		}
+	}
+	return c.evict(h)
+}
+
+// putSignature stores sig, a verified signature image of the manifest h, so
+// that offline builds can check it again.
+func (c *BlobCache) putSignature(h v1.Hash, sig v1.Image) error {
+	cached, err := c.wrapImage(sig)
+	if err != nil {
+		return err
+	}
+	if err := c.fill(cached); err != nil {
+		return err
+	}
+	sigDigest, err := sig.Digest()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := os.ReadFile(c.signaturesPath(h))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if slices.Contains(strings.Fields(string(data)), sigDigest.String()) {
+		return nil
+	}
+	return os.WriteFile(c.signaturesPath(h), fmt.Appendf(data, "%s\n", sigDigest), 0o644)
+}
+
+// signatures returns the cached signature images of the manifest h. Signatures
+// whose blobs were evicted since are left out.
+func (c *BlobCache) signatures(h v1.Hash) ([]v1.Image, error) {
+	data, err := os.ReadFile(c.signaturesPath(h))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []v1.Image
+	for _, line := range strings.Fields(string(data)) {
+		sigDigest, err := v1.NewHash(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature digest in cache: %w", err)
+		}
+		raw, mt, ok, err := c.manifest(sigDigest)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		sig, err := c.image(raw, mt, nil)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// evict removes least-recently-used blobs until the cache fits in maxSize, and
+// recounts its size. It leaves alone keep, the blob that was just written and
+// that the build is about to read even if it alone exceeds maxSize, and the
+// blobs of images in use.
+func (c *BlobCache) evict(keep v1.Hash) error {
+	entries, err := os.ReadDir(filepath.Join(c.dir, "blobs", "sha256"))
+	if err != nil {
+		return err
+	}
+
+	type blob struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var blobs []blob
+	var total int64
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		total += info.Size()
+		if h := (v1.Hash{Algorithm: "sha256", Hex: e.Name()}); h != keep && !c.inUse[h] {
+			blobs = append(blobs, blob{e.Name(), info.Size(), info.ModTime()})
+		}
+	}
+	c.size = total
+	if total <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].modTime.Before(blobs[j].modTime) })
+	for _, b := range blobs {
+		if total <= c.maxSize {
+			break
+		}
+		h := v1.Hash{Algorithm: "sha256", Hex: b.name}
+		if err := os.Remove(c.blobPath(h)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		_ = os.Remove(c.mediaTypePath(h))
+		total -= b.size
+		c.size = total
+	}
+	return nil
+}
+
+// ParseByteSize parses sizes such as "512MiB", "10G" or "1048576". Units are binary.
+func ParseByteSize(str string) (int64, error) {
+	s := strings.TrimSpace(str)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+
+	multiplier := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", str)
+	}
+	return n * multiplier, nil
+}
+
+// resolveCachedBaseSource resolves a registry base image through the cache.
+// Digest references already in the cache are served without touching the network;
+// everything else is fetched and written through. Offline, only the former works.
+func resolveCachedBaseSource(ctx BuildContext, ref name.Reference, fetch func() (baseSource, error)) (baseSource, error) {
+	cache := ctx.Cache
+	if digestRef, ok := ref.(name.Digest); ok {
+		h, err := v1.NewHash(digestRef.DigestStr())
+		if err != nil {
+			return baseSource{}, err
+		}
+		var refetch func() (baseSource, error)
+		if !ctx.Offline {
+			refetch = fetch
+		}
+		src, ok, err := cache.source(h, ref.Context().Name(), refetch)
+		if err != nil {
+			return baseSource{}, fmt.Errorf("failed to read base image from cache: %w", err)
+		}
+		if ok {
+			log.Println("Using base image from cache:", ref)
+			if !ctx.Offline {
+				src = mountableSource(src, ref.Context())
+			}
+			return src, nil
+		}
+		if ctx.Offline {
+			return baseSource{}, fmt.Errorf("base image %s is not in the cache at %s; run an online build once to populate it", ref, cache.dir)
+		}
+	} else if ctx.Offline {
+		return baseSource{}, fmt.Errorf("offline builds need a digest-pinned base image (or a lockfile entry), got %s", ref)
+	}
+
+	src, err := fetch()
+	if err != nil {
+		return baseSource{}, err
+	}
+	src, err = cache.wrapSource(src)
+	if err != nil {
+		return baseSource{}, err
+	}
+	return mountableSource(src, ref.Context()), nil
+}
+
+// mountableSource marks the layers of a cached source as coming from repo, as
+// remote does for the layers it fetches, so that pushing to the same registry
+// mounts them instead of uploading them from the cache.
+func mountableSource(src baseSource, repo name.Repository) baseSource {
+	if src.index != nil {
+		src.index = &mountableIndex{index: src.index, repo: repo}
+	} else {
+		src.image = &mountableImage{Image: src.image, repo: repo}
+	}
+	return src
+}
+
+type mountableIndex struct {
+	index v1.ImageIndex
+	repo  name.Repository
+}
+
+func (i *mountableIndex) MediaType() (types.MediaType, error)       { return i.index.MediaType() }
+func (i *mountableIndex) Digest() (v1.Hash, error)                  { return i.index.Digest() }
+func (i *mountableIndex) Size() (int64, error)                      { return i.index.Size() }
+func (i *mountableIndex) IndexManifest() (*v1.IndexManifest, error) { return i.index.IndexManifest() }
+func (i *mountableIndex) RawManifest() ([]byte, error)              { return i.index.RawManifest() }
+
+func (i *mountableIndex) Image(h v1.Hash) (v1.Image, error) {
+	img, err := i.index.Image(h)
+	if err != nil {
+		return nil, err
+	}
+	return &mountableImage{Image: img, repo: i.repo}, nil
+}
+
+func (i *mountableIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	idx, err := i.index.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+	return &mountableIndex{index: idx, repo: i.repo}, nil
+}
+
+type mountableImage struct {
+	v1.Image
+	repo name.Repository
+}
+
+func (i *mountableImage) mountable(l v1.Layer) (v1.Layer, error) {
+	digest, err := i.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &remote.MountableLayer{Layer: l, Reference: i.repo.Digest(digest.String())}, nil
+}
+
+func (i *mountableImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for n, l := range layers {
+		if layers[n], err = i.mountable(l); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+func (i *mountableImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mountable(l)
+}
+
+func (i *mountableImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mountable(l)
+}
+
+// fill makes sure the manifest, config and every layer of img are in the cache,
+// so that a later offline build does not depend on which blobs this build
+// happened to read. These blobs and also, such as the index img was selected
+// from, are marked as recently used and pinned for the rest of the build.
+func (c *BlobCache) fill(img v1.Image, also ...v1.Hash) error {
+	manifestDigest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	configDigest, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	digests := append([]v1.Hash{manifestDigest, configDigest}, also...)
+	for _, layer := range layers {
+		h, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		digests = append(digests, h)
+	}
+	c.pin(digests...)
+	for _, h := range digests {
+		c.touch(h)
+	}
+
+	if _, err := img.RawConfigFile(); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		h, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(c.blobPath(h)); err == nil {
+			continue
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, rc)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexFetcher and imageFetcher load the upstream copy of a cached manifest.
+// They are only called on a cache miss, and are nil when offline.
+type indexFetcher func() (v1.ImageIndex, error)
+type imageFetcher func() (v1.Image, error)
+
+// source loads a cached index or image manifest. Missing blobs referenced by it are
+// only detected when they are read, at which point fetch (if not nil) is used.
+func (c *BlobCache) source(h v1.Hash, baseName string, fetch func() (baseSource, error)) (baseSource, bool, error) {
+	raw, mt, ok, err := c.manifest(h)
+	if err != nil || !ok {
+		return baseSource{}, false, err
+	}
+
+	var fetchIndex indexFetcher
+	var fetchImage imageFetcher
+	if fetch != nil {
+		fetchOnce := sync.OnceValues(fetch)
+		fetchIndex = func() (v1.ImageIndex, error) {
+			src, err := fetchOnce()
+			return src.index, err
+		}
+		fetchImage = func() (v1.Image, error) {
+			src, err := fetchOnce()
+			return src.image, err
+		}
+	}
+
+	src := baseSource{name: baseName}
+	switch {
+	case mt.IsIndex():
+		src.index, err = c.index(raw, mt, fetchIndex)
+	case mt.IsImage():
+		src.image, err = c.image(raw, mt, fetchImage)
+	default:
+		return baseSource{}, false, fmt.Errorf("unsupported cached media type: %s", mt)
+	}
+	return src, err == nil, err
+}
+
+// wrapSource stores the manifest of a freshly fetched source and returns a cache-backed copy.
+func (c *BlobCache) wrapSource(src baseSource) (baseSource, error) {
+	var err error
+	if src.index != nil {
+		src.index, err = c.wrapIndex(src.index)
+	} else {
+		src.image, err = c.wrapImage(src.image)
+	}
+	return src, err
+}
+
+func (c *BlobCache) wrapIndex(upstream v1.ImageIndex) (v1.ImageIndex, error) {
+	raw, err := upstream.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := upstream.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	h, err := upstream.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.putManifest(h, mt, raw); err != nil {
+		return nil, fmt.Errorf("failed to cache base image index: %w", err)
+	}
+	return c.index(raw, mt, func() (v1.ImageIndex, error) { return upstream, nil })
+}
+
+func (c *BlobCache) wrapImage(upstream v1.Image) (v1.Image, error) {
+	raw, err := upstream.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := upstream.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	h, err := upstream.Digest()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.putManifest(h, mt, raw); err != nil {
+		return nil, fmt.Errorf("failed to cache base image manifest: %w", err)
+	}
+	return c.image(raw, mt, func() (v1.Image, error) { return upstream, nil })
+}
+
+func (c *BlobCache) index(raw []byte, mt types.MediaType, upstream indexFetcher) (v1.ImageIndex, error) {
+	manifest, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return &cachedIndex{cache: c, raw: raw, mediaType: mt, manifest: manifest, upstream: upstream}, nil
+}
+
+func (c *BlobCache) image(raw []byte, mt types.MediaType, upstream imageFetcher) (v1.Image, error) {
+	return partial.CompressedToImage(&cachedImage{cache: c, raw: raw, mediaType: mt, upstream: upstream})
+}
+
+// cachedIndex serves child manifests from the cache, falling back to upstream when set.
+type cachedIndex struct {
+	cache     *BlobCache
+	raw       []byte
+	mediaType types.MediaType
+	manifest  *v1.IndexManifest
+	upstream  indexFetcher
+}
+
+func (i *cachedIndex) MediaType() (types.MediaType, error)       { return i.mediaType, nil }
+func (i *cachedIndex) Digest() (v1.Hash, error)                  { return partial.Digest(i) }
+func (i *cachedIndex) Size() (int64, error)                      { return partial.Size(i) }
+func (i *cachedIndex) IndexManifest() (*v1.IndexManifest, error) { return i.manifest.DeepCopy(), nil }
+func (i *cachedIndex) RawManifest() ([]byte, error)              { return i.raw, nil }
+
+func (i *cachedIndex) Image(h v1.Hash) (v1.Image, error) {
+	raw, mt, ok, err := i.cache.manifest(h)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		var fetch imageFetcher
+		if i.upstream != nil {
+			fetch = func() (v1.Image, error) {
+				idx, err := i.upstream()
+				if err != nil {
+					return nil, err
+				}
+				return idx.Image(h)
+			}
+		}
+		return i.cache.image(raw, mt, fetch)
+	}
+	if i.upstream == nil {
+		return nil, fmt.Errorf("manifest %s is not in the cache", h)
+	}
+	idx, err := i.upstream()
+	if err != nil {
+		return nil, err
+	}
+	img, err := idx.Image(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.cache.wrapImage(img)
+}
+
+func (i *cachedIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	raw, mt, ok, err := i.cache.manifest(h)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		var fetch indexFetcher
+		if i.upstream != nil {
+			fetch = func() (v1.ImageIndex, error) {
+				idx, err := i.upstream()
+				if err != nil {
+					return nil, err
+				}
+				return idx.ImageIndex(h)
+			}
+		}
+		return i.cache.index(raw, mt, fetch)
+	}
+	if i.upstream == nil {
+		return nil, fmt.Errorf("index %s is not in the cache", h)
+	}
+	parent, err := i.upstream()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := parent.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.cache.wrapIndex(idx)
+}
+
+// cachedImage reads its config and layers from the cache, fetching and storing them
+// from upstream on a miss.
+type cachedImage struct {
+	cache     *BlobCache
+	raw       []byte
+	mediaType types.MediaType
+	upstream  imageFetcher
+}
+
+func (i *cachedImage) MediaType() (types.MediaType, error) { return i.mediaType, nil }
+func (i *cachedImage) RawManifest() ([]byte, error)        { return i.raw, nil }
+
+func (i *cachedImage) RawConfigFile() ([]byte, error) {
+	manifest, err := v1.ParseManifest(bytes.NewReader(i.raw))
+	if err != nil {
+		return nil, err
+	}
+	h := manifest.Config.Digest
+
+	data, err := i.cache.bytes(h)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if i.upstream == nil {
+		return nil, fmt.Errorf("config %s is not in the cache", h)
+	}
+
+	upstream, err := i.upstream()
+	if err != nil {
+		return nil, err
+	}
+	data, err = upstream.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := i.cache.putBytes(h, data); err != nil {
+		return nil, fmt.Errorf("failed to cache base image config: %w", err)
+	}
+	return data, nil
+}
+
+func (i *cachedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	manifest, err := v1.ParseManifest(bytes.NewReader(i.raw))
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Layers {
+		if desc.Digest == h {
+			return &cachedLayer{image: i, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found in manifest", h)
+}
+
+type cachedLayer struct {
+	image *cachedImage
+	desc  v1.Descriptor
+}
+
+func (l *cachedLayer) Digest() (v1.Hash, error)            { return l.desc.Digest, nil }
+func (l *cachedLayer) Size() (int64, error)                { return l.desc.Size, nil }
+func (l *cachedLayer) MediaType() (types.MediaType, error) { return l.desc.MediaType, nil }
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	cache := l.image.cache
+	f, err := cache.open(l.desc.Digest)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if l.image.upstream == nil {
+		return nil, fmt.Errorf("layer %s is not in the cache", l.desc.Digest)
+	}
+
+	upstream, err := l.image.upstream()
+	if err != nil {
+		return nil, err
+	}
+	layer, err := upstream.LayerByDigest(l.desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return newCachingReader(cache, l.desc.Digest, rc)
+}
+
+// cachingReader tees a blob into the cache while it is read, committing it
+// only when the whole blob was read and its digest matches.
+type cachingReader struct {
+	cache  *BlobCache
+	digest v1.Hash
+	src    io.ReadCloser
+	tmp    *os.File
+	hasher hash.Hash
+	size   int64
+	done   bool
+}
+
+func newCachingReader(cache *BlobCache, digest v1.Hash, src io.ReadCloser) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(cache.blobPath(digest)), digest.Hex+".*.tmp")
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &cachingReader{cache: cache, digest: digest, src: src, tmp: tmp, hasher: sha256.New()}, nil
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if n > 0 && r.tmp != nil {
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			r.discard()
+		} else {
+			r.hasher.Write(p[:n])
+			r.size += int64(n)
+		}
+	}
+	if err == io.EOF {
+		r.done = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	err := r.src.Close()
+	if r.tmp == nil {
+		return err
+	}
+	if !r.done || hex.EncodeToString(r.hasher.Sum(nil)) != r.digest.Hex {
+		r.discard()
+		return err
+	}
+
+	name := r.tmp.Name()
+	if cerr := r.tmp.Close(); cerr != nil {
+		os.Remove(name)
+		return err
+	}
+	if rerr := os.Rename(name, r.cache.blobPath(r.digest)); rerr != nil {
+		os.Remove(name)
+		log.Printf("failed to cache blob %s: %v", r.digest, rerr)
+		return err
+	}
+	if eerr := r.cache.added(r.digest, r.size); eerr != nil {
+		log.Printf("failed to evict cache entries: %v", eerr)
+	}
+	return err
+}
+
+func (r *cachingReader) discard() {
+	if r.tmp != nil {
+		r.tmp.Close()
+		os.Remove(r.tmp.Name())
+		r.tmp = nil
+	}
+}
@@ -0,0 +1,288 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"512MiB": 512 << 20,
+		"10G":    10 << 30,
+		"2KB":    2 << 10,
+		"1Ti":    1 << 40,
+	}
+	for in, want := range cases {
+		got, err := ParseByteSize(in)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", in, err)
+		}
+		if got != want {
+			t.Fatalf("%s: got %d, want %d", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "abc", "-1", "10X"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Fatalf("%s: expected error", in)
+		}
+	}
+}
+
+func pushTestBase(t *testing.T, host string) (name.Digest, v1.Image) {
+	t.Helper()
+	amd64 := Platform{OS: "linux", Arch: "amd64"}
+	img := imageWithFiles(t, map[string]string{"etc/os-release": "ID=test\n"}, nil)
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture = amd64.OS, amd64.Arch
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        img,
+		Descriptor: v1.Descriptor{Platform: amd64.ToV1Platform()},
+	})
+
+	tag, err := name.NewTag(host + "/base:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag.Context().Digest(digest.String()), img
+}
+
+func TestOfflineBuildFromCache(t *testing.T) {
+	ref, base := pushTestBase(t, newTestRegistry(t))
+
+	ctx := newTestBuildContext(t)
+	cache, err := NewBlobCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Cache = cache
+
+	srcDir := createTestSourceDir(t, map[string]string{"mybin": "binary"})
+	spec := newScratchBuildSpec(srcDir)
+	spec.BaseRef = ref.String()
+
+	online, _, err := buildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("online build failed: %v", err)
+	}
+
+	layers, err := base.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cache.blobPath(layerDigest)); err != nil {
+		t.Fatalf("expected base layer to be cached: %v", err)
+	}
+
+	// Offline, the cache has nothing to fall back to, so a missing blob fails the build
+	ctx.Offline = true
+
+	offline, _, err := buildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("offline build failed: %v", err)
+	}
+	d1, _ := online.Digest()
+	d2, _ := offline.Digest()
+	if d1 != d2 {
+		t.Fatalf("offline digest %s differs from online digest %s", d2, d1)
+	}
+
+	// Reading the base layers must not need the network either
+	if _, err := offline.Layers(); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layers[0].Compressed()
+	if err == nil {
+		rc.Close()
+	}
+
+	spec.BaseRef = ref.Context().Tag("latest").String()
+	_, _, err = buildImage(ctx, spec)
+	if err == nil || !strings.Contains(err.Error(), "digest-pinned") {
+		t.Fatalf("expected offline tag reference to fail, got %v", err)
+	}
+}
+
+func TestOfflineBuildCacheMiss(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	cache, err := NewBlobCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Cache = cache
+	ctx.Offline = true
+
+	_, _, err = getBaseImage(ctx, "example.com/base@sha256:"+strings.Repeat("a", 64), Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil || !strings.Contains(err.Error(), "not in the cache") {
+		t.Fatalf("expected cache miss error, got %v", err)
+	}
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"aaaaaa", "bbbbbb"} {
+		h, _, err := v1.SHA256(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.putBytes(h, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected eviction down to one blob, got %d", len(entries))
+	}
+}
+
+func TestBlobCacheKeepsBlobJustWritten(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewBlobCache(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "larger than the cache"
+	h, _, err := v1.SHA256(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.putBytes(h, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cache.bytes(h); err != nil || string(data) != content {
+		t.Fatalf("expected the blob just written to survive eviction, got %q, %v", data, err)
+	}
+}
+
+func TestBlobCacheFillKeepsBaseWithinSmallMaxSize(t *testing.T) {
+	host := newTestRegistry(t)
+	base := imageWithFiles(t, map[string]string{"etc/os-release": "ID=test\n"}, nil)
+	extra, err := imageWithFiles(t, map[string]string{"usr/lib/libfoo.so": strings.Repeat("x", 4096)}, nil).Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err = mutate.AppendLayers(base, extra...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := base.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture = "linux", "amd64"
+	base, err = mutate.ConfigFile(base, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(host + "/base:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, base); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The base alone is larger than the cache may grow
+	dir := t.TempDir()
+	ctx := newTestBuildContext(t)
+	ctx.Cache, err = NewBlobCache(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	spec.BaseRef = tag.Context().Digest(digest.String()).String()
+	if _, _, err := buildImage(ctx, spec); err != nil {
+		t.Fatalf("online build failed: %v", err)
+	}
+
+	ctx.Cache, err = NewBlobCache(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Offline = true
+	img, _, err := buildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("offline build failed: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range layers[:2] {
+		rc, err := layer.Compressed()
+		if err != nil {
+			t.Fatalf("expected base layer in the cache: %v", err)
+		}
+		rc.Close()
+	}
+}
+
+func TestCachedBaseLayersMountable(t *testing.T) {
+	ref, _ := pushTestBase(t, newTestRegistry(t))
+
+	ctx := newTestBuildContext(t)
+	cache, err := NewBlobCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Cache = cache
+
+	// Fetched on the first build and served from the cache on the second
+	for range 2 {
+		img, _, err := getBaseImage(ctx, ref.String(), Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ml, ok := layers[0].(*remote.MountableLayer)
+		if !ok || ml.Reference.Context() != ref.Context() {
+			t.Fatalf("expected a layer mountable from %s, got %T", ref.Context(), layers[0])
+		}
+	}
+}
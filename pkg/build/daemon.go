@@ -0,0 +1,127 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/moby/moby/client"
+)
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// daemonClient is a connection to the Docker-compatible daemon used by
+// LOCAL_DAEMON targets and daemon: base images.
+type daemonClient struct {
+	*client.Client
+
+	host   string
+	source string
+	engine string
+	os     string
+	arch   string
+}
+
+// resolveDaemonHost picks the daemon endpoint and says where it came from. An
+// empty host leaves the choice to the Docker client defaults.
+func resolveDaemonHost(explicit string) (host, source string) {
+	if explicit != "" {
+		return explicit, "--daemon-host"
+	}
+	if h := os.Getenv("DOCKER_HOST"); h != "" {
+		return h, "DOCKER_HOST"
+	}
+	if h := os.Getenv("CONTAINER_HOST"); h != "" {
+		return h, "CONTAINER_HOST"
+	}
+	// Rootless Podman only stands in when there's no Docker socket
+	if _, err := os.Stat(defaultDockerSocket); err != nil {
+		if sock := rootlessPodmanSocket(); sock != "" {
+			if _, err := os.Stat(sock); err == nil {
+				return "unix://" + sock, "rootless Podman socket"
+			}
+		}
+	}
+	return "", "default"
+}
+
+func rootlessPodmanSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		uid := os.Getuid()
+		if uid < 0 {
+			return ""
+		}
+		dir = fmt.Sprintf("/run/user/%d", uid)
+	}
+	return filepath.Join(dir, "podman", "podman.sock")
+}
+
+// connectDaemon connects to the daemon chosen by resolveDaemonHost. ssh:// hosts
+// go through the docker CLI connection helper, which needs docker on the remote.
+func connectDaemon(ctx BuildContext) (*daemonClient, error) {
+	host, source := resolveDaemonHost(ctx.DaemonHost)
+
+	opts := []client.Opt{client.FromEnv}
+	if host != "" {
+		helper, err := connhelper.GetConnectionHelper(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid daemon host %s: %w", host, err)
+		}
+		if helper != nil {
+			opts = append(opts, client.WithHost(helper.Host), client.WithDialContext(helper.Dialer))
+		} else {
+			opts = append(opts, client.WithHost(host))
+		}
+	}
+	c, err := client.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create daemon client for %s: %w", host, err)
+	}
+	if host == "" {
+		host = c.DaemonHost()
+	}
+
+	if _, err := c.Ping(ctx.Context, client.PingOptions{NegotiateAPIVersion: true}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to connect to daemon at %s (%s): %w", host, source, err)
+	}
+	version, err := c.ServerVersion(ctx.Context, client.ServerVersionOptions{})
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to query daemon at %s (%s): %w", host, source, err)
+	}
+
+	engine := version.Platform.Name
+	if engine == "" {
+		engine = "daemon"
+	}
+	return &daemonClient{
+		Client: c,
+		host:   host,
+		source: source,
+		engine: fmt.Sprintf("%s %s", engine, version.Version),
+		os:     version.Os,
+		arch:   version.Arch,
+	}, nil
+}
+
+func (d *daemonClient) String() string {
+	return fmt.Sprintf("%s at %s (%s)", d.engine, d.host, d.source)
+}
+
+// platform is the platform the daemon runs images for.
+func (d *daemonClient) platform() Platform {
+	p := Platform{OS: d.os, Arch: d.arch}
+	if p.OS == "" || p.Arch == "" {
+		p = Platform{OS: "linux", Arch: runtime.GOARCH}
+	}
+	return p
+}
+
+func (d *daemonClient) options(ctx BuildContext) []daemon.Option {
+	return []daemon.Option{daemon.WithContext(ctx.Context), daemon.WithClient(d.Client)}
+}
@@ -0,0 +1,165 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestResolveDaemonHost(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "tcp://docker.example:2376")
+	t.Setenv("CONTAINER_HOST", "unix:///run/podman/podman.sock")
+
+	if host, source := resolveDaemonHost("ssh://me@build"); host != "ssh://me@build" || source != "--daemon-host" {
+		t.Fatalf("explicit host not used: %s (%s)", host, source)
+	}
+	if host, source := resolveDaemonHost(""); host != "tcp://docker.example:2376" || source != "DOCKER_HOST" {
+		t.Fatalf("DOCKER_HOST not used: %s (%s)", host, source)
+	}
+
+	t.Setenv("DOCKER_HOST", "")
+	if host, source := resolveDaemonHost(""); host != "unix:///run/podman/podman.sock" || source != "CONTAINER_HOST" {
+		t.Fatalf("CONTAINER_HOST not used: %s (%s)", host, source)
+	}
+}
+
+func TestResolveDaemonHostRootlessPodman(t *testing.T) {
+	if _, err := os.Stat(defaultDockerSocket); err == nil {
+		t.Skip("a Docker socket exists, so Podman is not auto-detected")
+	}
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("CONTAINER_HOST", "")
+
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	if host, source := resolveDaemonHost(""); host != "" || source != "default" {
+		t.Fatalf("expected the default without a Podman socket, got %s (%s)", host, source)
+	}
+
+	sock := filepath.Join(runtimeDir, "podman", "podman.sock")
+	if err := os.MkdirAll(filepath.Dir(sock), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if host, source := resolveDaemonHost(""); host != "unix://"+sock || source != "rootless Podman socket" {
+		t.Fatalf("rootless Podman socket not detected: %s (%s)", host, source)
+	}
+}
+
+func TestConnectDaemon(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			w.Header().Set("Api-Version", "1.41")
+			w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/version"):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Platform":{"Name":"Podman Engine"},"Version":"5.2.0","ApiVersion":"1.41","Os":"linux","Arch":"arm64"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := newTestBuildContext(t)
+	ctx.DaemonHost = "tcp://" + strings.TrimPrefix(server.URL, "http://")
+	d, err := connectDaemon(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	want := "Podman Engine 5.2.0 at " + ctx.DaemonHost + " (--daemon-host)"
+	if d.String() != want {
+		t.Fatalf("expected %q, got %q", want, d.String())
+	}
+	if d.platform() != (Platform{OS: "linux", Arch: "arm64"}) {
+		t.Fatalf("unexpected daemon platform %s", d.platform())
+	}
+
+	server.Close()
+	if _, err := connectDaemon(ctx); err == nil || !strings.Contains(err.Error(), ctx.DaemonHost) {
+		t.Fatalf("expected an error naming the daemon host, got %v", err)
+	}
+}
+
+func TestResolveDaemonBaseOutlivesClient(t *testing.T) {
+	img := imageWithFiles(t, map[string]string{"etc/os-release": "ID=test\n"}, nil)
+	ref, err := name.NewTag("example/base:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved bytes.Buffer
+	if err := tarball.Write(ref, img, &saved); err != nil {
+		t.Fatal(err)
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect, err := json.Marshal(map[string]any{
+		"Id":           configName.String(),
+		"Os":           "linux",
+		"Architecture": "amd64",
+		"Created":      "2024-01-01T00:00:00Z",
+		"RootFS":       map[string]any{"Type": "layers", "Layers": cfg.RootFS.DiffIDs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			w.Header().Set("Api-Version", "1.41")
+			w.Write([]byte("OK"))
+		case strings.HasSuffix(r.URL.Path, "/version"):
+			w.Write([]byte(`{"Version":"27.0.0","ApiVersion":"1.41","Os":"linux","Arch":"amd64"}`))
+		case strings.HasSuffix(r.URL.Path, "/images/get"):
+			w.Write(saved.Bytes())
+		case strings.HasSuffix(r.URL.Path, "/history"):
+			w.Write([]byte("[]"))
+		case strings.HasSuffix(r.URL.Path, "/json"):
+			w.Write(inspect)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := newTestBuildContext(t)
+	ctx.DaemonHost = "tcp://" + strings.TrimPrefix(server.URL, "http://")
+	src, err := resolveDaemonBase(ctx, ref.String())
+	if err != nil {
+		t.Fatalf("resolveDaemonBase: %v", err)
+	}
+
+	// The client is closed once the base is resolved, so the image must not need the daemon any more
+	server.Close()
+	if _, err := src.image.ConfigFile(); err != nil {
+		t.Fatalf("ConfigFile: %v", err)
+	}
+	layers, err := src.image.Layers()
+	if err != nil || len(layers) != 1 {
+		t.Fatalf("Layers: %v", err)
+	}
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	rc.Close()
+}
@@ -0,0 +1,449 @@
+package build
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// elfPlatform is the platform an ELF file was built for.
+// OSKnown is false when the header does not name an OS (ELFOSABI_NONE),
+// which is the norm for linux binaries.
+type elfPlatform struct {
+	Platform Platform
+	OSKnown  bool
+}
+
+// readELFPlatform reads the ELF header of path and maps it to a Platform.
+// It returns ok=false for files that are not ELF, whose header can't be parsed,
+// or whose machine is not recognised.
+func readELFPlatform(path string) (elfPlatform, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return elfPlatform{}, false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return elfPlatform{}, false, nil
+		}
+		return elfPlatform{}, false, err
+	}
+	if string(magic) != elf.ELFMAG {
+		return elfPlatform{}, false, nil
+	}
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		// Firmware blobs, fixtures and truncated files can start with the ELF magic too
+		log.Printf("Skipping %s: failed to parse ELF header: %v", path, err)
+		return elfPlatform{}, false, nil
+	}
+	defer ef.Close()
+
+	if ef.Type != elf.ET_EXEC && ef.Type != elf.ET_DYN {
+		return elfPlatform{}, false, nil
+	}
+
+	arch, ok := elfArch(ef.FileHeader)
+	if !ok {
+		return elfPlatform{}, false, nil
+	}
+
+	result := elfPlatform{Platform: Platform{OS: "linux", Arch: arch}}
+	switch ef.OSABI {
+	case elf.ELFOSABI_NONE:
+	case elf.ELFOSABI_LINUX:
+		result.OSKnown = true
+	case elf.ELFOSABI_FREEBSD:
+		result.Platform.OS, result.OSKnown = "freebsd", true
+	case elf.ELFOSABI_NETBSD:
+		result.Platform.OS, result.OSKnown = "netbsd", true
+	case elf.ELFOSABI_OPENBSD:
+		result.Platform.OS, result.OSKnown = "openbsd", true
+	case elf.ELFOSABI_SOLARIS:
+		result.Platform.OS, result.OSKnown = "solaris", true
+	}
+
+	if arch == "arm" {
+		result.Platform.Variant = armVariant(ef, f)
+	}
+
+	return result, true, nil
+}
+
+// elfArch maps ELF machine, class and byte order to a GOARCH-style architecture.
+func elfArch(h elf.FileHeader) (string, bool) {
+	is64 := h.Class == elf.ELFCLASS64
+	le := h.Data == elf.ELFDATA2LSB
+
+	switch h.Machine {
+	case elf.EM_X86_64:
+		if is64 {
+			return "amd64", true
+		}
+	case elf.EM_386:
+		return "386", true
+	case elf.EM_AARCH64:
+		if is64 {
+			return "arm64", true
+		}
+	case elf.EM_ARM:
+		return "arm", true
+	case elf.EM_PPC64:
+		if le {
+			return "ppc64le", true
+		}
+		return "ppc64", true
+	case elf.EM_S390:
+		if is64 {
+			return "s390x", true
+		}
+	case elf.EM_RISCV:
+		if is64 {
+			return "riscv64", true
+		}
+	case elf.EM_LOONGARCH:
+		if is64 {
+			return "loong64", true
+		}
+	case elf.EM_MIPS, elf.EM_MIPS_RS3_LE:
+		arch := "mips"
+		if is64 {
+			arch = "mips64"
+		}
+		if le {
+			arch += "le"
+		}
+		return arch, true
+	}
+	return "", false
+}
+
+// armVariant derives the ARM variant (v5, v6, v7, ...) of a 32-bit ARM binary.
+// The .ARM.attributes section is preferred, with the GOARM build setting
+// of Go binaries as a fallback. An empty string means the variant is unknown.
+func armVariant(ef *elf.File, r io.ReaderAt) string {
+	if sec := ef.Section(".ARM.attributes"); sec != nil {
+		data, err := sec.Data()
+		if err == nil {
+			if arch, ok := parseARMCPUArch(data); ok {
+				return armCPUArchVariant(arch)
+			}
+		}
+	}
+
+	if info, err := buildinfo.Read(r); err == nil {
+		for _, s := range info.Settings {
+			if s.Key == "GOARM" && s.Value != "" {
+				return "v" + strings.SplitN(s.Value, ",", 2)[0]
+			}
+		}
+	}
+
+	return ""
+}
+
+// armCPUArchVariant maps a Tag_CPU_arch value to an OCI platform variant.
+func armCPUArchVariant(arch uint64) string {
+	switch {
+	case arch <= 5:
+		return "v5"
+	case arch <= 9, arch == 11, arch == 12:
+		return "v6"
+	case arch == 10, arch == 13:
+		return "v7"
+	default:
+		return "v8"
+	}
+}
+
+const armTagCPUArch = 6
+
+// parseARMCPUArch extracts Tag_CPU_arch from the "aeabi" subsection of an
+// .ARM.attributes section.
+func parseARMCPUArch(data []byte) (uint64, bool) {
+	if len(data) < 1 || data[0] != 'A' {
+		return 0, false
+	}
+	data = data[1:]
+
+	for len(data) >= 4 {
+		secLen := binary.LittleEndian.Uint32(data)
+		if secLen < 4 || int(secLen) > len(data) {
+			return 0, false
+		}
+		section := data[4:secLen]
+		data = data[secLen:]
+
+		vendor, rest, ok := bytes.Cut(section, []byte{0})
+		if !ok || string(vendor) != "aeabi" {
+			continue
+		}
+
+		for len(rest) >= 5 {
+			tag := rest[0]
+			subLen := binary.LittleEndian.Uint32(rest[1:])
+			if subLen < 5 || int(subLen) > len(rest) {
+				return 0, false
+			}
+			attrs := rest[5:subLen]
+			rest = rest[subLen:]
+
+			// Only file-scoped attributes describe the whole binary
+			if tag != 1 {
+				continue
+			}
+			if arch, ok := findARMAttribute(attrs, armTagCPUArch); ok {
+				return arch, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func findARMAttribute(attrs []byte, want uint64) (uint64, bool) {
+	for len(attrs) > 0 {
+		tag, n := binary.Uvarint(attrs)
+		if n <= 0 {
+			return 0, false
+		}
+		attrs = attrs[n:]
+
+		// Tags 4, 5 and 67 are NUL-terminated strings, 32 is a ULEB128
+		// followed by a string. Above 32, odd tags are strings.
+		isString := tag == 4 || tag == 5 || tag == 67 || (tag > 32 && tag%2 == 1)
+		if tag == 32 {
+			_, n := binary.Uvarint(attrs)
+			if n <= 0 {
+				return 0, false
+			}
+			attrs = attrs[n:]
+			isString = true
+		}
+
+		if isString {
+			_, rest, ok := bytes.Cut(attrs, []byte{0})
+			if !ok {
+				return 0, false
+			}
+			attrs = rest
+			continue
+		}
+
+		value, n := binary.Uvarint(attrs)
+		if n <= 0 {
+			return 0, false
+		}
+		attrs = attrs[n:]
+		if tag == want {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// elfPlatformMatches reports whether a binary built for got can run on the target platform.
+func elfPlatformMatches(got elfPlatform, target Platform) bool {
+	if got.OSKnown && got.Platform.OS != target.OS {
+		return false
+	}
+	if !got.OSKnown && !isELFOS(target.OS) {
+		return false
+	}
+	if got.Platform.Arch != target.Arch {
+		return false
+	}
+
+	// A binary built for an older ARM revision runs on newer ones, but not the other way around
+	if target.Arch == "arm" && got.Platform.Variant != "" && target.Variant != "" {
+		gotLevel, gotOK := armVariantLevel(got.Platform.Variant)
+		targetLevel, targetOK := armVariantLevel(target.Variant)
+		if !gotOK || !targetOK {
+			return got.Platform.Variant == target.Variant
+		}
+		return gotLevel <= targetLevel
+	}
+	return true
+}
+
+// armVariantLevel parses an ARM variant such as "v7" into its architecture
+// revision, so that v10 and later compare above v9.
+func armVariantLevel(variant string) (int, bool) {
+	digits, ok := strings.CutPrefix(strings.ToLower(variant), "v")
+	if !ok {
+		return 0, false
+	}
+	level, err := strconv.Atoi(digits)
+	if err != nil || level < 0 {
+		return 0, false
+	}
+	return level, true
+}
+
+func isELFOS(os string) bool {
+	return slices.Contains([]string{"linux", "freebsd", "netbsd", "openbsd", "solaris", "illumos", "android"}, os)
+}
+
+// verifySourcePlatform checks that every ELF executable or shared object in
+// srcPath was built for the target platform. Non-ELF files are ignored.
+func verifySourcePlatform(srcPath string, platform Platform) error {
+	var mismatches []string
+	err := filepath.WalkDir(srcPath, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		got, ok, err := readELFPlatform(file)
+		if err != nil {
+			return err
+		}
+		if !ok || elfPlatformMatches(got, platform) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(srcPath, file)
+		if err != nil {
+			return err
+		}
+		mismatches = append(mismatches, fmt.Sprintf("%s (%s)", relPath, got.Platform))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to inspect binaries in %s: %w", srcPath, err)
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("binaries in %s do not match target platform %s: %s", srcPath, platform, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// InferPlatformSpecs determines the platforms to build from the ELF binaries under sourceRoot.
+// If every binary lives in its platform's <os>/<arch>[/<variant>] directory, one spec is
+// returned per directory, with SourcePath set to it. Otherwise all binaries must share a
+// single platform and SourcePath is left empty, meaning sourceRoot itself.
+// Results are sorted by Platform.String(), matching ParsePlatformSpecs.
+func InferPlatformSpecs(sourceRoot string) ([]PlatformSpec, error) {
+	layout := make(map[string]Platform)
+	flat := make(map[string]Platform)
+	inLayout := true
+
+	err := filepath.WalkDir(sourceRoot, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		got, ok, err := readELFPlatform(file)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		flat[got.Platform.String()] = got.Platform
+
+		p, ok, err := platformDirFor(sourceRoot, file, got)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			inLayout = false
+			return nil
+		}
+		layout[p.String()] = p
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect binaries in %s: %w", sourceRoot, err)
+	}
+
+	found := layout
+	for _, p := range layout {
+		if p.Variant == "" {
+			continue
+		}
+		archOnly := Platform{OS: p.OS, Arch: p.Arch}
+		if _, ok := layout[archOnly.String()]; ok {
+			return nil, fmt.Errorf("found binaries both in %s and in its %s variant directory in %s", archOnly, p.Variant, sourceRoot)
+		}
+	}
+	if !inLayout {
+		if len(flat) > 1 {
+			return nil, fmt.Errorf("found binaries for multiple platforms (%s) outside of the <os>/<arch>/ layout in %s", strings.Join(slices.Sorted(maps.Keys(flat)), ", "), sourceRoot)
+		}
+		found = flat
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no ELF binaries found in %s to infer platforms from", sourceRoot)
+	}
+
+	var specs []PlatformSpec
+	for _, p := range found {
+		spec := PlatformSpec{Platform: p}
+		if inLayout {
+			spec.SourcePath = PlatformSourcePath(sourceRoot, p)
+		}
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Platform.String() < specs[j].Platform.String()
+	})
+	return specs, nil
+}
+
+// platformDirFor returns the platform whose PlatformSourcePath contains file.
+// The variant directory is optional; when absent the platform has no variant.
+// A binary in a variant directory takes that directory's variant, and must be
+// able to run on it.
+func platformDirFor(sourceRoot, file string, got elfPlatform) (Platform, bool, error) {
+	p := got.Platform
+	p.Variant = ""
+	archDir := PlatformSourcePath(sourceRoot, p)
+	if !isWithin(archDir, file) {
+		return Platform{}, false, nil
+	}
+
+	rel, err := filepath.Rel(archDir, file)
+	if err != nil {
+		return Platform{}, false, err
+	}
+	dir, _, nested := strings.Cut(rel, string(filepath.Separator))
+	if _, isVariant := armVariantLevel(dir); !nested || !isVariant {
+		return p, true, nil
+	}
+	p.Variant = dir
+	if got.Platform.Variant != "" && !elfPlatformMatches(got, p) {
+		return Platform{}, false, fmt.Errorf("%s was built for %s but is in the %s directory", file, got.Platform, p)
+	}
+	return p, true, nil
+}
+
+func isWithin(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
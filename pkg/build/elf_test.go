@@ -0,0 +1,326 @@
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testELF struct {
+	class   elf.Class
+	data    elf.Data
+	machine elf.Machine
+	osabi   elf.OSABI
+}
+
+var (
+	elfAmd64 = testELF{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, elf.ELFOSABI_NONE}
+	elfArm64 = testELF{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_AARCH64, elf.ELFOSABI_NONE}
+)
+
+// writeTestELF writes a header-only ELF executable.
+func writeTestELF(t *testing.T, path string, e testELF) {
+	t.Helper()
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if e.data == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(e.class)
+	ident[elf.EI_DATA] = byte(e.data)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	ident[elf.EI_OSABI] = byte(e.osabi)
+
+	var buf bytes.Buffer
+	var hdr any
+	if e.class == elf.ELFCLASS64 {
+		hdr = elf.Header64{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(e.machine), Version: uint32(elf.EV_CURRENT), Ehsize: 64}
+	} else {
+		hdr = elf.Header32{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(e.machine), Version: uint32(elf.EV_CURRENT), Ehsize: 52}
+	}
+	if err := binary.Write(&buf, order, hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestARMELF writes a 32-bit ARM executable whose .ARM.attributes
+// section records Tag_CPU_arch.
+func writeTestARMELF(t *testing.T, path string, cpuArch byte) {
+	t.Helper()
+	attrs := []byte{6, cpuArch}
+	sub := append([]byte{1}, binary.LittleEndian.AppendUint32(nil, uint32(5+len(attrs)))...)
+	sub = append(sub, attrs...)
+	sec := append([]byte("aeabi"), 0)
+	sec = append(sec, sub...)
+	data := append([]byte{'A'}, binary.LittleEndian.AppendUint32(nil, uint32(4+len(sec)))...)
+	data = append(data, sec...)
+
+	shstrtab := []byte("\x00.shstrtab\x00.ARM.attributes\x00")
+	shstrtabOff := uint32(52)
+	attrsOff := shstrtabOff + uint32(len(shstrtab))
+	shOff := attrsOff + uint32(len(data))
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	write := func(v any) {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(elf.Header32{
+		Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_ARM), Version: uint32(elf.EV_CURRENT),
+		Shoff: shOff, Ehsize: 52, Shentsize: 40, Shnum: 3, Shstrndx: 1,
+	})
+	buf.Write(shstrtab)
+	buf.Write(data)
+	write(elf.Section32{})
+	write(elf.Section32{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint32(len(shstrtab)), Addralign: 1})
+	write(elf.Section32{Name: 11, Type: uint32(elf.SHT_LOPROC + 3) /* SHT_ARM_ATTRIBUTES */, Off: attrsOff, Size: uint32(len(data)), Addralign: 1})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadELFPlatform(t *testing.T) {
+	cases := []struct {
+		elf  testELF
+		want string
+	}{
+		{elfAmd64, "linux/amd64"},
+		{elfArm64, "linux/arm64"},
+		{testELF{elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_386, elf.ELFOSABI_NONE}, "linux/386"},
+		{testELF{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_PPC64, elf.ELFOSABI_NONE}, "linux/ppc64le"},
+		{testELF{elf.ELFCLASS64, elf.ELFDATA2MSB, elf.EM_S390, elf.ELFOSABI_NONE}, "linux/s390x"},
+		{testELF{elf.ELFCLASS32, elf.ELFDATA2MSB, elf.EM_MIPS, elf.ELFOSABI_NONE}, "linux/mips"},
+		{testELF{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64, elf.ELFOSABI_FREEBSD}, "freebsd/amd64"},
+	}
+	dir := t.TempDir()
+	for i, c := range cases {
+		path := filepath.Join(dir, c.want, "bin"+string(rune('a'+i)))
+		writeTestELF(t, path, c.elf)
+
+		got, ok, err := readELFPlatform(path)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.want, err)
+		}
+		if !ok {
+			t.Fatalf("%s: expected ELF to be recognised", c.want)
+		}
+		if got.Platform.String() != c.want {
+			t.Fatalf("got %s, want %s", got.Platform, c.want)
+		}
+	}
+}
+
+func TestReadELFPlatformNotELF(t *testing.T) {
+	dir := createTestSourceDir(t, map[string]string{"script.sh": "#!/bin/sh\n", "x": "E"})
+	for _, name := range []string{"script.sh", "x"} {
+		_, ok, err := readELFPlatform(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if ok {
+			t.Fatalf("%s: should not be detected as ELF", name)
+		}
+	}
+}
+
+func TestReadELFPlatformUnparsable(t *testing.T) {
+	dir := createTestSourceDir(t, map[string]string{"firmware.bin": elf.ELFMAG + "\x02\x01\x01 truncated"})
+	_, ok, err := readELFPlatform(filepath.Join(dir, "firmware.bin"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatal("a file with an unparsable ELF header should be skipped")
+	}
+}
+
+func TestParseARMCPUArch(t *testing.T) {
+	// Tag_CPU_name "7-A", Tag_CPU_arch v7, Tag_CPU_arch_profile 'A'
+	attrs := []byte{5, '7', '-', 'A', 0, 6, 10, 7, 'A'}
+	sub := append([]byte{1}, binary.LittleEndian.AppendUint32(nil, uint32(5+len(attrs)))...)
+	sub = append(sub, attrs...)
+	sec := append([]byte("aeabi"), 0)
+	sec = append(sec, sub...)
+	data := append([]byte{'A'}, binary.LittleEndian.AppendUint32(nil, uint32(4+len(sec)))...)
+	data = append(data, sec...)
+
+	arch, ok := parseARMCPUArch(data)
+	if !ok {
+		t.Fatal("expected Tag_CPU_arch to be found")
+	}
+	if arch != 10 {
+		t.Fatalf("got Tag_CPU_arch %d, want 10", arch)
+	}
+	if v := armCPUArchVariant(arch); v != "v7" {
+		t.Fatalf("got variant %s, want v7", v)
+	}
+}
+
+func TestElfPlatformMatchesARMVariant(t *testing.T) {
+	v6 := elfPlatform{Platform: Platform{OS: "linux", Arch: "arm", Variant: "v6"}}
+	if !elfPlatformMatches(v6, Platform{OS: "linux", Arch: "arm", Variant: "v7"}) {
+		t.Fatal("v6 binary should run on linux/arm/v7")
+	}
+	v7 := elfPlatform{Platform: Platform{OS: "linux", Arch: "arm", Variant: "v7"}}
+	if elfPlatformMatches(v7, Platform{OS: "linux", Arch: "arm", Variant: "v6"}) {
+		t.Fatal("v7 binary should not run on linux/arm/v6")
+	}
+	v8 := elfPlatform{Platform: Platform{OS: "linux", Arch: "arm", Variant: "v8"}}
+	if !elfPlatformMatches(v8, Platform{OS: "linux", Arch: "arm", Variant: "v10"}) {
+		t.Fatal("v8 binary should run on linux/arm/v10")
+	}
+}
+
+func TestVerifySourcePlatformMismatch(t *testing.T) {
+	dir := createTestSourceDir(t, map[string]string{"README": "not a binary"})
+	writeTestELF(t, filepath.Join(dir, "app"), elfArm64)
+
+	err := verifySourcePlatform(dir, Platform{OS: "linux", Arch: "amd64"})
+	if err == nil {
+		t.Fatal("expected platform mismatch error")
+	}
+	if !strings.Contains(err.Error(), "app (linux/arm64)") {
+		t.Fatalf("error should name the offending binary, got: %v", err)
+	}
+
+	if err := verifySourcePlatform(dir, Platform{OS: "linux", Arch: "arm64", Variant: "v8"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBuildImageRejectsWrongPlatformBinary(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	srcDir := t.TempDir()
+	writeTestELF(t, filepath.Join(srcDir, "mybin"), elfArm64)
+
+	_, _, err := buildImage(ctx, newScratchBuildSpec(srcDir))
+	if err == nil {
+		t.Fatal("expected build to fail for arm64 binary on linux/amd64")
+	}
+}
+
+func TestBuildImageSkipPlatformCheck(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	srcDir := t.TempDir()
+	writeTestELF(t, filepath.Join(srcDir, "mybin"), elfArm64)
+
+	spec := newScratchBuildSpec(srcDir)
+	spec.SkipPlatformCheck = true
+	if _, _, err := buildImage(ctx, spec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestInferPlatformSpecsLayout(t *testing.T) {
+	dir := t.TempDir()
+	writeTestELF(t, filepath.Join(dir, "linux", "arm64", "app"), elfArm64)
+	writeTestELF(t, filepath.Join(dir, "linux", "amd64", "app"), elfAmd64)
+
+	specs, err := InferPlatformSpecs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(specs) != 2 || specs[0].Platform.String() != "linux/amd64" || specs[1].Platform.String() != "linux/arm64" {
+		t.Fatalf("unexpected specs: %+v", specs)
+	}
+}
+
+func TestInferPlatformSpecsSingleLayout(t *testing.T) {
+	dir := t.TempDir()
+	writeTestELF(t, filepath.Join(dir, "linux", "amd64", "app"), elfAmd64)
+
+	specs, err := InferPlatformSpecs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := filepath.Join(dir, "linux", "amd64")
+	if len(specs) != 1 || specs[0].Platform.String() != "linux/amd64" || specs[0].SourcePath != want {
+		t.Fatalf("expected linux/amd64 from %s, got %+v", want, specs)
+	}
+}
+
+func TestInferPlatformSpecsARMVariants(t *testing.T) {
+	dir := t.TempDir()
+	writeTestARMELF(t, filepath.Join(dir, "linux", "arm", "v6", "app"), 6)
+	writeTestARMELF(t, filepath.Join(dir, "linux", "arm", "v7", "app"), 10)
+	// A binary whose variant can't be read takes its directory's
+	writeTestELF(t, filepath.Join(dir, "linux", "arm", "v7", "helper"), testELF{elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_ARM, elf.ELFOSABI_NONE})
+
+	specs, err := InferPlatformSpecs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(specs) != 2 || specs[0].Platform.String() != "linux/arm/v6" || specs[1].Platform.String() != "linux/arm/v7" {
+		t.Fatalf("unexpected specs: %+v", specs)
+	}
+	if want := filepath.Join(dir, "linux", "arm", "v7"); specs[1].SourcePath != want {
+		t.Fatalf("expected linux/arm/v7 from %s, got %s", want, specs[1].SourcePath)
+	}
+}
+
+func TestInferPlatformSpecsARMVariantMismatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestARMELF(t, filepath.Join(dir, "linux", "arm", "v6", "app"), 10)
+	writeTestARMELF(t, filepath.Join(dir, "linux", "arm", "v7", "app"), 10)
+
+	_, err := InferPlatformSpecs(dir)
+	if err == nil || !strings.Contains(err.Error(), "linux/arm/v7 but is in the linux/arm/v6 directory") {
+		t.Fatalf("expected a variant mismatch error, got %v", err)
+	}
+
+	dir = t.TempDir()
+	writeTestARMELF(t, filepath.Join(dir, "linux", "arm", "app"), 6)
+	writeTestARMELF(t, filepath.Join(dir, "linux", "arm", "v7", "app"), 10)
+	if _, err := InferPlatformSpecs(dir); err == nil {
+		t.Fatal("expected an error for binaries both in linux/arm and linux/arm/v7")
+	}
+}
+
+func TestInferPlatformSpecsFlat(t *testing.T) {
+	dir := t.TempDir()
+	writeTestELF(t, filepath.Join(dir, "app"), elfArm64)
+	writeTestELF(t, filepath.Join(dir, "lib", "helper"), elfArm64)
+
+	specs, err := InferPlatformSpecs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(specs) != 1 || specs[0].Platform.String() != "linux/arm64" || specs[0].SourcePath != "" {
+		t.Fatalf("unexpected specs: %+v", specs)
+	}
+}
+
+func TestInferPlatformSpecsMixedFlat(t *testing.T) {
+	dir := t.TempDir()
+	writeTestELF(t, filepath.Join(dir, "app"), elfArm64)
+	writeTestELF(t, filepath.Join(dir, "other"), elfAmd64)
+
+	if _, err := InferPlatformSpecs(dir); err == nil {
+		t.Fatal("expected error for mixed platforms outside the layout")
+	}
+}
@@ -0,0 +1,348 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// Library directories searched by glibc and musl when ld.so.conf does not list them.
+var defaultLibraryDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib"}
+
+// elfDeps are the dynamic loading requirements of an ELF executable.
+type elfDeps struct {
+	Interpreter string
+	Needed      []string
+	RunPath     []string
+}
+
+// imageFS is a flattened view of the paths in an image, enough to resolve
+// library lookups without keeping file contents around.
+type imageFS struct {
+	files   map[string]bool
+	links   map[string]string
+	configs map[string][]byte
+}
+
+// checkDynamicLinking verifies that the entrypoint's ELF interpreter and
+// direct DT_NEEDED libraries can be found in the base image or in the injected layer.
+func checkDynamicLinking(base v1.Image, layer BuildSpecInjectLayer) error {
+	rel, err := filepath.Rel(layer.DestinationPath, layer.Entrypoint)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		log.Printf("Entrypoint %s is not part of the injected layer, skipping linking check", layer.Entrypoint)
+		return nil
+	}
+
+	deps, ok, err := readELFDeps(filepath.Join(layer.SourcePath, rel))
+	if err != nil {
+		return fmt.Errorf("failed to read entrypoint dependencies: %w", err)
+	}
+	if !ok {
+		log.Printf("Entrypoint %s is not an ELF executable, skipping linking check", layer.Entrypoint)
+		return nil
+	}
+	if deps.Interpreter == "" && len(deps.Needed) == 0 {
+		log.Printf("Entrypoint %s is statically linked", layer.Entrypoint)
+		return nil
+	}
+
+	ifs, err := readImageFS(base)
+	if err != nil {
+		return fmt.Errorf("failed to read base image filesystem: %w", err)
+	}
+	if err := ifs.addSourceTree(layer.SourcePath, layer.DestinationPath); err != nil {
+		return fmt.Errorf("failed to read injected files: %w", err)
+	}
+
+	missing := ifs.missingDeps(deps, path.Dir(layer.Entrypoint))
+	if len(missing) == 0 {
+		log.Printf("All dynamic dependencies of %s resolved in base image", layer.Entrypoint)
+		return nil
+	}
+
+	msg := fmt.Sprintf("entrypoint %s cannot be loaded on the base image: %s", layer.Entrypoint, strings.Join(missing, ", "))
+	if hint := ifs.libcHint(deps); hint != "" {
+		msg += " (" + hint + ")"
+	}
+	return errors.New(msg)
+}
+
+// readELFDeps reads PT_INTERP, DT_NEEDED and DT_RUNPATH/DT_RPATH from an ELF file.
+// It returns ok=false if the file is not ELF.
+func readELFDeps(file string) (elfDeps, bool, error) {
+	ef, err := elf.Open(file)
+	if err != nil {
+		var formatErr *elf.FormatError
+		if errors.As(err, &formatErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return elfDeps{}, false, nil
+		}
+		return elfDeps{}, false, err
+	}
+	defer ef.Close()
+
+	var deps elfDeps
+	for _, prog := range ef.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return elfDeps{}, false, fmt.Errorf("failed to read ELF interpreter: %w", err)
+		}
+		deps.Interpreter = string(bytes.TrimRight(data, "\x00"))
+	}
+
+	deps.Needed, err = ef.ImportedLibraries()
+	if err != nil {
+		return elfDeps{}, false, fmt.Errorf("failed to read DT_NEEDED entries: %w", err)
+	}
+
+	for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+		paths, err := ef.DynString(tag)
+		if err != nil {
+			return elfDeps{}, false, fmt.Errorf("failed to read %s entries: %w", tag, err)
+		}
+		for _, p := range paths {
+			deps.RunPath = append(deps.RunPath, strings.Split(p, ":")...)
+		}
+	}
+
+	return deps, true, nil
+}
+
+func newImageFS() *imageFS {
+	return &imageFS{
+		files:   make(map[string]bool),
+		links:   make(map[string]string),
+		configs: make(map[string][]byte),
+	}
+}
+
+func readImageFS(img v1.Image) (*imageFS, error) {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	ifs := newImageFS()
+	reader := tar.NewReader(rc)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Join("/", header.Name)
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeLink:
+			ifs.files[name] = true
+			if isLoaderConfig(name) && header.Typeflag == tar.TypeReg {
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					return nil, err
+				}
+				ifs.configs[name] = data
+			}
+		case tar.TypeSymlink:
+			ifs.links[name] = header.Linkname
+		}
+	}
+	return ifs, nil
+}
+
+func isLoaderConfig(name string) bool {
+	if name == "/etc/ld.so.conf" || strings.HasPrefix(name, "/etc/ld.so.conf.d/") {
+		return true
+	}
+	return strings.HasPrefix(name, "/etc/ld-musl-") && strings.HasSuffix(name, ".path")
+}
+
+func (f *imageFS) addSourceTree(srcPath, dstPath string) error {
+	return filepath.WalkDir(srcPath, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcPath, file)
+		if err != nil {
+			return err
+		}
+		f.files[path.Join(dstPath, filepath.ToSlash(relPath))] = true
+		return nil
+	})
+}
+
+// resolve follows symlinks in every component of p and reports whether it names a file.
+func (f *imageFS) resolve(p string) (string, bool) {
+	p = path.Join("/", p)
+	for range 40 {
+		parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+		cur := "/"
+		redirected := false
+		for i, part := range parts {
+			next := path.Join(cur, part)
+			if target, ok := f.links[next]; ok {
+				if !path.IsAbs(target) {
+					target = path.Join(cur, target)
+				}
+				p = path.Join(append([]string{target}, parts[i+1:]...)...)
+				redirected = true
+				break
+			}
+			cur = next
+		}
+		if !redirected {
+			return cur, f.files[cur]
+		}
+	}
+	return "", false
+}
+
+// libraryDirs returns the search path from ld.so.conf (following includes)
+// and musl's ld-musl-*.path files, followed by the default directories.
+func (f *imageFS) libraryDirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	var parse func(name string, depth int)
+	parse = func(name string, depth int) {
+		data, ok := f.configs[name]
+		if !ok || depth > 8 {
+			return
+		}
+		for line := range strings.SplitSeq(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			fields := strings.FieldsFunc(line, func(r rune) bool {
+				return r == ' ' || r == '\t' || r == ':' || r == ','
+			})
+			if len(fields) == 0 || fields[0] == "hwcap" {
+				continue
+			}
+			if fields[0] == "include" {
+				for _, pattern := range fields[1:] {
+					if !path.IsAbs(pattern) {
+						pattern = path.Join(path.Dir(name), pattern)
+					}
+					for _, match := range f.configsMatching(pattern) {
+						parse(match, depth+1)
+					}
+				}
+				continue
+			}
+			for _, dir := range fields {
+				add(dir)
+			}
+		}
+	}
+	parse("/etc/ld.so.conf", 0)
+
+	for _, name := range f.configsMatching("/etc/ld-musl-*.path") {
+		parse(name, 0)
+	}
+
+	for _, dir := range defaultLibraryDirs {
+		add(dir)
+	}
+	return dirs
+}
+
+func (f *imageFS) configsMatching(pattern string) []string {
+	var matches []string
+	for name := range f.configs {
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	slices.Sort(matches)
+	return matches
+}
+
+// missingDeps returns a description of each dependency that cannot be resolved.
+// origin is the directory of the executable, used to expand $ORIGIN in run paths.
+func (f *imageFS) missingDeps(deps elfDeps, origin string) []string {
+	var missing []string
+	if deps.Interpreter != "" {
+		if _, ok := f.resolve(deps.Interpreter); !ok {
+			missing = append(missing, "interpreter "+deps.Interpreter)
+		}
+	}
+
+	var searchDirs []string
+	for _, dir := range deps.RunPath {
+		dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+		dir = strings.ReplaceAll(dir, "$ORIGIN", origin)
+		searchDirs = append(searchDirs, dir)
+	}
+	searchDirs = append(searchDirs, f.libraryDirs()...)
+
+	for _, lib := range deps.Needed {
+		if !f.findLibrary(lib, searchDirs) {
+			missing = append(missing, "library "+lib)
+		}
+	}
+	return missing
+}
+
+func (f *imageFS) findLibrary(lib string, dirs []string) bool {
+	if strings.Contains(lib, "/") {
+		_, ok := f.resolve(lib)
+		return ok
+	}
+	for _, dir := range dirs {
+		if _, ok := f.resolve(path.Join(dir, lib)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// libcHint explains the most common cause of a missing interpreter: a binary
+// linked against one libc on a base image shipping the other (or none).
+func (f *imageFS) libcHint(deps elfDeps) string {
+	if deps.Interpreter == "" {
+		return ""
+	}
+	if _, ok := f.resolve(deps.Interpreter); ok {
+		return ""
+	}
+
+	hasMusl := len(f.configsMatching("/etc/ld-musl-*.path")) > 0
+	for name := range f.files {
+		if strings.HasPrefix(name, "/lib/ld-musl-") {
+			hasMusl = true
+			break
+		}
+	}
+
+	interp := path.Base(deps.Interpreter)
+	switch {
+	case strings.HasPrefix(interp, "ld-linux") && hasMusl:
+		return "binary is linked against glibc but the base image uses musl"
+	case strings.HasPrefix(interp, "ld-musl"):
+		return "binary is linked against musl but the base image does not provide it"
+	case !hasMusl && len(f.configsMatching("/etc/ld.so.conf")) == 0:
+		return "base image has no dynamic loader; use a statically linked binary or a base image with a libc"
+	}
+	return ""
+}
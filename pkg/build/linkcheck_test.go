@@ -0,0 +1,144 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// imageWithFiles builds a single-layer image containing the given files and symlinks.
+func imageWithFiles(t *testing.T, files map[string]string, links map[string]string) v1.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+var glibcDeps = elfDeps{
+	Interpreter: "/lib64/ld-linux-x86-64.so.2",
+	Needed:      []string{"libc.so.6"},
+}
+
+func TestImageFSDebianMergedUsr(t *testing.T) {
+	img := imageWithFiles(t, map[string]string{
+		"usr/lib/x86_64-linux-gnu/ld-linux-x86-64.so.2": "",
+		"usr/lib/x86_64-linux-gnu/libc.so.6":            "",
+		"etc/ld.so.conf":                                "include /etc/ld.so.conf.d/*.conf\n",
+		"etc/ld.so.conf.d/x86_64-linux-gnu.conf":        "# Multiarch support\n/usr/local/lib/x86_64-linux-gnu\n/lib/x86_64-linux-gnu\n/usr/lib/x86_64-linux-gnu\n",
+	}, map[string]string{
+		"lib":                            "usr/lib",
+		"lib64":                          "usr/lib64",
+		"usr/lib64/ld-linux-x86-64.so.2": "../lib/x86_64-linux-gnu/ld-linux-x86-64.so.2",
+	})
+
+	ifs, err := readImageFS(img)
+	if err != nil {
+		t.Fatalf("readImageFS: %v", err)
+	}
+
+	dirs := ifs.libraryDirs()
+	if dirs[0] != "/usr/local/lib/x86_64-linux-gnu" {
+		t.Fatalf("expected ld.so.conf.d entries first, got %v", dirs)
+	}
+
+	if missing := ifs.missingDeps(glibcDeps, "/app"); len(missing) != 0 {
+		t.Fatalf("unexpected missing deps: %v", missing)
+	}
+}
+
+func TestImageFSGlibcOnMusl(t *testing.T) {
+	img := imageWithFiles(t, map[string]string{
+		"lib/ld-musl-x86_64.so.1": "",
+		"etc/ld-musl-x86_64.path": "/lib\n/usr/local/lib\n/usr/lib\n",
+	}, map[string]string{
+		"lib/libc.musl-x86_64.so.1": "ld-musl-x86_64.so.1",
+	})
+
+	ifs, err := readImageFS(img)
+	if err != nil {
+		t.Fatalf("readImageFS: %v", err)
+	}
+
+	missing := ifs.missingDeps(glibcDeps, "/app")
+	if len(missing) != 2 {
+		t.Fatalf("expected interpreter and libc to be missing, got %v", missing)
+	}
+	if hint := ifs.libcHint(glibcDeps); !strings.Contains(hint, "musl") {
+		t.Fatalf("expected musl hint, got %q", hint)
+	}
+}
+
+func TestImageFSRunPathOrigin(t *testing.T) {
+	ifs := newImageFS()
+	ifs.files["/lib/ld-linux-x86-64.so.2"] = true
+	ifs.files["/app/lib/libfoo.so"] = true
+
+	deps := elfDeps{
+		Interpreter: "/lib/ld-linux-x86-64.so.2",
+		Needed:      []string{"libfoo.so"},
+		RunPath:     []string{"$ORIGIN/lib"},
+	}
+	if missing := ifs.missingDeps(deps, "/app"); len(missing) != 0 {
+		t.Fatalf("unexpected missing deps: %v", missing)
+	}
+}
+
+func TestCheckDynamicLinkingSkipsNonELF(t *testing.T) {
+	srcDir := createTestSourceDir(t, map[string]string{"mybin": "#!/bin/sh\n"})
+	layer := BuildSpecInjectLayer{
+		SourcePath:      srcDir,
+		DestinationPath: "/app",
+		Entrypoint:      "/app/mybin",
+	}
+	if err := checkDynamicLinking(empty.Image, layer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckDynamicLinkingStaticBinary(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestELF(t, filepath.Join(srcDir, "mybin"), elfAmd64)
+	layer := BuildSpecInjectLayer{
+		SourcePath:      srcDir,
+		DestinationPath: "/app",
+		Entrypoint:      "/app/mybin",
+	}
+	if err := checkDynamicLinking(empty.Image, layer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	ociLayoutPrefix     = "oci-layout:"
+	dockerArchivePrefix = "docker-archive:"
+	daemonPrefix        = "daemon:"
+
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+func isLocalBaseRef(baseRef string) bool {
+	return strings.HasPrefix(baseRef, ociLayoutPrefix) ||
+		strings.HasPrefix(baseRef, dockerArchivePrefix) ||
+		strings.HasPrefix(baseRef, daemonPrefix)
+}
+
+// resolveLocalBaseSource loads a base image that does not come from a registry:
+//
+//	oci-layout:PATH[:TAG|@DIGEST]  an OCI image layout directory
+//	docker-archive:PATH[:REF]      a tarball written by `docker save`
+//	daemon:REF                     an image in the local docker daemon
+func resolveLocalBaseSource(ctx BuildContext, baseRef string) (baseSource, error) {
+	switch {
+	case strings.HasPrefix(baseRef, ociLayoutPrefix):
+		return resolveOCILayoutBase(strings.TrimPrefix(baseRef, ociLayoutPrefix))
+	case strings.HasPrefix(baseRef, dockerArchivePrefix):
+		return resolveDockerArchiveBase(strings.TrimPrefix(baseRef, dockerArchivePrefix))
+	case strings.HasPrefix(baseRef, daemonPrefix):
+		return resolveDaemonBase(ctx, strings.TrimPrefix(baseRef, daemonPrefix))
+	}
+	return baseSource{}, fmt.Errorf("unsupported base image reference: %s", baseRef)
+}
+
+// parseOCILayoutRef splits PATH[:TAG|@DIGEST]. A tag is only recognised after the last path separator.
+func parseOCILayoutRef(str string) (path, tag, digest string) {
+	if p, d, ok := strings.Cut(str, "@"); ok {
+		return p, "", d
+	}
+	if i := strings.LastIndex(str, ":"); i > strings.LastIndex(str, "/") {
+		return str[:i], str[i+1:], ""
+	}
+	return str, "", ""
+}
+
+func resolveOCILayoutBase(str string) (baseSource, error) {
+	path, tag, digest := parseOCILayoutRef(str)
+
+	index, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to read OCI layout %s: %w", path, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to read OCI layout index %s: %w", path, err)
+	}
+
+	var selected *v1.Descriptor
+	switch {
+	case digest != "":
+		h, err := v1.NewHash(digest)
+		if err != nil {
+			return baseSource{}, fmt.Errorf("invalid digest in base image reference: %w", err)
+		}
+		for i := range manifest.Manifests {
+			if manifest.Manifests[i].Digest == h {
+				selected = &manifest.Manifests[i]
+			}
+		}
+		if selected == nil {
+			return baseSource{}, fmt.Errorf("digest %s not found in OCI layout %s", digest, path)
+		}
+	case tag != "":
+		for i := range manifest.Manifests {
+			if manifest.Manifests[i].Annotations[ociRefNameAnnotation] == tag {
+				selected = &manifest.Manifests[i]
+			}
+		}
+		if selected == nil {
+			return baseSource{}, fmt.Errorf("tag %s not found in OCI layout %s", tag, path)
+		}
+	case len(manifest.Manifests) == 1:
+		selected = &manifest.Manifests[0]
+	}
+
+	var src baseSource
+
+	// Without a selector, a layout holding several manifests is treated as a multi-platform index
+	if selected == nil {
+		digest, err := index.Digest()
+		if err != nil {
+			return baseSource{}, err
+		}
+		log.Printf("Using base image: %s%s@%s", ociLayoutPrefix, path, digest)
+		src.index = index
+		return src, nil
+	}
+
+	log.Printf("Using base image: %s%s@%s", ociLayoutPrefix, path, selected.Digest)
+	if refName := selected.Annotations[ociRefNameAnnotation]; refName != "" {
+		// tko's own layouts record bare tags here, which name no repository
+		src.name = localBaseName([]string{refName}, name.StrictValidation)
+	}
+	switch {
+	case selected.MediaType.IsIndex():
+		src.index, err = index.ImageIndex(selected.Digest)
+	case selected.MediaType.IsImage():
+		src.image, err = index.Image(selected.Digest)
+	default:
+		return baseSource{}, fmt.Errorf("unsupported base image media type: %s", selected.MediaType)
+	}
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to read base image from OCI layout %s: %w", path, err)
+	}
+	return src, nil
+}
+
+// parseDockerArchiveRef splits PATH[:REF]. Since references contain colons too,
+// the first colon that follows an existing file name ends the path.
+func parseDockerArchiveRef(str string) (path, ref string) {
+	for i := 0; i < len(str); i++ {
+		if str[i] != ':' {
+			continue
+		}
+		if info, err := os.Stat(str[:i]); err == nil && !info.IsDir() {
+			return str[:i], str[i+1:]
+		}
+	}
+	return str, ""
+}
+
+func resolveDockerArchiveBase(str string) (baseSource, error) {
+	path, refStr := parseDockerArchiveRef(str)
+
+	var tag *name.Tag
+	if refStr != "" {
+		t, err := name.NewTag(refStr)
+		if err != nil {
+			return baseSource{}, fmt.Errorf("failed to parse docker archive reference: %w", err)
+		}
+		tag = &t
+	}
+
+	img, err := tarball.ImageFromPath(path, tag)
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to read docker archive %s: %w", path, err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return baseSource{}, err
+	}
+	log.Printf("Using base image: %s%s@%s", dockerArchivePrefix, path, digest)
+
+	src := baseSource{image: img}
+	if tag != nil {
+		src.name = tag.Context().Name()
+	} else if m, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return os.Open(path) }); err == nil && len(m) == 1 {
+		src.name = localBaseName(m[0].RepoTags)
+	}
+	return src, nil
+}
+
+// localBaseName returns the repository shared by the references stored
+// alongside a local base image, or "" when there is none. The path of a layout
+// or archive is never used, since the base name label must not depend on where
+// the file was and must be something `tko base outdated` and `tko rebase` can resolve.
+func localBaseName(refs []string, opts ...name.Option) string {
+	var repo string
+	for _, refStr := range refs {
+		ref, err := name.ParseReference(refStr, opts...)
+		if err != nil || (repo != "" && repo != ref.Context().Name()) {
+			return ""
+		}
+		repo = ref.Context().Name()
+	}
+	return repo
+}
+
+func resolveDaemonBase(ctx BuildContext, refStr string) (baseSource, error) {
+	ref, err := name.ParseReference(refStr)
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to parse base image reference: %w", err)
+	}
+
+	d, err := connectDaemon(ctx)
+	if err != nil {
+		return baseSource{}, err
+	}
+	defer d.Close()
+	log.Printf("Reading base image from %s", d)
+
+	img, err := daemon.Image(ref, d.options(ctx)...)
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to read base image from daemon: %w", err)
+	}
+
+	// Daemon images are read lazily through the client. Buffering the image and
+	// computing its config now means the client isn't needed after this returns.
+	digest, err := img.Digest()
+	if err != nil {
+		return baseSource{}, fmt.Errorf("failed to read base image from daemon: %w", err)
+	}
+	if _, err := img.ConfigFile(); err != nil {
+		return baseSource{}, fmt.Errorf("failed to read base image config from daemon: %w", err)
+	}
+	log.Printf("Using base image: %s%s@%s", daemonPrefix, ref, digest)
+
+	return baseSource{name: ref.Context().Name(), image: img}, nil
+}
@@ -0,0 +1,151 @@
+package build
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestParseOCILayoutRef(t *testing.T) {
+	cases := []struct {
+		in, path, tag, digest string
+	}{
+		{"./base", "./base", "", ""},
+		{"./base:v1", "./base", "v1", ""},
+		{"/abs/base@sha256:abcd", "/abs/base", "", "sha256:abcd"},
+		{"host:dir/base", "host:dir/base", "", ""},
+	}
+	for _, c := range cases {
+		path, tag, digest := parseOCILayoutRef(c.in)
+		if path != c.path || tag != c.tag || digest != c.digest {
+			t.Fatalf("parseOCILayoutRef(%q) = %q, %q, %q", c.in, path, tag, digest)
+		}
+	}
+}
+
+func writeTestLayout(t *testing.T) (string, map[string]v1.Hash) {
+	t.Helper()
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digests := make(map[string]v1.Hash)
+	for _, p := range []Platform{{OS: "linux", Arch: "amd64"}, {OS: "linux", Arch: "arm64"}} {
+		img := imageWithPlatform(t, p)
+		err := lp.AppendImage(img,
+			layout.WithPlatform(*p.ToV1Platform()),
+			layout.WithAnnotations(map[string]string{ociRefNameAnnotation: p.Arch}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests[p.String()], err = img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, digests
+}
+
+func TestGetBaseImageOCILayoutPlatform(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	dir, digests := writeTestLayout(t)
+
+	ref := "oci-layout:" + dir
+	img, metadata, err := getBaseImage(ctx, ref, Platform{OS: "linux", Arch: "arm64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != digests["linux/arm64"] {
+		t.Fatalf("selected %s, want linux/arm64 image %s", got, digests["linux/arm64"])
+	}
+	// The layout names no repository, and its path must not end up in the base name label
+	if metadata.name != "" || metadata.imageDigest != got.String() {
+		t.Fatalf("unexpected metadata: %+v", metadata)
+	}
+}
+
+func TestGetBaseImageOCILayoutTag(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	dir, digests := writeTestLayout(t)
+
+	img, _, err := getBaseImage(ctx, "oci-layout:"+dir+":amd64", Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != digests["linux/amd64"] {
+		t.Fatalf("selected %s, want %s", got, digests["linux/amd64"])
+	}
+
+	// The tagged image is a single manifest, so its platform is verified
+	_, _, err = getBaseImage(ctx, "oci-layout:"+dir+":amd64", Platform{OS: "linux", Arch: "arm64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil {
+		t.Fatal("expected platform mismatch error")
+	}
+}
+
+func TestGetBaseImageDockerArchive(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	p := Platform{OS: "linux", Arch: "amd64"}
+	img := imageWithPlatform(t, p)
+
+	tag, err := name.NewTag("example.com/base:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "base.tar")
+	if err := tarball.WriteToFile(path, tag, img); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"docker-archive:" + path, "docker-archive:" + path + ":example.com/base:1"} {
+		got, metadata, err := getBaseImage(ctx, ref, p, FORMAT_DOCKER, ctx.Keychain)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", ref, err)
+		}
+		want, _ := img.Digest()
+		gotDigest, _ := got.Digest()
+		if gotDigest != want {
+			t.Fatalf("%s: digest %s, want %s", ref, gotDigest, want)
+		}
+		if metadata.name != "example.com/base" {
+			t.Fatalf("%s: base name %q, want example.com/base", ref, metadata.name)
+		}
+	}
+}
+
+func TestGetBaseImageOCILayoutRefName(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	p := Platform{OS: "linux", Arch: "amd64"}
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lp.AppendImage(imageWithPlatform(t, p), layout.WithAnnotations(map[string]string{ociRefNameAnnotation: "example.com/base:1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, metadata, err := getBaseImage(ctx, "oci-layout:"+dir, p, FORMAT_DOCKER, ctx.Keychain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.name != "example.com/base" {
+		t.Fatalf("base name %q, want example.com/base", metadata.name)
+	}
+}
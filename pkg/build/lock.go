@@ -0,0 +1,231 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v3"
+)
+
+const lockFileVersion = 1
+
+// LockFile pins base image references to the digests they resolved to.
+type LockFile struct {
+	Version int          `yaml:"version"`
+	Bases   []LockedBase `yaml:"bases"`
+}
+
+// LockedBase is a single base image reference and its resolved digests.
+// Digest is what Ref pointed at (an index or a single manifest);
+// Platforms maps each platform to the manifest selected for it.
+type LockedBase struct {
+	Ref       string            `yaml:"ref"`
+	Digest    string            `yaml:"digest"`
+	Platforms map[string]string `yaml:"platforms"`
+}
+
+// ReadLockFile reads a lockfile. A missing file yields an error matching fs.ErrNotExist.
+func ReadLockFile(path string) (*LockFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock LockFile
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile %s: %w", path, err)
+	}
+	if lock.Version != lockFileVersion {
+		return nil, fmt.Errorf("unsupported lockfile version %d in %s", lock.Version, path)
+	}
+	return &lock, nil
+}
+
+// ReadLockFileIfExists is ReadLockFile, returning nil when the file does not exist.
+func ReadLockFileIfExists(path string) (*LockFile, error) {
+	lock, err := ReadLockFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return lock, err
+}
+
+func WriteLockFile(path string, lock *LockFile) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	header := []byte("# Generated by `tko lock update`. Do not edit.\n")
+	return os.WriteFile(path, append(header, data...), 0o644)
+}
+
+func (l *LockFile) find(ref string) (LockedBase, bool) {
+	if l == nil {
+		return LockedBase{}, false
+	}
+	for _, b := range l.Bases {
+		if b.Ref == ref {
+			return b, true
+		}
+	}
+	return LockedBase{}, false
+}
+
+// Replace swaps the entry for oldRef, if any, for bases, keeping entries sorted by reference.
+func (l *LockFile) Replace(oldRef string, bases ...LockedBase) {
+	l.Bases = slices.DeleteFunc(l.Bases, func(b LockedBase) bool { return b.Ref == oldRef })
+	for _, b := range bases {
+		l.Bases = slices.DeleteFunc(l.Bases, func(existing LockedBase) bool { return existing.Ref == b.Ref })
+		l.Bases = append(l.Bases, b)
+	}
+	slices.SortFunc(l.Bases, func(a, b LockedBase) int { return strings.Compare(a.Ref, b.Ref) })
+}
+
+// isLockable reports whether a base reference resolves through a registry.
+func isLockable(baseRef string) bool {
+	return baseRef != "scratch" && !isLocalBaseRef(baseRef)
+}
+
+// ResolveLockFile resolves every base reference in bases for the given platforms.
+func ResolveLockFile(ctx BuildContext, bases map[string][]Platform) (*LockFile, error) {
+	lock := &LockFile{Version: lockFileVersion}
+
+	for _, baseRef := range slices.Sorted(maps.Keys(bases)) {
+		if !isLockable(baseRef) {
+			continue
+		}
+		locked, err := resolveLockedBase(ctx, baseRef, bases[baseRef])
+		if err != nil {
+			return nil, err
+		}
+		lock.Bases = append(lock.Bases, locked)
+	}
+	return lock, nil
+}
+
+func resolveLockedBase(ctx BuildContext, baseRef string, platforms []Platform) (LockedBase, error) {
+	ref, err := name.ParseReference(baseRef)
+	if err != nil {
+		return LockedBase{}, fmt.Errorf("failed to parse base image reference: %w", err)
+	}
+
+	desc, err := remoteGet(ctx, ref, ctx.Keychain)
+	if err != nil {
+		return LockedBase{}, fmt.Errorf("failed to resolve base image %s: %w", baseRef, err)
+	}
+
+	locked := LockedBase{
+		Ref:       baseRef,
+		Digest:    desc.Digest.String(),
+		Platforms: make(map[string]string),
+	}
+
+	for _, p := range platforms {
+		digest, err := descriptorPlatformDigest(desc, p)
+		if err != nil {
+			return LockedBase{}, fmt.Errorf("failed to resolve %s for platform %s: %w", baseRef, p, err)
+		}
+		locked.Platforms[p.String()] = digest.String()
+	}
+	return locked, nil
+}
+
+// DiffLockFiles describes the changes between two lockfiles, one line per changed entry.
+func DiffLockFiles(old, new *LockFile) []string {
+	oldBases := make(map[string]LockedBase)
+	if old != nil {
+		for _, b := range old.Bases {
+			oldBases[b.Ref] = b
+		}
+	}
+	newBases := make(map[string]LockedBase)
+	for _, b := range new.Bases {
+		newBases[b.Ref] = b
+	}
+
+	var lines []string
+	for _, b := range new.Bases {
+		prev, ok := oldBases[b.Ref]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("+ %s %s", b.Ref, b.Digest))
+			continue
+		}
+		if prev.Digest != b.Digest {
+			lines = append(lines, fmt.Sprintf("~ %s %s -> %s", b.Ref, prev.Digest, b.Digest))
+		}
+		for _, p := range slices.Sorted(maps.Keys(b.Platforms)) {
+			switch before, ok := prev.Platforms[p]; {
+			case !ok:
+				lines = append(lines, fmt.Sprintf("+ %s [%s] %s", b.Ref, p, b.Platforms[p]))
+			case before != b.Platforms[p]:
+				lines = append(lines, fmt.Sprintf("~ %s [%s] %s -> %s", b.Ref, p, before, b.Platforms[p]))
+			}
+		}
+		for _, p := range slices.Sorted(maps.Keys(prev.Platforms)) {
+			if _, ok := b.Platforms[p]; !ok {
+				lines = append(lines, fmt.Sprintf("- %s [%s] %s", b.Ref, p, prev.Platforms[p]))
+			}
+		}
+	}
+	var removed []string
+	for ref, b := range oldBases {
+		if _, ok := newBases[ref]; !ok {
+			removed = append(removed, fmt.Sprintf("- %s %s", ref, b.Digest))
+		}
+	}
+	sort.Strings(removed)
+	return append(lines, removed...)
+}
+
+// lockedBaseRef returns the digest-pinned reference to use for baseRef.
+// In locked mode, the live tag is compared with the lockfile and any drift is an error.
+func lockedBaseRef(ctx BuildContext, ref name.Reference, baseRef string) (name.Reference, error) {
+	locked, ok := ctx.Lock.find(baseRef)
+	if !ok {
+		if ctx.Locked {
+			return nil, fmt.Errorf("base image %s is not in the lockfile; run `tko lock update`", baseRef)
+		}
+		return ref, nil
+	}
+
+	if ctx.Locked && ctx.Offline {
+		log.Printf("Offline: trusting lockfile digest %s for %s without checking the tag", locked.Digest, baseRef)
+	} else if ctx.Locked {
+		desc, err := remoteHead(ctx, ref, ctx.Keychain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve base image %s: %w", baseRef, err)
+		}
+		if desc.Digest.String() != locked.Digest {
+			return nil, fmt.Errorf("base image %s resolves to %s but the lockfile has %s; run `tko lock update`", baseRef, desc.Digest, locked.Digest)
+		}
+	}
+
+	return ref.Context().Digest(locked.Digest), nil
+}
+
+// verifyLockedPlatform checks the manifest chosen for platform against the lockfile.
+func verifyLockedPlatform(ctx BuildContext, baseRef string, platform Platform, digest string) error {
+	locked, ok := ctx.Lock.find(baseRef)
+	if !ok {
+		return nil
+	}
+	want, ok := locked.Platforms[platform.String()]
+	if !ok {
+		if ctx.Locked {
+			return fmt.Errorf("platform %s of base image %s is not in the lockfile; run `tko lock update`", platform, baseRef)
+		}
+		return nil
+	}
+	if want != digest {
+		return fmt.Errorf("base image %s for platform %s is %s but the lockfile has %s", baseRef, platform, digest, want)
+	}
+	return nil
+}
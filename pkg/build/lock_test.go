@@ -0,0 +1,143 @@
+package build
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newTestRegistry starts an in-memory registry and returns its host.
+func newTestRegistry(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(registry.New())
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// pushTestIndex pushes a two-platform index whose images carry the given author,
+// so that different authors produce different digests.
+func pushTestIndex(t *testing.T, ref string, author string) v1.ImageIndex {
+	t.Helper()
+	var addenda []mutate.IndexAddendum
+	for _, p := range []Platform{{OS: "linux", Arch: "amd64"}, {OS: "linux", Arch: "arm64"}} {
+		img := imageWithPlatform(t, p)
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg = cfg.DeepCopy()
+		cfg.Author = author
+		img, err = mutate.ConfigFile(img, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addenda = append(addenda, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: p.ToV1Platform()}})
+	}
+	idx := mutate.AppendManifests(empty.Index, addenda...)
+
+	tag, err := name.NewTag(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestLockFileRoundTripAndDiff(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	baseRef := newTestRegistry(t) + "/base:latest"
+	pushTestIndex(t, baseRef, "v1")
+
+	bases := map[string][]Platform{
+		baseRef:   {{OS: "linux", Arch: "amd64"}},
+		"scratch": {{OS: "linux", Arch: "amd64"}},
+	}
+	lock, err := ResolveLockFile(ctx, bases)
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	if len(lock.Bases) != 1 {
+		t.Fatalf("expected only the registry base to be locked, got %+v", lock.Bases)
+	}
+
+	path := filepath.Join(t.TempDir(), "tko.lock")
+	if err := WriteLockFile(path, lock); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := DiffLockFiles(lock, read); len(diff) != 0 {
+		t.Fatalf("expected no diff after round trip, got %v", diff)
+	}
+
+	pushTestIndex(t, baseRef, "v2")
+	updated, err := ResolveLockFile(ctx, bases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := DiffLockFiles(read, updated)
+	if len(diff) != 2 || !strings.HasPrefix(diff[0], "~ "+baseRef) || !strings.Contains(diff[1], "[linux/amd64]") {
+		t.Fatalf("unexpected diff: %v", diff)
+	}
+}
+
+func TestGetBaseImageUsesLock(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	baseRef := newTestRegistry(t) + "/base:latest"
+	amd64 := Platform{OS: "linux", Arch: "amd64"}
+
+	old := pushTestIndex(t, baseRef, "v1")
+	lock, err := ResolveLockFile(ctx, map[string][]Platform{baseRef: {amd64}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestIndex(t, baseRef, "v2")
+
+	ctx.Lock = lock
+	img, metadata, err := getBaseImage(ctx, baseRef, amd64, FORMAT_DOCKER, ctx.Keychain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, err := getImageForPlatform(old, amd64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDigest, _ := want.Digest()
+	gotDigest, _ := img.Digest()
+	if gotDigest != wantDigest {
+		t.Fatalf("expected locked image %s, got %s", wantDigest, gotDigest)
+	}
+	if strings.Contains(metadata.name, "@") {
+		t.Fatalf("base name label should not carry the locked digest: %s", metadata.name)
+	}
+
+	ctx.Locked = true
+	_, _, err = getBaseImage(ctx, baseRef, amd64, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil || !strings.Contains(err.Error(), "lockfile") {
+		t.Fatalf("expected locked mode to reject moved tag, got %v", err)
+	}
+
+	ctx.Lock, err = ResolveLockFile(ctx, map[string][]Platform{baseRef: {amd64}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := getBaseImage(ctx, baseRef, amd64, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("unexpected error after relocking: %v", err)
+	}
+	_, _, err = getBaseImage(ctx, baseRef, Platform{OS: "linux", Arch: "arm64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil || !strings.Contains(err.Error(), "not in the lockfile") {
+		t.Fatalf("expected locked mode to reject unlocked platform, got %v", err)
+	}
+}
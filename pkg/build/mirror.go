@@ -0,0 +1,109 @@
+package build
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// mirrorRefs returns the references to try for ref: each configured mirror
+// of its registry in order, then ref itself. A mirror is a registry host,
+// optionally followed by a path the upstream repository is nested under
+// (e.g. mirror.corp/dockerhub for docker.io/library/ubuntu gives
+// mirror.corp/dockerhub/library/ubuntu).
+func mirrorRefs(mirrors map[string][]string, ref name.Reference) ([]name.Reference, error) {
+	var refs []name.Reference
+	for _, registry := range slices.Sorted(maps.Keys(mirrors)) {
+		reg, err := name.NewRegistry(registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry in mirror configuration: %w", err)
+		}
+		if reg.RegistryStr() != ref.Context().RegistryStr() {
+			continue
+		}
+		for _, endpoint := range mirrors[registry] {
+			mirrored, err := mirrorRef(strings.TrimSuffix(endpoint, "/"), ref)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mirror %s for %s: %w", endpoint, registry, err)
+			}
+			refs = append(refs, mirrored)
+		}
+	}
+	return append(refs, ref), nil
+}
+
+func mirrorRef(endpoint string, ref name.Reference) (name.Reference, error) {
+	repo := endpoint + "/" + ref.Context().RepositoryStr()
+	if d, ok := ref.(name.Digest); ok {
+		return name.NewDigest(repo + "@" + d.DigestStr())
+	}
+	return name.NewTag(repo + ":" + ref.Identifier())
+}
+
+// withMirrors calls fn for each mirror of ref in order, falling back to ref
+// itself, and returns the first success. If everything fails, the upstream
+// error is returned.
+func withMirrors[T any](ctx BuildContext, ref name.Reference, fn func(name.Reference) (T, error)) (T, error) {
+	var zero T
+	refs, err := mirrorRefs(ctx.Mirrors, ref)
+	if err != nil {
+		return zero, err
+	}
+	for _, r := range refs[:len(refs)-1] {
+		result, err := fn(r)
+		if err == nil {
+			log.Printf("Using mirror %s for %s", r.Context(), ref.Context())
+			return result, nil
+		}
+		log.Printf("Mirror %s failed for %s: %v", r.Context(), ref, err)
+	}
+	return fn(ref)
+}
+
+func remoteGet(ctx BuildContext, ref name.Reference, keychain authn.Keychain) (*remote.Descriptor, error) {
+	return withMirrors(ctx, ref, func(r name.Reference) (*remote.Descriptor, error) {
+		return remote.Get(r, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(keychain))
+	})
+}
+
+func remoteHead(ctx BuildContext, ref name.Reference, keychain authn.Keychain) (*v1.Descriptor, error) {
+	return withMirrors(ctx, ref, func(r name.Reference) (*v1.Descriptor, error) {
+		return remote.Head(r, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(keychain))
+	})
+}
+
+// remoteGetOptional is remoteGet for references that may not exist, such as
+// cosign signature tags. found is false when ref doesn't exist, which includes a
+// mirror answering without it while the registry itself can't be reached.
+func remoteGetOptional(ctx BuildContext, ref name.Reference, keychain authn.Keychain) (*remote.Descriptor, bool, error) {
+	var missingOnMirror bool
+	desc, err := withMirrors(ctx, ref, func(r name.Reference) (*remote.Descriptor, error) {
+		desc, err := remote.Get(r, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(keychain))
+		if isNotFound(err) && r.String() != ref.String() {
+			missingOnMirror = true
+		}
+		return desc, err
+	})
+	switch {
+	case err == nil:
+		return desc, true, nil
+	case isNotFound(err) || missingOnMirror:
+		return nil, false, nil
+	}
+	return nil, false, err
+}
+
+// remoteReferrers lists the referrers of ref through mirrors.
+func remoteReferrers(ctx BuildContext, ref name.Digest, keychain authn.Keychain, options ...remote.Option) (v1.ImageIndex, error) {
+	return withMirrors(ctx, ref, func(r name.Reference) (v1.ImageIndex, error) {
+		opts := append([]remote.Option{remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(keychain)}, options...)
+		return remote.Referrers(r.(name.Digest), opts...)
+	})
+}
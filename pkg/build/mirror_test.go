@@ -0,0 +1,95 @@
+package build
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+func TestMirrorRefs(t *testing.T) {
+	ref, err := name.ParseReference("ubuntu:jammy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrors := map[string][]string{
+		"docker.io": {"mirror.corp/dockerhub/", "mirror2.corp"},
+		"ghcr.io":   {"mirror.corp/ghcr"},
+	}
+	refs, err := mirrorRefs(mirrors, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"mirror.corp/dockerhub/library/ubuntu:jammy",
+		"mirror2.corp/library/ubuntu:jammy",
+		"index.docker.io/library/ubuntu:jammy",
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("got %v, want %v", refs, want)
+	}
+	for i := range want {
+		if refs[i].Name() != want[i] {
+			t.Fatalf("refs[%d] = %s, want %s", i, refs[i].Name(), want[i])
+		}
+	}
+
+	digest, err := name.ParseReference("ghcr.io/org/app@sha256:" + strings.Repeat("a", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err = mirrorRefs(mirrors, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refs[0].Name(); got != "mirror.corp/ghcr/org/app@sha256:"+strings.Repeat("a", 64) {
+		t.Fatalf("unexpected digest mirror %s", got)
+	}
+}
+
+func TestGetBaseImageFromMirror(t *testing.T) {
+	upstream := httptest.NewServer(registry.New())
+	defer upstream.Close()
+	mirror := httptest.NewServer(registry.New())
+	defer mirror.Close()
+	dead := httptest.NewServer(registry.New())
+	dead.Close()
+
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	deadHost := strings.TrimPrefix(dead.URL, "http://")
+
+	ref, _ := pushTestBase(t, upstreamHost)
+	pushTestBase(t, mirrorHost)
+	upstream.Close()
+
+	ctx := newTestBuildContext(t)
+	ctx.Mirrors = map[string][]string{upstreamHost: {deadHost, mirrorHost}}
+
+	_, metadata, err := getBaseImage(ctx, ref.String(), Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.name != ref.Context().Name() {
+		t.Fatalf("base name %q, want upstream %q", metadata.name, ref.Context().Name())
+	}
+}
+
+func TestGetBaseImageMirrorFallback(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	dead := httptest.NewServer(registry.New())
+	dead.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref, _ := pushTestBase(t, host)
+
+	ctx := newTestBuildContext(t)
+	ctx.Mirrors = map[string][]string{host: {strings.TrimPrefix(dead.URL, "http://")}}
+
+	if _, _, err := getBaseImage(ctx, ref.String(), Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("expected fallback to upstream, got %v", err)
+	}
+}
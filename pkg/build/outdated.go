@@ -0,0 +1,205 @@
+package build
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+const (
+	baseNameLabel   = "org.opencontainers.image.base.name"
+	baseDigestLabel = "org.opencontainers.image.base.digest"
+)
+
+// OutdatedReport compares the base image digests in use with what the base tag points at now.
+type OutdatedReport struct {
+	Base      string             `json:"base"`
+	Latest    string             `json:"latest"`
+	Outdated  bool               `json:"outdated"`
+	Platforms []OutdatedPlatform `json:"platforms"`
+}
+
+type OutdatedPlatform struct {
+	Platform string `json:"platform"`
+	Current  string `json:"current"`
+	Latest   string `json:"latest"`
+	Outdated bool   `json:"outdated"`
+}
+
+// BaseDigests are the base image manifests an image was, or will be, built on.
+type BaseDigests struct {
+	// Name is the base reference as configured or recorded, which may lack a tag.
+	Name      string
+	Platforms map[Platform]string
+}
+
+// TagOf returns the tag explicitly named in a reference such as
+// debian:bookworm-slim or debian:bookworm-slim@sha256:..., if there is one.
+func TagOf(ref string) (name.Tag, bool) {
+	str, _, _ := strings.Cut(ref, "@")
+	if strings.LastIndex(str, ":") <= strings.LastIndex(str, "/") {
+		return name.Tag{}, false
+	}
+	tag, err := name.NewTag(str)
+	if err != nil {
+		return name.Tag{}, false
+	}
+	return tag, true
+}
+
+// PinnedBaseDigests returns the digests a build of baseRef uses for each
+// platform: those of the digest in the reference, or else those locked in ctx.Lock.
+func PinnedBaseDigests(ctx BuildContext, baseRef string, platforms []Platform) (BaseDigests, error) {
+	if !isLockable(baseRef) {
+		return BaseDigests{}, fmt.Errorf("base image %s does not come from a registry", baseRef)
+	}
+	digests := BaseDigests{Name: baseRef, Platforms: make(map[Platform]string)}
+
+	if _, digest, ok := strings.Cut(baseRef, "@"); ok {
+		ref, err := name.ParseReference(baseRef)
+		if err != nil {
+			return BaseDigests{}, fmt.Errorf("failed to parse base image reference: %w", err)
+		}
+		desc, err := remoteGet(ctx, ref.Context().Digest(digest), ctx.Keychain)
+		if err != nil {
+			return BaseDigests{}, fmt.Errorf("failed to retrieve base image %s: %w", baseRef, err)
+		}
+		for _, p := range platforms {
+			d, err := descriptorPlatformDigest(desc, p)
+			if err != nil {
+				return BaseDigests{}, fmt.Errorf("failed to resolve %s for platform %s: %w", baseRef, p, err)
+			}
+			digests.Platforms[p] = d.String()
+		}
+		return digests, nil
+	}
+
+	locked, ok := ctx.Lock.find(baseRef)
+	if !ok {
+		return BaseDigests{}, fmt.Errorf("base image %s is neither digest-pinned nor in the lockfile", baseRef)
+	}
+	for _, p := range platforms {
+		d, ok := locked.Platforms[p.String()]
+		if !ok {
+			return BaseDigests{}, fmt.Errorf("platform %s of base image %s is not in the lockfile", p, baseRef)
+		}
+		digests.Platforms[p] = d
+	}
+	return digests, nil
+}
+
+// PublishedBaseDigests reads the base image labels of a published image or of
+// every platform image in a published index.
+func PublishedBaseDigests(ctx BuildContext, imageRef string) (BaseDigests, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return BaseDigests{}, fmt.Errorf("failed to parse image reference: %w", err)
+	}
+	desc, err := remote.Get(ref, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain))
+	if err != nil {
+		return BaseDigests{}, fmt.Errorf("failed to retrieve image %s: %w", imageRef, err)
+	}
+
+	var images []v1.Image
+	switch {
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return BaseDigests{}, err
+		}
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return BaseDigests{}, err
+		}
+		for _, m := range manifest.Manifests {
+			// Skip attestations and other manifests that are not platform images
+			if m.Platform == nil || m.Platform.OS == "unknown" || !m.MediaType.IsImage() {
+				continue
+			}
+			img, err := index.Image(m.Digest)
+			if err != nil {
+				return BaseDigests{}, err
+			}
+			images = append(images, img)
+		}
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return BaseDigests{}, err
+		}
+		images = append(images, img)
+	default:
+		return BaseDigests{}, fmt.Errorf("unsupported media type: %s", desc.MediaType)
+	}
+
+	digests := BaseDigests{Platforms: make(map[Platform]string)}
+	for _, img := range images {
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return BaseDigests{}, fmt.Errorf("failed to read image config: %w", err)
+		}
+		p := Platform{OS: cfg.OS, Arch: cfg.Architecture, Variant: cfg.Variant}
+		baseName, baseDigest := cfg.Config.Labels[baseNameLabel], cfg.Config.Labels[baseDigestLabel]
+		if baseName == "" || baseDigest == "" {
+			return BaseDigests{}, fmt.Errorf("image %s for platform %s has no base image labels", imageRef, p)
+		}
+		if digests.Name != "" && digests.Name != baseName {
+			return BaseDigests{}, fmt.Errorf("image %s has different bases per platform (%s, %s)", imageRef, digests.Name, baseName)
+		}
+		digests.Name = baseName
+		digests.Platforms[p] = baseDigest
+	}
+	if len(digests.Platforms) == 0 {
+		return BaseDigests{}, fmt.Errorf("image %s has no platform images", imageRef)
+	}
+	return digests, nil
+}
+
+// CheckOutdated resolves tag and compares each platform's current digest with it.
+func CheckOutdated(ctx BuildContext, tag name.Tag, current BaseDigests) (OutdatedReport, error) {
+	desc, err := remoteGet(ctx, tag, ctx.Keychain)
+	if err != nil {
+		return OutdatedReport{}, fmt.Errorf("failed to resolve base image %s: %w", tag, err)
+	}
+
+	report := OutdatedReport{Base: tag.String(), Latest: desc.Digest.String()}
+	platforms := slices.SortedFunc(maps.Keys(current.Platforms), func(a, b Platform) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	for _, p := range platforms {
+		latest, err := descriptorPlatformDigest(desc, p)
+		if err != nil {
+			return OutdatedReport{}, fmt.Errorf("failed to resolve %s for platform %s: %w", tag, p, err)
+		}
+		entry := OutdatedPlatform{
+			Platform: p.String(),
+			Current:  current.Platforms[p],
+			Latest:   latest.String(),
+			Outdated: current.Platforms[p] != latest.String(),
+		}
+		report.Outdated = report.Outdated || entry.Outdated
+		report.Platforms = append(report.Platforms, entry)
+	}
+	return report, nil
+}
+
+// descriptorPlatformDigest returns the manifest for platform in desc: the
+// matching index entry, or desc itself if it is a single image.
+func descriptorPlatformDigest(desc *remote.Descriptor, p Platform) (v1.Hash, error) {
+	switch {
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		return getDigestForPlatform(index, p)
+	case desc.MediaType.IsImage():
+		return desc.Digest, nil
+	}
+	return v1.Hash{}, fmt.Errorf("unsupported media type: %s", desc.MediaType)
+}
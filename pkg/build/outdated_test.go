@@ -0,0 +1,117 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestTagOf(t *testing.T) {
+	cases := map[string]string{
+		"debian:bookworm-slim":              "index.docker.io/library/debian:bookworm-slim",
+		"localhost:5000/base:1@sha256:abcd": "localhost:5000/base:1",
+		"ghcr.io/org/base:v2":               "ghcr.io/org/base:v2",
+		"localhost:5000/base":               "",
+		"index.docker.io/library/debian":    "",
+	}
+	for in, want := range cases {
+		tag, ok := TagOf(in)
+		if want == "" {
+			if ok {
+				t.Fatalf("TagOf(%q) = %s, want no tag", in, tag)
+			}
+			continue
+		}
+		if !ok || tag.Name() != want {
+			t.Fatalf("TagOf(%q) = %s, %v, want %s", in, tag, ok, want)
+		}
+	}
+}
+
+func TestCheckOutdatedFromPublishedImage(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	pushTestIndex(t, host+"/base:1", "v1")
+
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	spec.BaseRef = host + "/base:1"
+	spec.Target = BuildSpecTarget{Repo: host + "/app:latest", Type: REMOTE}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	current, err := PublishedBaseDigests(ctx, host+"/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64 := Platform{OS: "linux", Arch: "amd64"}
+	if current.Name != host+"/base" || current.Platforms[amd64] == "" || len(current.Platforms) != 1 {
+		t.Fatalf("unexpected base digests: %+v", current)
+	}
+
+	tag, err := name.NewTag(host + "/base:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := CheckOutdated(ctx, tag, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Outdated {
+		t.Fatalf("expected up to date, got %+v", report)
+	}
+
+	pushTestIndex(t, host+"/base:1", "v2")
+	report, err = CheckOutdated(ctx, tag, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Outdated || len(report.Platforms) != 1 || !report.Platforms[0].Outdated {
+		t.Fatalf("expected update available, got %+v", report)
+	}
+	if report.Platforms[0].Current != current.Platforms[amd64] || report.Platforms[0].Latest == current.Platforms[amd64] {
+		t.Fatalf("unexpected platform report: %+v", report.Platforms[0])
+	}
+}
+
+func TestPinnedBaseDigests(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	idx := pushTestIndex(t, host+"/base:1", "v1")
+	digest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	platforms := []Platform{{OS: "linux", Arch: "amd64"}, {OS: "linux", Arch: "arm64"}}
+	pinned, err := PinnedBaseDigests(ctx, host+"/base:1@"+digest.String(), platforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range platforms {
+		want, err := getDigestForPlatform(idx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pinned.Platforms[p] != want.String() {
+			t.Fatalf("platform %s pinned to %s, want %s", p, pinned.Platforms[p], want)
+		}
+	}
+
+	if _, err := PinnedBaseDigests(ctx, host+"/base:1", platforms); err == nil {
+		t.Fatal("expected an unpinned tag without a lockfile to fail")
+	}
+
+	lock, err := ResolveLockFile(ctx, map[string][]Platform{host + "/base:1": platforms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Lock = lock
+	locked, err := PinnedBaseDigests(ctx, host+"/base:1", platforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked.Platforms[platforms[1]] != pinned.Platforms[platforms[1]] {
+		t.Fatalf("lockfile digests %v differ from pinned %v", locked.Platforms, pinned.Platforms)
+	}
+}
@@ -0,0 +1,172 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// BasePolicy restricts which base images may be built on.
+//
+// Allow and Deny are patterns matched against the base repository
+// (e.g. docker.io/library/ubuntu). A pattern is a path.Match glob, and a
+// trailing /** matches everything below it. Docker Hub references are
+// matched as docker.io. Local bases are matched by their full reference.
+type BasePolicy struct {
+	Allow         []string `yaml:"allow"`
+	Deny          []string `yaml:"deny"`
+	RequireDigest bool     `yaml:"require-digest"`
+	// MaxAge is a duration such as 720h or 30d, compared with the base config's Created time.
+	MaxAge string `yaml:"max-age"`
+}
+
+// ReadBasePolicy reads a standalone policy file.
+func ReadBasePolicy(path string) (*BasePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy BasePolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %w", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return &policy, nil
+}
+
+// Validate checks the patterns and max age parse.
+func (p *BasePolicy) Validate() error {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if p.MaxAge != "" {
+		if _, err := parseMaxAge(p.MaxAge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMaxAge accepts Go durations, plus a plain number of days (30d).
+func parseMaxAge(str string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(str, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid max age: %s", str)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid max age: %s", str)
+	}
+	return d, nil
+}
+
+func matchesPattern(pattern, repo string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if repo == prefix || strings.HasPrefix(repo, prefix+"/") {
+			return true
+		}
+	}
+	ok, _ := path.Match(pattern, repo)
+	return ok
+}
+
+// policyRepoName is the name base refs are matched by.
+func policyRepoName(baseRef string) (string, error) {
+	if isLocalBaseRef(baseRef) {
+		return baseRef, nil
+	}
+	ref, err := name.ParseReference(baseRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse base image reference: %w", err)
+	}
+	repo := ref.Context()
+	if repo.RegistryStr() == name.DefaultRegistry {
+		return "docker.io/" + repo.RepositoryStr(), nil
+	}
+	return repo.Name(), nil
+}
+
+// checkRef returns the violations that can be found from the reference alone.
+// allowed is false when the repository must not be contacted at all.
+func (p *BasePolicy) checkRef(ctx BuildContext, baseRef string) (violations []string, allowed bool, err error) {
+	repo, err := policyRepoName(baseRef)
+	if err != nil {
+		return nil, false, err
+	}
+
+	allowed = true
+	for _, pattern := range p.Deny {
+		if matchesPattern(pattern, repo) {
+			violations = append(violations, fmt.Sprintf("%s matches deny pattern %q", repo, pattern))
+			allowed = false
+		}
+	}
+	if len(p.Allow) > 0 {
+		matched := false
+		for _, pattern := range p.Allow {
+			matched = matched || matchesPattern(pattern, repo)
+		}
+		if !matched {
+			violations = append(violations, fmt.Sprintf("%s does not match any allowed pattern", repo))
+			allowed = false
+		}
+	}
+
+	if p.RequireDigest && !isDigestPinned(ctx, baseRef) {
+		violations = append(violations, fmt.Sprintf("%s is not pinned to a digest", baseRef))
+	}
+	return violations, allowed, nil
+}
+
+// isDigestPinned reports whether baseRef names a digest, or is locked to one with --locked.
+func isDigestPinned(ctx BuildContext, baseRef string) bool {
+	if strings.Contains(baseRef, "@sha256:") {
+		return true
+	}
+	if _, ok := ctx.Lock.find(baseRef); ok && ctx.Locked {
+		return true
+	}
+	return false
+}
+
+// checkImage returns the violations found in the base image config.
+func (p *BasePolicy) checkImage(img v1.Image, now time.Time) ([]string, error) {
+	if p.MaxAge == "" {
+		return nil, nil
+	}
+	maxAge, err := parseMaxAge(p.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base image config: %w", err)
+	}
+	created := cfg.Created.Time
+	if created.IsZero() {
+		return []string{"base image has no creation time"}, nil
+	}
+	if age := now.Sub(created); age > maxAge {
+		return []string{fmt.Sprintf("base image was created %s, %s ago, exceeding the maximum age of %s",
+			created.UTC().Format(time.RFC3339), age.Round(time.Hour), p.MaxAge)}, nil
+	}
+	return nil, nil
+}
+
+func policyError(baseRef string, violations []string) error {
+	return fmt.Errorf("base image %s violates policy:\n  - %s", baseRef, strings.Join(violations, "\n  - "))
+}
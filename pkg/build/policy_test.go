@@ -0,0 +1,133 @@
+package build
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+func TestMatchesPattern(t *testing.T) {
+	cases := []struct {
+		pattern, repo string
+		want          bool
+	}{
+		{"docker.io/library/*", "docker.io/library/ubuntu", true},
+		{"docker.io/library/*", "docker.io/myorg/ubuntu", false},
+		{"ghcr.io/myorg/**", "ghcr.io/myorg/base/debian", true},
+		{"ghcr.io/myorg/**", "ghcr.io/myorg", true},
+		{"ghcr.io/myorg/**", "ghcr.io/myorganisation/base", false},
+		{"gcr.io/distroless/static", "gcr.io/distroless/static", true},
+	}
+	for _, c := range cases {
+		if got := matchesPattern(c.pattern, c.repo); got != c.want {
+			t.Fatalf("matchesPattern(%q, %q) = %v, want %v", c.pattern, c.repo, got, c.want)
+		}
+	}
+}
+
+func TestParseMaxAge(t *testing.T) {
+	for in, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "12h": 12 * time.Hour} {
+		got, err := parseMaxAge(in)
+		if err != nil || got != want {
+			t.Fatalf("parseMaxAge(%q) = %v, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "d", "-1d", "soon"} {
+		if _, err := parseMaxAge(in); err == nil {
+			t.Fatalf("parseMaxAge(%q): expected error", in)
+		}
+	}
+}
+
+func TestPolicyCheckRef(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	policy := &BasePolicy{
+		Allow:         []string{"docker.io/library/*"},
+		Deny:          []string{"docker.io/library/centos"},
+		RequireDigest: true,
+	}
+
+	violations, allowed, err := policy.checkRef(ctx, "ubuntu:jammy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed || len(violations) != 1 || !strings.Contains(violations[0], "not pinned") {
+		t.Fatalf("unexpected result: %v %v", allowed, violations)
+	}
+
+	violations, allowed, err = policy.checkRef(ctx, "centos:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed || len(violations) != 2 {
+		t.Fatalf("expected deny and digest violations, got %v %v", allowed, violations)
+	}
+
+	violations, allowed, err = policy.checkRef(ctx, "quay.io/other/image@sha256:"+strings.Repeat("a", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed || len(violations) != 1 || !strings.Contains(violations[0], "allowed pattern") {
+		t.Fatalf("expected allowlist violation, got %v %v", allowed, violations)
+	}
+
+	// A locked tag counts as pinned in --locked mode
+	ctx.Lock = &LockFile{Version: lockFileVersion, Bases: []LockedBase{{Ref: "ubuntu:jammy"}}}
+	ctx.Locked = true
+	violations, _, err = policy.checkRef(ctx, "ubuntu:jammy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("expected locked ref to be pinned, got %v", violations)
+	}
+}
+
+func TestPolicyCheckImageAge(t *testing.T) {
+	img := imageWithPlatform(t, Platform{OS: "linux", Arch: "amd64"})
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	cfg = cfg.DeepCopy()
+	cfg.Created = v1.Time{Time: now.Add(-40 * 24 * time.Hour)}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations, err := (&BasePolicy{MaxAge: "30d"}).checkImage(img, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || !strings.Contains(violations[0], "maximum age") {
+		t.Fatalf("expected age violation, got %v", violations)
+	}
+
+	violations, err = (&BasePolicy{MaxAge: "60d"}).checkImage(img, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+}
+
+func TestGetBaseImageReportsAllViolations(t *testing.T) {
+	ref, _ := pushTestBase(t, newTestRegistry(t))
+	ctx := newTestBuildContext(t)
+	ctx.Policy = &BasePolicy{RequireDigest: true, MaxAge: "1h"}
+
+	tag := ref.Context().Tag("latest").String()
+	_, _, err := getBaseImage(ctx, tag, Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil {
+		t.Fatal("expected policy violation")
+	}
+	if !strings.Contains(err.Error(), "not pinned") || !strings.Contains(err.Error(), "creation time") {
+		t.Fatalf("expected both violations to be reported, got: %v", err)
+	}
+}
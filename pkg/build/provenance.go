@@ -0,0 +1,260 @@
+package build
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Media types and identifiers of in-toto statements carrying SLSA provenance.
+// Signed statements are wrapped in a DSSE envelope.
+const (
+	inTotoStatementType     = "https://in-toto.io/Statement/v1"
+	inTotoMediaType         = "application/vnd.in-toto+json"
+	inTotoPredicateTypeAnno = "in-toto.io/predicate-type"
+	slsaProvenanceType      = "https://slsa.dev/provenance/v1"
+	dsseMediaType           = "application/vnd.dsse.envelope.v1+json"
+
+	tkoBuildType = "https://github.com/dskiff/tko/build/v1"
+	tkoBuilderID = "https://github.com/dskiff/tko"
+)
+
+// BuildSource is the source revision an image was built from, recorded in its provenance.
+type BuildSource struct {
+	// Repository is the URL of the git remote. Empty when there is none.
+	Repository string
+	Commit     string
+	Dirty      bool
+}
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string                   `json:"buildType"`
+		ExternalParameters   provenanceParameters     `json:"externalParameters"`
+		ResolvedDependencies []slsaResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+}
+
+type slsaResourceDescriptor struct {
+	URI         string            `json:"uri,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]any    `json:"annotations,omitempty"`
+}
+
+// provenanceParameters is the part of a BuildSpec that determines the image.
+// Local paths and publishing details are left out.
+type provenanceParameters struct {
+	Base             string            `json:"base"`
+	Platform         string            `json:"platform"`
+	DestinationPath  string            `json:"destinationPath"`
+	DestinationChown bool              `json:"destinationChown"`
+	Entrypoint       string            `json:"entrypoint"`
+	Author           string            `json:"author,omitempty"`
+	Annotations      map[string]string `json:"annotations,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+	RunAs            *string           `json:"runAs,omitempty"`
+}
+
+// generateProvenance describes how img was built as an in-toto statement with
+// a SLSA provenance predicate, signed when ctx has a ProvenanceSigner. It
+// records no timestamps, so rebuilding an image reproduces unsigned provenance.
+func generateProvenance(ctx BuildContext, spec BuildSpec, base BaseImageMetadata, img v1.Image) (Attachment, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to get image digest: %w", err)
+	}
+
+	statement := inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []inTotoSubject{{Name: imageName(spec.Target), Digest: map[string]string{digest.Algorithm: digest.Hex}}},
+		PredicateType: slsaProvenanceType,
+	}
+	def := &statement.Predicate.BuildDefinition
+	def.BuildType = tkoBuildType
+	def.ExternalParameters = provenanceParameters{
+		Base:             provenanceBase(spec.BaseRef, base),
+		Platform:         spec.InjectLayer.Platform.String(),
+		DestinationPath:  spec.InjectLayer.DestinationPath,
+		DestinationChown: spec.InjectLayer.DestinationChown,
+		Entrypoint:       spec.InjectLayer.Entrypoint,
+		Author:           spec.Author,
+		Annotations:      spec.Annotations,
+		Env:              spec.Env,
+		RunAs:            spec.RunAs,
+	}
+	def.ResolvedDependencies = []slsaResourceDescriptor{}
+	if base.imageDigest != "" {
+		baseDigest, err := v1.NewHash(base.imageDigest)
+		if err != nil {
+			return Attachment{}, fmt.Errorf("failed to parse base image digest: %w", err)
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, slsaResourceDescriptor{
+			Name:   base.name,
+			Digest: map[string]string{baseDigest.Algorithm: baseDigest.Hex},
+		})
+	}
+	if spec.Source != nil {
+		source := slsaResourceDescriptor{
+			Digest: map[string]string{"gitCommit": spec.Source.Commit},
+		}
+		if spec.Source.Repository != "" {
+			source.URI = "git+" + spec.Source.Repository
+		}
+		if spec.Source.Dirty {
+			source.Annotations = map[string]any{"dirty": true}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, source)
+	}
+	builder := &statement.Predicate.RunDetails.Builder
+	builder.ID = tkoBuilderID
+	builder.Version = map[string]string{"tko": toolVersion(ctx)}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return Attachment{}, err
+	}
+	attachment := Attachment{
+		ArtifactType: inTotoMediaType,
+		Data:         payload,
+		Extension:    ".provenance.json",
+		Annotations:  map[string]string{inTotoPredicateTypeAnno: slsaProvenanceType},
+	}
+	if ctx.ProvenanceSigner != nil {
+		envelope, err := ctx.ProvenanceSigner.sign(inTotoMediaType, payload)
+		if err != nil {
+			return Attachment{}, fmt.Errorf("failed to sign provenance: %w", err)
+		}
+		attachment.MediaType = dsseMediaType
+		attachment.Data, err = json.Marshal(envelope)
+		if err != nil {
+			return Attachment{}, err
+		}
+	}
+	return attachment, nil
+}
+
+// provenanceBase is the base reference recorded in provenance. Local bases are
+// recorded by digest alone, since their references hold paths on this machine.
+func provenanceBase(baseRef string, base BaseImageMetadata) string {
+	if isLocalBaseRef(baseRef) {
+		return base.imageDigest
+	}
+	return baseRef
+}
+
+// ProvenanceSigner signs provenance statements with a local private key.
+type ProvenanceSigner struct {
+	key   crypto.Signer
+	keyID string
+}
+
+// NewProvenanceSigner loads an unencrypted PEM encoded ECDSA, RSA or Ed25519
+// private key, given either as a path to a key file or as the PEM text itself.
+func NewProvenanceSigner(key string) (*ProvenanceSigner, error) {
+	data := []byte(key)
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		var err error
+		data, err = os.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read provenance key: %w", err)
+		}
+	}
+	signer, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse provenance key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode provenance public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return &ProvenanceSigner{key: signer, keyID: hex.EncodeToString(sum[:])}, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q; expected an unencrypted PKCS#8, EC or PKCS#1 private key", block.Type)
+}
+
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     []byte          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// dssePAE is the pre-authentication encoding DSSE signs instead of the bare payload.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+// sign wraps payload in a DSSE envelope. ECDSA and RSA (PKCS #1 v1.5) sign
+// a SHA-256 digest of the encoding, as cosign does; Ed25519 signs it whole.
+func (s *ProvenanceSigner) sign(payloadType string, payload []byte) (dsseEnvelope, error) {
+	message := dssePAE(payloadType, payload)
+	var sig []byte
+	var err error
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		sig, err = s.key.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return dsseEnvelope{}, err
+	}
+	return dsseEnvelope{
+		PayloadType: payloadType,
+		Payload:     payload,
+		Signatures:  []dsseSignature{{KeyID: s.keyID, Sig: sig}},
+	}, nil
+}
@@ -0,0 +1,211 @@
+package build
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// provenanceOf returns the statement attached to the only platform of result.
+func provenanceOf(t *testing.T, result *BuildResult) inTotoStatement {
+	t.Helper()
+	for _, a := range result.Platforms[0].Attachments {
+		if a.ArtifactType != inTotoMediaType {
+			continue
+		}
+		payload := a.Data
+		if a.MediaType == dsseMediaType {
+			var envelope dsseEnvelope
+			if err := json.Unmarshal(a.Data, &envelope); err != nil {
+				t.Fatalf("failed to decode DSSE envelope: %v", err)
+			}
+			payload = envelope.Payload
+		}
+		var statement inTotoStatement
+		if err := json.Unmarshal(payload, &statement); err != nil {
+			t.Fatalf("failed to decode statement: %v", err)
+		}
+		return statement
+	}
+	t.Fatalf("no provenance attached")
+	return inTotoStatement{}
+}
+
+func TestProvenanceRecordsBaseAndSource(t *testing.T) {
+	baseRef := newTestRegistry(t) + "/base:1"
+	pushTestIndex(t, baseRef, "base")
+
+	ctx := newTestBuildContext(t)
+	ctx.Version = "1.2.3"
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "hello"}))
+	spec.BaseRef = baseRef
+	spec.Target = BuildSpecTarget{Repo: "registry.example/app:latest", Type: REMOTE}
+	spec.Provenance = true
+	spec.Source = &BuildSource{Repository: "https://github.com/example/app.git", Commit: "0123abcd", Dirty: true}
+
+	result, err := BuildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("BuildImage: %v", err)
+	}
+	statement := provenanceOf(t, result)
+
+	if statement.PredicateType != slsaProvenanceType || len(statement.Subject) != 1 {
+		t.Fatalf("unexpected statement: %+v", statement)
+	}
+	if got := "sha256:" + statement.Subject[0].Digest["sha256"]; got != result.Digest || statement.Subject[0].Name != "registry.example/app" {
+		t.Fatalf("unexpected subject: %+v", statement.Subject[0])
+	}
+	if v := statement.Predicate.RunDetails.Builder.Version["tko"]; v != "1.2.3" {
+		t.Fatalf("expected tko version 1.2.3, got %q", v)
+	}
+	params := statement.Predicate.BuildDefinition.ExternalParameters
+	if params.Base != baseRef || params.Platform != "linux/amd64" || params.Entrypoint != "/app/mybin" {
+		t.Fatalf("unexpected parameters: %+v", params)
+	}
+
+	deps := statement.Predicate.BuildDefinition.ResolvedDependencies
+	if len(deps) != 2 {
+		t.Fatalf("expected base and source dependencies, got %+v", deps)
+	}
+	if got := "sha256:" + deps[0].Digest["sha256"]; got != result.Platforms[0].Base.Digest {
+		t.Fatalf("expected base digest %s, got %s", result.Platforms[0].Base.Digest, got)
+	}
+	if deps[1].URI != "git+https://github.com/example/app.git" || deps[1].Digest["gitCommit"] != "0123abcd" || deps[1].Annotations["dirty"] != true {
+		t.Fatalf("unexpected source: %+v", deps[1])
+	}
+
+	again, err := BuildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("BuildImage: %v", err)
+	}
+	if first, second := result.Platforms[0].Attachments[0].Data, again.Platforms[0].Attachments[0].Data; string(first) != string(second) {
+		t.Fatalf("expected unsigned provenance to be reproducible")
+	}
+}
+
+func TestProvenanceLocalBaseByDigest(t *testing.T) {
+	dir, digests := writeTestLayout(t)
+
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "hello"}))
+	spec.BaseRef = "oci-layout:" + dir
+	spec.Target = BuildSpecTarget{Repo: "registry.example/app:latest", Type: REMOTE}
+	spec.Provenance = true
+
+	result, err := BuildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("BuildImage: %v", err)
+	}
+	def := provenanceOf(t, result).Predicate.BuildDefinition
+	if base := def.ExternalParameters.Base; base != digests["linux/amd64"].String() {
+		t.Fatalf("expected the base digest without its path, got %q", base)
+	}
+	if len(def.ResolvedDependencies) != 1 || def.ResolvedDependencies[0].Name != "" {
+		t.Fatalf("unexpected dependencies: %+v", def.ResolvedDependencies)
+	}
+}
+
+func TestProvenanceSignedReferrer(t *testing.T) {
+	key, pubPath := newTestSigningKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewProvenanceSigner(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	if err != nil {
+		t.Fatalf("NewProvenanceSigner: %v", err)
+	}
+	verifier, err := NewSignatureVerifier([]string{pubPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestBuildContext(t)
+	ctx.ProvenanceSigner = signer
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "hello"}))
+	spec.Target = BuildSpecTarget{Repo: newTestRegistry(t) + "/app:latest", Type: REMOTE}
+	spec.Provenance = true
+
+	result, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	// ECDSA signatures are randomized, so only a push may attach another statement
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	subject, err := name.NewDigest(result.Pinned())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := remote.Referrers(subject)
+	if err != nil {
+		t.Fatalf("Referrers: %v", err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 1 || manifest.Manifests[0].ArtifactType != inTotoMediaType {
+		t.Fatalf("expected one in-toto referrer, got %+v", manifest.Manifests)
+	}
+	referrer, err := remote.Image(subject.Context().Digest(manifest.Manifests[0].Digest.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := referrer.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].MediaType != dsseMediaType || m.Layers[0].Annotations[inTotoPredicateTypeAnno] != slsaProvenanceType {
+		t.Fatalf("unexpected layer: %+v", m.Layers[0])
+	}
+
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(result.Platforms[0].Attachments[0].Data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if len(envelope.Signatures) != 1 || !verifier.verifyPayload(dssePAE(envelope.PayloadType, envelope.Payload), envelope.Signatures[0].Sig) {
+		t.Fatalf("expected a valid signature from the test key")
+	}
+}
+
+func TestProvenanceSignerEd25519File(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "provenance.key")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewProvenanceSigner(path)
+	if err != nil {
+		t.Fatalf("NewProvenanceSigner: %v", err)
+	}
+	envelope, err := signer.sign(inTotoMediaType, []byte("{}"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if !ed25519.Verify(pub, dssePAE(inTotoMediaType, []byte("{}")), envelope.Signatures[0].Sig) {
+		t.Fatalf("signature does not verify")
+	}
+
+	if _, err := NewProvenanceSigner("-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n"); err == nil {
+		t.Fatalf("expected an error for a PEM block without a private key")
+	}
+}
@@ -1,75 +1,474 @@
 package build
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
-func publishIndex(ctx BuildContext, index v1.ImageIndex, target BuildSpecTarget) error {
-	ref, err := name.NewTag(target.Repo)
+// Refs returns every tag the target is published under.
+func (t BuildSpecTarget) Refs() ([]name.Tag, error) {
+	if len(t.Tags) == 0 {
+		ref, err := name.NewTag(t.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse target repo: %w", err)
+		}
+		return []name.Tag{ref}, nil
+	}
+
+	var refs []name.Tag
+	if tag, ok := TagOf(t.Repo); ok {
+		refs = append(refs, tag)
+	}
+	repo, err := name.NewTag(t.Repo)
 	if err != nil {
-		return fmt.Errorf("failed to parse target repo: %w", err)
+		return nil, fmt.Errorf("failed to parse target repo: %w", err)
+	}
+	for _, tag := range t.Tags {
+		ref, err := name.NewTag(repo.Context().Name() + ":" + tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+		if !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
 	}
+	return refs, nil
+}
+
+// OutputPath is the file or directory a LOCAL_FILE or OCI_LAYOUT target writes to.
+func (t BuildSpecTarget) OutputPath() string {
+	if t.Output != "" {
+		return t.Output
+	}
+	if t.Type == OCI_LAYOUT {
+		return "oci-layout"
+	}
+	return "out.tar"
+}
 
-	log.Println("Publishing multi-platform index to remote...")
+func (t BuildSpecTarget) String() string {
+	switch t.Type {
+	case LOCAL_FILE, OCI_LAYOUT:
+		return fmt.Sprintf("%s %s (%s)", t.Type, t.OutputPath(), t.Repo)
+	default:
+		return fmt.Sprintf("%s %s", t.Type, t.Repo)
+	}
+}
 
-	err = remote.WriteIndex(ref, index, remote.WithContext(ctx.Context),
-		remote.WithAuthFromKeychain(ctx.Keychain))
+// publishTargets runs publish for every target concurrently and reports how
+// each one went. Unless allowPartialFailure is set, any failure fails the build.
+// The returned slice holds each target's error, in order.
+func publishTargets(targets []BuildSpecTarget, allowPartialFailure bool, publish func(BuildSpecTarget) error) ([]error, error) {
+	if len(targets) == 1 {
+		err := publish(targets[0])
+		return []error{err}, err
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Go(func() {
+			errs[i] = publish(target)
+		})
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, target := range targets {
+		if errs[i] != nil {
+			log.Printf("Failed: %s: %v", target, errs[i])
+			failed = append(failed, fmt.Errorf("%s: %w", target, errs[i]))
+		} else {
+			log.Printf("Published: %s", target)
+		}
+	}
+	if len(failed) == 0 {
+		return errs, nil
+	}
+	if allowPartialFailure && len(failed) < len(targets) {
+		log.Printf("Published to %d of %d targets", len(targets)-len(failed), len(targets))
+		return errs, nil
+	}
+	return errs, fmt.Errorf("failed to publish to %d of %d targets: %w", len(failed), len(targets), errors.Join(failed...))
+}
+
+// openLayout opens the OCI image layout at path, creating an empty one if there is none.
+func openLayout(path string) (layout.Path, error) {
+	p, err := layout.FromPath(path)
+	if err == nil {
+		return p, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to open OCI layout %s: %w", path, err)
+	}
+	p, err = layout.Write(path, empty.Index)
 	if err != nil {
-		return fmt.Errorf("failed to write index to remote: %w", err)
+		return "", fmt.Errorf("failed to create OCI layout %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// writeLayout adds image to the layout at path once per tag, replacing
+// whatever each tag pointed at before.
+func writeLayout(path string, image v1.Image, refs []name.Tag) error {
+	p, err := openLayout(path)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		tag := ref.TagStr()
+		err := p.ReplaceImage(image, refNameMatcher(tag), layout.WithAnnotations(map[string]string{ociRefNameAnnotation: tag}))
+		if err != nil {
+			return fmt.Errorf("failed to write image to OCI layout %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func refNameMatcher(tag string) match.Matcher {
+	return func(desc v1.Descriptor) bool {
+		return desc.Annotations[ociRefNameAnnotation] == tag
+	}
+}
+
+// taggableArtifact is an image or index that can be written to a registry.
+type taggableArtifact interface {
+	remote.Taggable
+	Digest() (v1.Hash, error)
+}
+
+// writeRemote publishes artifact under the tags that don't already point at
+// it: write uploads it under the first, the rest only get the manifest. It
+// reports whether anything was written.
+func writeRemote(ctx BuildContext, refs []name.Tag, artifact taggableArtifact, write func(name.Tag) error) (bool, error) {
+	digest, err := artifact.Digest()
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve digest: %w", err)
+	}
+	stale, err := staleRefs(ctx, refs, digest)
+	if err != nil {
+		return false, err
+	}
+	if len(stale) == 0 {
+		log.Printf("Up to date: %s", refs[0].Context().Digest(digest.String()))
+		return false, nil
+	}
+
+	if err := write(stale[0]); err != nil {
+		return false, err
+	}
+	// The blobs are all uploaded; further tags only need the manifest
+	for _, ref := range stale[1:] {
+		err := remote.Tag(ref, artifact, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain))
+		if err != nil {
+			return false, fmt.Errorf("failed to tag %s: %w", ref, err)
+		}
+	}
+	return true, nil
+}
+
+// staleRefs returns the tags that don't already point at digest. With
+// FailIfChanged, such a tag is an error instead, as is an existing immutable tag.
+func staleRefs(ctx BuildContext, refs []name.Tag, digest v1.Hash) ([]name.Tag, error) {
+	var stale []name.Tag
+	for _, ref := range refs {
+		desc, err := remote.Head(ref, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain))
+		immutable := isImmutable(ctx.ImmutableTags, ref.TagStr())
+		switch {
+		case err == nil && desc.Digest == digest:
+			continue
+		case immutable && err == nil:
+			return nil, fmt.Errorf("refusing to overwrite immutable tag %s: it points at %s, not %s", ref, desc.Digest, digest)
+		case immutable && !isNotFound(err):
+			return nil, fmt.Errorf("failed to check immutable tag %s: %w", ref, err)
+		case ctx.FailIfChanged && err == nil:
+			return nil, fmt.Errorf("%s changed: it points at %s, but the rebuild is %s", ref, desc.Digest, digest)
+		case ctx.FailIfChanged && isNotFound(err):
+			return nil, fmt.Errorf("%s changed: it does not exist, but the rebuild is %s", ref, digest)
+		case ctx.FailIfChanged:
+			return nil, fmt.Errorf("failed to check %s: %w", ref, err)
+		case err != nil && !isNotFound(err):
+			// Some registries refuse to HEAD tags that don't exist yet; pushing will tell
+			log.Printf("Could not check %s, pushing anyway: %v", ref, err)
+		}
+		stale = append(stale, ref)
+	}
+	return stale, nil
+}
+
+// CheckPublish makes the read-only checks publishing result to target would,
+// and returns the tags that would be pushed. For REMOTE targets, tags already
+// pointing at the result are left out, and immutable tags and FailIfChanged
+// are enforced as when publishing. Other targets always get every tag.
+func CheckPublish(ctx BuildContext, result *BuildResult, target BuildSpecTarget) ([]name.Tag, error) {
+	refs, err := target.Refs()
+	if err != nil || target.Type != REMOTE {
+		return refs, err
+	}
+	digest, err := v1.NewHash(result.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse digest: %w", err)
+	}
+	return staleRefs(ctx, refs, digest)
+}
+
+// isImmutable reports whether tag matches one of the immutable tag patterns.
+func isImmutable(patterns []string, tag string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, tag)
+		return ok
+	})
+}
+
+// publishIndex writes index to target. It reports false when every registry
+// tag already pointed at it, so nothing was written.
+func publishIndex(ctx BuildContext, index v1.ImageIndex, target BuildSpecTarget) (bool, error) {
+	refs, err := target.Refs()
+	if err != nil {
+		return false, err
+	}
+
+	switch target.Type {
+	case REMOTE:
+		log.Println("Publishing multi-platform index to remote...")
+
+		written, err := writeRemote(ctx, refs, index, func(ref name.Tag) error {
+			err := remote.WriteIndex(ref, index, remote.WithContext(ctx.Context),
+				remote.WithAuthFromKeychain(ctx.Keychain))
+			if err != nil {
+				return fmt.Errorf("failed to write index to remote: %w", err)
+			}
+			return nil
+		})
+		if err != nil || !written {
+			return written, err
+		}
+	case LOCAL_DAEMON:
+		selected, err := daemonImage(ctx, index, target)
+		if err != nil {
+			return false, err
+		}
+		// The daemon stores single images, so this publishes the platform image rather than the index
+		return publish(ctx, selected.image, target)
+	case LOCAL_FILE:
+		log.Printf("Publishing multi-platform images to local file %s...", target.OutputPath())
+		images, err := indexImages(index)
+		if err != nil {
+			return false, err
+		}
+		tagged := make(map[name.Tag]v1.Image, len(refs)*len(images))
+		var lines []string
+		for _, ref := range refs {
+			for _, pi := range images {
+				digest, err := pi.image.Digest()
+				if err != nil {
+					return false, fmt.Errorf("failed to retrieve image digest: %w", err)
+				}
+				platformRef := ref.Context().Tag(ref.TagStr() + "-" + platformTagSuffix(pi.platform))
+				tagged[platformRef] = pi.image
+				lines = append(lines, fmt.Sprintf("Tagged: %s@%s", platformRef, digest))
+			}
+		}
+		if err := tarball.MultiWriteToFile(target.OutputPath(), tagged); err != nil {
+			return false, fmt.Errorf("failed to write images to file: %w", err)
+		}
+		// The tarball holds the platform images but not the index, so there is no index digest to report
+		for _, line := range lines {
+			log.Print(line)
+		}
+		return true, nil
+	case OCI_LAYOUT:
+		log.Printf("Publishing multi-platform index to OCI layout %s...", target.OutputPath())
+		p, err := openLayout(target.OutputPath())
+		if err != nil {
+			return false, err
+		}
+		for _, ref := range refs {
+			tag := ref.TagStr()
+			err := p.ReplaceIndex(index, refNameMatcher(tag), layout.WithAnnotations(map[string]string{ociRefNameAnnotation: tag}))
+			if err != nil {
+				return false, fmt.Errorf("failed to write index to OCI layout %s: %w", target.OutputPath(), err)
+			}
+		}
+	default:
+		return false, fmt.Errorf("unknown target type: %d", target.Type)
 	}
 
 	digest, err := index.Digest()
 	if err != nil {
-		return fmt.Errorf("failed to retrieve index digest: %w", err)
+		return false, fmt.Errorf("failed to retrieve index digest: %w", err)
 	}
-	log.Printf("Pushed: %s", ref.Context().Digest(digest.String()))
+	logPushed(refs, digest)
 
-	return nil
+	return true, nil
+}
+
+// daemonImage selects the platform image of index that a LOCAL_DAEMON target loads.
+func daemonImage(ctx BuildContext, index v1.ImageIndex, target BuildSpecTarget) (platformImage, error) {
+	images, err := indexImages(index)
+	if err != nil {
+		return platformImage{}, err
+	}
+	var host Platform
+	if target.DaemonPlatform == nil {
+		d, err := connectDaemon(ctx)
+		if err != nil {
+			return platformImage{}, err
+		}
+		host = d.platform()
+		d.Close()
+	}
+	selected, err := selectDaemonPlatform(images, target.DaemonPlatform, host)
+	if err != nil {
+		return platformImage{}, err
+	}
+	log.Printf("Loading platform %s into local daemon...", selected.platform)
+	return selected, nil
+}
+
+type platformImage struct {
+	platform Platform
+	image    v1.Image
+}
+
+// indexImages returns the platform images of an index built by tko, in index order.
+func indexImages(index v1.ImageIndex) ([]platformImage, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index manifest: %w", err)
+	}
+	var images []platformImage
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image for platform %s: %w", desc.Platform, err)
+		}
+		images = append(images, platformImage{
+			platform: Platform{OS: desc.Platform.OS, Arch: desc.Platform.Architecture, Variant: desc.Platform.Variant},
+			image:    img,
+		})
+	}
+	return images, nil
+}
+
+// selectDaemonPlatform picks the image to load into the daemon: the chosen
+// platform, or else the one the daemon runs. A platform without a variant
+// matches any variant.
+func selectDaemonPlatform(images []platformImage, chosen *Platform, host Platform) (platformImage, error) {
+	want := host
+	if chosen != nil {
+		want = *chosen
+	}
+
+	var available []string
+	for _, pi := range images {
+		if pi.platform.OS == want.OS && pi.platform.Arch == want.Arch && (want.Variant == "" || pi.platform.Variant == want.Variant) {
+			return pi, nil
+		}
+		available = append(available, pi.platform.String())
+	}
+	if chosen != nil {
+		return platformImage{}, fmt.Errorf("platform %s was not built; available platforms: %s", want, strings.Join(available, ", "))
+	}
+	return platformImage{}, fmt.Errorf("no platform matches the daemon (%s); choose one of %s with --daemon-platform", want, strings.Join(available, ", "))
+}
+
+// platformTagSuffix renders a platform for use in a tag, e.g. linux-arm64.
+func platformTagSuffix(p Platform) string {
+	return strings.ReplaceAll(p.String(), "/", "-")
 }
 
-func publish(ctx BuildContext, image v1.Image, target BuildSpecTarget) error {
-	ref, err := name.NewTag(target.Repo)
+// publish writes image to target. It reports false when every registry tag
+// already pointed at it, so nothing was written.
+func publish(ctx BuildContext, image v1.Image, target BuildSpecTarget) (bool, error) {
+	refs, err := target.Refs()
 	if err != nil {
-		return fmt.Errorf("failed to parse target repo: %w", err)
+		return false, err
 	}
 
 	switch target.Type {
 	case REMOTE:
 		log.Println("Publishing to remote...")
 
-		err := remote.Write(ref, image, remote.WithContext(ctx.Context),
-			remote.WithAuthFromKeychain(ctx.Keychain))
-		if err != nil {
-			return fmt.Errorf("failed to write image to remote: %w", err)
+		written, err := writeRemote(ctx, refs, image, func(ref name.Tag) error {
+			err := remote.Write(ref, image, remote.WithContext(ctx.Context),
+				remote.WithAuthFromKeychain(ctx.Keychain))
+			if err != nil {
+				return fmt.Errorf("failed to write image to remote: %w", err)
+			}
+			return nil
+		})
+		if err != nil || !written {
+			return written, err
 		}
 	case LOCAL_DAEMON:
-		log.Println("Publishing to local daemon...")
-		_, err := daemon.Write(ref, image, daemon.WithContext(ctx.Context))
+		d, err := connectDaemon(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer d.Close()
+
+		log.Printf("Publishing to local daemon: %s", d)
+		_, err = daemon.Write(refs[0], image, d.options(ctx)...)
 		if err != nil {
-			return fmt.Errorf("failed to write image to daemon: %w", err)
+			return false, fmt.Errorf("failed to write image to %s: %w", d, err)
+		}
+		for _, ref := range refs[1:] {
+			if err := daemon.Tag(refs[0], ref, d.options(ctx)...); err != nil {
+				return false, fmt.Errorf("failed to tag %s: %w", ref, err)
+			}
 		}
 	case LOCAL_FILE:
-		log.Println("Publishing to local file...")
-		err := tarball.WriteToFile("out.tar", ref, image)
+		log.Printf("Publishing to local file %s...", target.OutputPath())
+		tagged := make(map[name.Tag]v1.Image, len(refs))
+		for _, ref := range refs {
+			tagged[ref] = image
+		}
+		err := tarball.MultiWriteToFile(target.OutputPath(), tagged)
 		if err != nil {
-			return fmt.Errorf("failed to write image to file: %w", err)
+			return false, fmt.Errorf("failed to write image to file: %w", err)
+		}
+	case OCI_LAYOUT:
+		log.Printf("Publishing to OCI layout %s...", target.OutputPath())
+		if err := writeLayout(target.OutputPath(), image, refs); err != nil {
+			return false, err
 		}
 	default:
-		return fmt.Errorf("unknown target type: %d", target.Type)
+		return false, fmt.Errorf("unknown target type: %d", target.Type)
 	}
 
 	digest, err := image.Digest()
 	if err != nil {
-		return fmt.Errorf("failed to retrieve new image digest: %w", err)
+		return false, fmt.Errorf("failed to retrieve new image digest: %w", err)
 	}
-	log.Printf("Pushed: %s", ref.Context().Digest(digest.String()))
+	logPushed(refs, digest)
 
-	return nil
+	return true, nil
+}
+
+func logPushed(refs []name.Tag, digest v1.Hash) {
+	log.Printf("Pushed: %s", refs[0].Context().Digest(digest.String()))
+	if len(refs) > 1 {
+		for _, ref := range refs {
+			log.Printf("Tagged: %s", ref)
+		}
+	}
 }
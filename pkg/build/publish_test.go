@@ -0,0 +1,493 @@
+package build
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestTargetRefs(t *testing.T) {
+	cases := []struct {
+		target BuildSpecTarget
+		want   []string
+	}{
+		{BuildSpecTarget{Repo: "example.com/app"}, []string{"example.com/app:latest"}},
+		{BuildSpecTarget{Repo: "example.com/app:v1"}, []string{"example.com/app:v1"}},
+		{BuildSpecTarget{Repo: "example.com/app", Tags: []string{"main", "sha-abc"}}, []string{"example.com/app:main", "example.com/app:sha-abc"}},
+		{BuildSpecTarget{Repo: "example.com/app:v1", Tags: []string{"main", "v1"}}, []string{"example.com/app:v1", "example.com/app:main"}},
+	}
+	for _, c := range cases {
+		refs, err := c.target.Refs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range refs {
+			got = append(got, r.Name())
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Fatalf("%+v: got %v, want %v", c.target, got, c.want)
+		}
+	}
+
+	if _, err := (BuildSpecTarget{Repo: "example.com/app", Tags: []string{"not/valid"}}).Refs(); err == nil {
+		t.Fatal("expected invalid tag to fail")
+	}
+}
+
+func TestPublishMultipleTagsUploadsOnce(t *testing.T) {
+	var blobUploads atomic.Int32
+	reg := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			blobUploads.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app", Type: REMOTE, Tags: []string{"main", "sha-abc123", "1.4.2"}}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	// One layer and one config
+	if n := blobUploads.Load(); n != 2 {
+		t.Fatalf("expected 2 blob uploads, got %d", n)
+	}
+
+	var digests []string
+	for _, tag := range spec.Target.Tags {
+		desc, err := remote.Head(mustParseRef(t, host+"/app:"+tag))
+		if err != nil {
+			t.Fatalf("tag %s was not pushed: %v", tag, err)
+		}
+		digests = append(digests, desc.Digest.String())
+	}
+	if digests[0] != digests[1] || digests[1] != digests[2] {
+		t.Fatalf("tags point at different digests: %v", digests)
+	}
+	if _, err := remote.Head(mustParseRef(t, host+"/app:latest")); err == nil {
+		t.Fatal("latest should not be pushed when tags are given")
+	}
+}
+
+func TestPublishLocalFileOutput(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	output := filepath.Join(t.TempDir(), "image.tar")
+	spec.Target = BuildSpecTarget{Repo: "example.com/app", Type: LOCAL_FILE, Tags: []string{"1.4.2", "main"}, Output: output}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	for _, tag := range []string{"1.4.2", "main"} {
+		ref, err := name.NewTag("example.com/app:" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarball.ImageFromPath(output, &ref); err != nil {
+			t.Fatalf("tag %s not found in %s: %v", tag, output, err)
+		}
+	}
+}
+
+func TestPublishOCILayout(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	output := filepath.Join(t.TempDir(), "layout")
+
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "v1"}))
+	spec.Target = BuildSpecTarget{Repo: "example.com/app", Type: OCI_LAYOUT, Tags: []string{"1.0.0", "stable"}, Output: output}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	// A second build adds a tag and moves stable, leaving 1.0.0 alone
+	spec.InjectLayer.SourcePath = createTestSourceDir(t, map[string]string{"mybin": "v2"})
+	spec.Target.Tags = []string{"1.1.0", "stable"}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("second build failed: %v", err)
+	}
+
+	index, err := layout.ImageIndexFromPath(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests := map[string]v1.Hash{}
+	for _, desc := range manifest.Manifests {
+		tag := desc.Annotations[ociRefNameAnnotation]
+		if _, ok := digests[tag]; ok {
+			t.Fatalf("tag %s appears twice in index.json", tag)
+		}
+		digests[tag] = desc.Digest
+	}
+	if len(digests) != 3 {
+		t.Fatalf("expected tags 1.0.0, 1.1.0 and stable, got %v", digests)
+	}
+	if digests["1.0.0"] == digests["1.1.0"] || digests["stable"] != digests["1.1.0"] {
+		t.Fatalf("unexpected tag digests: %v", digests)
+	}
+
+	// The layout is readable as a base image by tag
+	src, err := resolveOCILayoutBase(output + ":1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := src.image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != digests["1.0.0"] {
+		t.Fatalf("expected %s, got %s", digests["1.0.0"], digest)
+	}
+}
+
+func newMultiPlatformTestSpec(t *testing.T, target BuildSpecTarget) MultiPlatformBuildSpec {
+	t.Helper()
+	return MultiPlatformBuildSpec{
+		BaseRef: "scratch",
+		Platforms: []PlatformSpec{
+			{Platform: Platform{OS: "linux", Arch: "amd64"}},
+			{Platform: Platform{OS: "linux", Arch: "arm64"}},
+		},
+		SourceRoot: createTestSourceDir(t, map[string]string{
+			"linux/amd64/app": "amd64 binary",
+			"linux/arm64/app": "arm64 binary",
+		}),
+		DestinationPath:  "/app",
+		DestinationChown: true,
+		Entrypoint:       "/app/app",
+		Author:           "tko-test",
+		Target:           target,
+	}
+}
+
+func TestPublishIndexOCILayout(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	output := filepath.Join(t.TempDir(), "layout")
+	spec := newMultiPlatformTestSpec(t, BuildSpecTarget{Repo: "example.com/app:1.0.0", Type: OCI_LAYOUT, Output: output})
+	if _, err := BuildMultiPlatform(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	src, err := resolveOCILayoutBase(output + ":1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.index == nil {
+		t.Fatal("expected the tag to point at an index")
+	}
+	images, err := indexImages(src.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].platform.Arch != "amd64" || images[1].platform.Arch != "arm64" {
+		t.Fatalf("unexpected platforms in layout: %v", images)
+	}
+}
+
+func TestPublishIndexLocalFile(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	output := filepath.Join(t.TempDir(), "images.tar")
+	spec := newMultiPlatformTestSpec(t, BuildSpecTarget{Repo: "example.com/app:1.0.0", Type: LOCAL_FILE, Output: output})
+	if _, err := BuildMultiPlatform(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		ref, err := name.NewTag("example.com/app:1.0.0-linux-" + arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := tarball.ImageFromPath(output, &ref)
+		if err != nil {
+			t.Fatalf("%s not found in %s: %v", ref, output, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Architecture != arch {
+			t.Fatalf("%s has architecture %s", ref, cfg.Architecture)
+		}
+	}
+}
+
+func TestSelectDaemonPlatform(t *testing.T) {
+	images := []platformImage{
+		{platform: Platform{OS: "linux", Arch: "amd64"}},
+		{platform: Platform{OS: "linux", Arch: "arm", Variant: "v7"}},
+		{platform: Platform{OS: "linux", Arch: "arm64"}},
+	}
+
+	host := Platform{OS: "linux", Arch: "arm64"}
+	selected, err := selectDaemonPlatform(images, &Platform{OS: "linux", Arch: "arm"}, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selected.platform.Variant != "v7" {
+		t.Fatalf("expected linux/arm/v7, got %s", selected.platform)
+	}
+
+	if _, err := selectDaemonPlatform(images, &Platform{OS: "linux", Arch: "s390x"}, host); err == nil {
+		t.Fatal("expected a platform that wasn't built to fail")
+	}
+
+	selected, err = selectDaemonPlatform(images, nil, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selected.platform != host {
+		t.Fatalf("expected the daemon's platform, got %s", selected.platform)
+	}
+
+	if _, err := selectDaemonPlatform(images, nil, Platform{OS: "linux", Arch: "riscv64"}); err == nil {
+		t.Fatal("expected a daemon platform that wasn't built to fail")
+	}
+}
+
+func TestPublishMultipleTargets(t *testing.T) {
+	host := newTestRegistry(t)
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer denied.Close()
+	deniedHost := strings.TrimPrefix(denied.URL, "http://")
+
+	ctx := newTestBuildContext(t)
+	output := filepath.Join(t.TempDir(), "app.tar")
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app:1.0.0", Type: REMOTE}
+	spec.Targets = []BuildSpecTarget{
+		{Repo: host + "/mirror:1.0.0", Type: REMOTE},
+		{Repo: "example.com/app:1.0.0", Type: LOCAL_FILE, Output: output},
+		{Repo: deniedHost + "/app:1.0.0", Type: REMOTE},
+	}
+
+	_, err := Build(ctx, spec)
+	if err == nil || !strings.Contains(err.Error(), "failed to publish to 1 of 4 targets") || !strings.Contains(err.Error(), deniedHost) {
+		t.Fatalf("expected the denied target to fail the build, got %v", err)
+	}
+
+	// Targets that could be published were, and with the same image
+	app, err := remote.Head(mustParseRef(t, host+"/app:1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := remote.Head(mustParseRef(t, host+"/mirror:1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.NewTag("example.com/app:1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := tarball.ImageFromPath(output, &ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Digest != mirror.Digest || app.Digest != local {
+		t.Fatalf("targets received different images: %s, %s, %s", app.Digest, mirror.Digest, local)
+	}
+
+	spec.AllowPartialFailure = true
+	result, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("expected partial failure to be tolerated, got %v", err)
+	}
+	for i, target := range result.Targets {
+		if (target.Error != "") != (i == 3) {
+			t.Fatalf("unexpected outcome for target %d: %+v", i, target)
+		}
+	}
+	if len(result.References) != 3 {
+		t.Fatalf("expected references for the 3 published targets, got %v", result.References)
+	}
+
+	spec.Target = spec.Targets[2]
+	spec.Targets = nil
+	if _, err := Build(ctx, spec); err == nil {
+		t.Fatal("expected a build with no published target to fail")
+	}
+}
+
+func TestPublishSkipsUpToDateTags(t *testing.T) {
+	var manifestPuts atomic.Int32
+	reg := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+			manifestPuts.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app", Type: REMOTE, Tags: []string{"1.0.0", "main"}}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if n := manifestPuts.Load(); n != 2 {
+		t.Fatalf("expected 2 manifest uploads, got %d", n)
+	}
+
+	// Rebuilding pushes nothing, and only the new tag once one is added
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if n := manifestPuts.Load(); n != 2 {
+		t.Fatalf("expected an up to date rebuild to push nothing, got %d manifest uploads", n)
+	}
+	spec.Target.Tags = append(spec.Target.Tags, "stable")
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if n := manifestPuts.Load(); n != 3 {
+		t.Fatalf("expected only the new tag to be pushed, got %d manifest uploads", n)
+	}
+}
+
+func TestPublishFailIfChanged(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "v1"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app:1.0.0", Type: REMOTE}
+
+	ctx.FailIfChanged = true
+	if _, err := Build(ctx, spec); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected a missing tag to fail, got %v", err)
+	}
+
+	ctx.FailIfChanged = false
+	published, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	ctx.FailIfChanged = true
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("expected a reproduced image to pass, got %v", err)
+	}
+
+	spec.InjectLayer.SourcePath = createTestSourceDir(t, map[string]string{"mybin": "v2"})
+	_, err = Build(ctx, spec)
+	if err == nil || !strings.Contains(err.Error(), published.Digest) {
+		t.Fatalf("expected a changed image to fail naming %s, got %v", published.Digest, err)
+	}
+	desc, err := remote.Head(mustParseRef(t, host+"/app:1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest.String() != published.Digest {
+		t.Fatal("a changed image was pushed")
+	}
+}
+
+func TestCheckPublish(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	ctx.ImmutableTags = []string{"1.*"}
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "v1"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app", Type: REMOTE, Tags: []string{"1.0.0", "latest"}}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	spec.InjectLayer.SourcePath = createTestSourceDir(t, map[string]string{"mybin": "v2"})
+	changed, err := BuildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if _, err := CheckPublish(ctx, changed, spec.Target); err == nil || !strings.Contains(err.Error(), "immutable tag") {
+		t.Fatalf("expected the immutable tag to be refused, got %v", err)
+	}
+
+	spec.Target.Tags = []string{"1.0.1", "latest"}
+	refs, err := CheckPublish(ctx, changed, spec.Target)
+	if err != nil {
+		t.Fatalf("CheckPublish: %v", err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("expected both tags to be pushed, got %v", refs)
+	}
+
+	ctx.FailIfChanged = true
+	if _, err := CheckPublish(ctx, changed, spec.Target); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("expected --fail-if-changed to fail, got %v", err)
+	}
+	desc, err := remote.Head(mustParseRef(t, host+"/app:latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest.String() == changed.Digest {
+		t.Fatal("CheckPublish pushed a tag")
+	}
+}
+
+func TestPublishImmutableTags(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	ctx.ImmutableTags = []string{"[0-9]*.[0-9]*.[0-9]*"}
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "v1"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app", Type: REMOTE, Tags: []string{"1.4.2", "latest"}}
+
+	published, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	// An identical rebuild is a no-op
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("expected an identical rebuild to pass, got %v", err)
+	}
+
+	spec.InjectLayer.SourcePath = createTestSourceDir(t, map[string]string{"mybin": "v2"})
+	_, err = Build(ctx, spec)
+	if err == nil || !strings.Contains(err.Error(), "immutable tag") || !strings.Contains(err.Error(), published.Digest) {
+		t.Fatalf("expected overwriting 1.4.2 to fail naming %s, got %v", published.Digest, err)
+	}
+	for _, tag := range []string{"1.4.2", "latest"} {
+		desc, err := remote.Head(mustParseRef(t, host+"/app:"+tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.Digest.String() != published.Digest {
+			t.Fatalf("%s was moved despite the refusal", tag)
+		}
+	}
+
+	// Mutable tags still move
+	spec.Target.Tags = []string{"1.4.3", "latest"}
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	desc, err := remote.Head(mustParseRef(t, host+"/app:latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest.String() == published.Digest {
+		t.Fatal("latest did not move")
+	}
+}
@@ -0,0 +1,279 @@
+package build
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// RebaseSpec describes swapping the base image under a published image.
+type RebaseSpec struct {
+	// Image is the published image or index to rebase.
+	Image string
+	// NewBase is the base image reference to rebase onto.
+	NewBase string
+	// Target is where the rebased image is pushed.
+	Target BuildSpecTarget
+}
+
+// Rebase replaces the base layers of a tko-built image, or of every platform
+// image in an index, with those of NewBase. The old base is found through the
+// base image labels and must match the image's bottom layers exactly. Nothing
+// is pushed when every platform is already on NewBase.
+func Rebase(ctx BuildContext, spec RebaseSpec) error {
+	if spec.Target.Type != REMOTE {
+		return fmt.Errorf("rebase only supports REMOTE targets")
+	}
+
+	ref, err := name.ParseReference(spec.Image)
+	if err != nil {
+		return fmt.Errorf("failed to parse image reference: %w", err)
+	}
+	desc, err := remote.Get(ref, remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve image %s: %w", spec.Image, err)
+	}
+
+	switch {
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		rebased, changed, err := rebaseImage(ctx, img, spec.NewBase)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			log.Printf("%s is already on %s; nothing to push", spec.Image, spec.NewBase)
+			return nil
+		}
+		_, err = publish(ctx, rebased, spec.Target)
+		return err
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		rebased, changed, err := rebaseIndex(ctx, index, spec.NewBase)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			log.Printf("%s is already on %s; nothing to push", spec.Image, spec.NewBase)
+			return nil
+		}
+		_, err = publishIndex(ctx, rebased, spec.Target)
+		return err
+	}
+	return fmt.Errorf("unsupported media type: %s", desc.MediaType)
+}
+
+// rebaseIndex rebases every platform image of index. It reports false, returning
+// index as is, when all of them were already on newBase.
+func rebaseIndex(ctx BuildContext, index v1.ImageIndex, newBase string) (v1.ImageIndex, bool, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var addenda []mutate.IndexAddendum
+	changed := false
+	for _, m := range manifest.Manifests {
+		if m.Platform == nil || m.Platform.OS == "unknown" || !m.MediaType.IsImage() {
+			// Attestations describe the image as it was, so they don't carry over
+			log.Printf("Dropping %s, which is not a platform image", m.Digest)
+			continue
+		}
+		log.Printf("Rebasing platform %s...", m.Platform)
+
+		img, err := index.Image(m.Digest)
+		if err != nil {
+			return nil, false, err
+		}
+		rebased, platformChanged, err := rebaseImage(ctx, img, newBase)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to rebase platform %s: %w", m.Platform, err)
+		}
+		changed = changed || platformChanged
+		addenda = append(addenda, mutate.IndexAddendum{
+			Add: rebased,
+			Descriptor: v1.Descriptor{
+				Platform:    m.Platform,
+				Annotations: m.Annotations,
+			},
+		})
+	}
+
+	if !changed {
+		return index, false, nil
+	}
+
+	rebased := mutate.IndexMediaType(mutate.AppendManifests(empty.Index, addenda...), manifest.MediaType)
+	if len(manifest.Annotations) > 0 {
+		rebased = mutate.Annotations(rebased, manifest.Annotations).(v1.ImageIndex)
+	}
+	return rebased, true, nil
+}
+
+// rebaseImage moves the layers tko added on top of img's old base onto newBase,
+// keeping img's config and updating what came from the base. It reports false,
+// returning img as is, when img is already on newBase.
+func rebaseImage(ctx BuildContext, img v1.Image, newBaseRef string) (v1.Image, bool, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read image config: %w", err)
+	}
+	platform := Platform{OS: cfg.OS, Arch: cfg.Architecture, Variant: cfg.Variant}
+
+	oldBase, err := labeledBaseImage(ctx, cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	oldCfg, err := oldBase.ConfigFile()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read old base image config: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, false, err
+	}
+	oldLayers, err := oldBase.Layers()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := verifyBaseLayers(layers, oldLayers); err != nil {
+		return nil, false, fmt.Errorf("refusing to rebase: %w", err)
+	}
+
+	scratchFormat := FORMAT_DOCKER
+	if mt, err := img.MediaType(); err == nil && mt == types.OCIManifestSchema1 {
+		scratchFormat = FORMAT_OCI
+	}
+	newBase, metadata, err := getBaseImage(ctx, newBaseRef, platform, scratchFormat, ctx.Keychain)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve new base image: %w", err)
+	}
+	if metadata.imageDigest == cfg.Config.Labels[baseDigestLabel] {
+		log.Printf("Platform %s is already on %s", platform, metadata.imageDigest)
+		return img, false, nil
+	}
+
+	mediaType, err := getMediaType(newBase)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get media type: %w", err)
+	}
+	var addenda []mutate.Addendum
+	for _, l := range layers[len(oldLayers):] {
+		addenda = append(addenda, mutate.Addendum{Layer: l, MediaType: mediaType})
+	}
+	rebased, err := mutate.Append(newBase, addenda...)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to append layers to new base image: %w", err)
+	}
+
+	rebasedCfg, err := rebased.ConfigFile()
+	if err != nil {
+		return nil, false, err
+	}
+	newCfg, err := newBase.ConfigFile()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read new base image config: %w", err)
+	}
+	rebasedCfg = rebasedCfg.DeepCopy()
+
+	if rebasedCfg.OS == "" {
+		rebasedCfg.OS, rebasedCfg.Architecture, rebasedCfg.Variant = platform.OS, platform.Arch, platform.Variant
+	}
+	rebasedCfg.Author = cfg.Author
+	rebasedCfg.Created = cfg.Created
+	rebasedCfg.Container = cfg.Container
+	rebasedCfg.DockerVersion = cfg.DockerVersion
+	rebasedCfg.Config = *cfg.Config.DeepCopy()
+	rebasedCfg.Config.Env = rebaseEnv(cfg.Config.Env, oldCfg.Config.Env, newCfg.Config.Env)
+	rebasedCfg.Config.Labels[baseNameLabel] = metadata.name
+	rebasedCfg.Config.Labels[baseDigestLabel] = metadata.imageDigest
+	if metadata.name == "" {
+		delete(rebasedCfg.Config.Labels, baseNameLabel)
+	}
+	if metadata.imageDigest == "" {
+		delete(rebasedCfg.Config.Labels, baseDigestLabel)
+	}
+	if len(cfg.History) >= len(oldCfg.History) {
+		rebasedCfg.History = append(slices.Clone(newCfg.History), cfg.History[len(oldCfg.History):]...)
+	}
+
+	rebased, err = mutate.ConfigFile(rebased, rebasedCfg)
+	if err != nil {
+		return nil, false, err
+	}
+	return rebased, true, nil
+}
+
+// labeledBaseImage fetches the base image recorded in cfg's labels.
+func labeledBaseImage(ctx BuildContext, cfg *v1.ConfigFile) (v1.Image, error) {
+	baseName := cfg.Config.Labels[baseNameLabel]
+	baseDigest := cfg.Config.Labels[baseDigestLabel]
+	if baseName == "scratch" {
+		return empty.Image, nil
+	}
+	if baseName == "" || baseDigest == "" {
+		return nil, fmt.Errorf("image has no base image labels; was it built by tko?")
+	}
+	if !isLockable(baseName) {
+		return nil, fmt.Errorf("base image %s does not come from a registry", baseName)
+	}
+
+	repo, err := name.NewRepository(baseName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse base image name label: %w", err)
+	}
+	desc, err := remoteGet(ctx, repo.Digest(baseDigest), ctx.Keychain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve old base image %s@%s: %w", baseName, baseDigest, err)
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read old base image %s@%s: %w", baseName, baseDigest, err)
+	}
+	return img, nil
+}
+
+// verifyBaseLayers checks that the image's bottom layers are exactly the old base's.
+func verifyBaseLayers(layers, baseLayers []v1.Layer) error {
+	if len(baseLayers) > len(layers) {
+		return fmt.Errorf("image has %d layers, fewer than the %d of its old base", len(layers), len(baseLayers))
+	}
+	for i, l := range baseLayers {
+		want, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		got, err := layers[i].Digest()
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("layer %d is %s, but the old base has %s", i, got, want)
+		}
+	}
+	return nil
+}
+
+// rebaseEnv swaps the old base's environment for the new base's, keeping
+// the variables the build appended after it.
+func rebaseEnv(env, oldEnv, newEnv []string) []string {
+	if len(env) < len(oldEnv) || !slices.Equal(env[:len(oldEnv)], oldEnv) {
+		log.Println("WARNING: image environment does not start with the old base's; keeping it unchanged")
+		return env
+	}
+	return append(slices.Clone(newEnv), env[len(oldEnv):]...)
+}
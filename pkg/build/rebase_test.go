@@ -0,0 +1,206 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+var rebasePlatforms = []Platform{{OS: "linux", Arch: "amd64"}, {OS: "linux", Arch: "arm64"}}
+
+// pushLayeredBase pushes a two-platform base whose layer and PATH depend on version.
+func pushLayeredBase(t *testing.T, ref, version string) v1.ImageIndex {
+	t.Helper()
+	var addenda []mutate.IndexAddendum
+	for _, p := range rebasePlatforms {
+		img := imageWithFiles(t, map[string]string{"etc/version": version + " " + p.String()}, nil)
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg = cfg.DeepCopy()
+		cfg.OS, cfg.Architecture = p.OS, p.Arch
+		cfg.Config.Env = []string{"PATH=/" + version}
+		img, err = mutate.ConfigFile(img, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addenda = append(addenda, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: p.ToV1Platform()}})
+	}
+	idx := mutate.AppendManifests(empty.Index, addenda...)
+
+	tag, err := name.NewTag(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func buildRebaseTestApp(t *testing.T, ctx BuildContext, baseRef, target string) {
+	t.Helper()
+	srcDir := createTestSourceDir(t, map[string]string{
+		"linux/amd64/app": "amd64 binary",
+		"linux/arm64/app": "arm64 binary",
+	})
+	var platforms []PlatformSpec
+	for _, p := range rebasePlatforms {
+		platforms = append(platforms, PlatformSpec{Platform: p})
+	}
+	_, err := BuildMultiPlatform(ctx, MultiPlatformBuildSpec{
+		BaseRef:          baseRef,
+		Platforms:        platforms,
+		SourceRoot:       srcDir,
+		DestinationPath:  "/app",
+		DestinationChown: true,
+		Entrypoint:       "/app/app",
+		Env:              map[string]string{"APP": "1"},
+		Author:           "tko-test",
+		Target:           BuildSpecTarget{Repo: target, Type: REMOTE},
+	})
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+}
+
+func mustParseRef(t *testing.T, ref string) name.Reference {
+	t.Helper()
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRebaseIndex(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	pushLayeredBase(t, host+"/base:1", "v1")
+	buildRebaseTestApp(t, ctx, host+"/base:1", host+"/app:latest")
+
+	newBase := pushLayeredBase(t, host+"/base:2", "v2")
+	err := Rebase(ctx, RebaseSpec{
+		Image:   host + "/app:latest",
+		NewBase: host + "/base:2",
+		Target:  BuildSpecTarget{Repo: host + "/app:rebased", Type: REMOTE},
+	})
+	if err != nil {
+		t.Fatalf("rebase failed: %v", err)
+	}
+
+	// Building on the new base directly must give the same image
+	buildRebaseTestApp(t, ctx, host+"/base:2", host+"/app:rebuilt")
+	rebased, err := remote.Head(mustParseRef(t, host+"/app:rebased"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := remote.Head(mustParseRef(t, host+"/app:rebuilt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebased.Digest != rebuilt.Digest {
+		t.Fatalf("rebased index %s differs from a fresh build %s", rebased.Digest, rebuilt.Digest)
+	}
+
+	current, err := PublishedBaseDigests(ctx, host+"/app:rebased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range rebasePlatforms {
+		want, err := getDigestForPlatform(newBase, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Platforms[p] != want.String() {
+			t.Fatalf("platform %s base digest %s, want %s", p, current.Platforms[p], want)
+		}
+	}
+}
+
+func TestRebaseAlreadyOnBase(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	pushLayeredBase(t, host+"/base:1", "v1")
+	buildRebaseTestApp(t, ctx, host+"/base:1", host+"/app:latest")
+
+	err := Rebase(ctx, RebaseSpec{
+		Image:   host + "/app:latest",
+		NewBase: host + "/base:1",
+		Target:  BuildSpecTarget{Repo: host + "/app:rebased", Type: REMOTE},
+	})
+	if err != nil {
+		t.Fatalf("rebase failed: %v", err)
+	}
+	if _, err := remote.Head(mustParseRef(t, host+"/app:rebased")); !isNotFound(err) {
+		t.Fatalf("expected nothing to be pushed for an image already on its base, got %v", err)
+	}
+}
+
+func TestRebaseRefusesMismatchedBase(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	pushLayeredBase(t, host+"/base:1", "v1")
+	buildRebaseTestApp(t, ctx, host+"/base:1", host+"/app:latest")
+
+	// Make the recorded old base disagree with the image's layers
+	pushLayeredBase(t, host+"/other:1", "other")
+	desc, err := remote.Get(mustParseRef(t, host+"/app:latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := getImageForPlatform(index, rebasePlatforms[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := remote.Index(mustParseRef(t, host+"/other:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := getDigestForPlatform(other, rebasePlatforms[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Config.Labels[baseNameLabel] = host + "/other"
+	cfg.Config.Labels[baseDigestLabel] = otherDigest.String()
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(mustParseRef(t, host+"/app:tampered"), img); err != nil {
+		t.Fatal(err)
+	}
+
+	pushLayeredBase(t, host+"/base:2", "v2")
+	err = Rebase(ctx, RebaseSpec{
+		Image:   host + "/app:tampered",
+		NewBase: host + "/base:2",
+		Target:  BuildSpecTarget{Repo: host + "/app:tampered", Type: REMOTE},
+	})
+	if err == nil || !strings.Contains(err.Error(), "refusing to rebase") {
+		t.Fatalf("expected mismatched base to be refused, got %v", err)
+	}
+}
+
+func TestRebaseEnv(t *testing.T) {
+	got := rebaseEnv([]string{"PATH=/v1", "APP=1"}, []string{"PATH=/v1"}, []string{"PATH=/v2", "LANG=C"})
+	want := []string{"PATH=/v2", "LANG=C", "APP=1"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
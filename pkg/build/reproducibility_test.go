@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 func newTestBuildContext(t *testing.T) BuildContext {
@@ -64,11 +65,11 @@ func TestReproducibleBuild_SameInputsSameDigest(t *testing.T) {
 	})
 	spec := newScratchBuildSpec(srcDir)
 
-	img1, err := buildImage(ctx, spec)
+	img1, _, err := buildImage(ctx, spec)
 	if err != nil {
 		t.Fatalf("first build failed: %v", err)
 	}
-	img2, err := buildImage(ctx, spec)
+	img2, _, err := buildImage(ctx, spec)
 	if err != nil {
 		t.Fatalf("second build failed: %v", err)
 	}
@@ -167,7 +168,7 @@ func TestReproducibleBuild_ImageConfig(t *testing.T) {
 	})
 	spec := newScratchBuildSpec(srcDir)
 
-	img, err := buildImage(ctx, spec)
+	img, _, err := buildImage(ctx, spec)
 	if err != nil {
 		t.Fatalf("build failed: %v", err)
 	}
@@ -212,7 +213,7 @@ func TestReproducibleBuild_HistoryTimestamps(t *testing.T) {
 	})
 	spec := newScratchBuildSpec(srcDir)
 
-	img, err := buildImage(ctx, spec)
+	img, _, err := buildImage(ctx, spec)
 	if err != nil {
 		t.Fatalf("build failed: %v", err)
 	}
@@ -244,11 +245,11 @@ func TestReproducibleBuild_DifferentInputsDifferentDigest(t *testing.T) {
 	spec1 := newScratchBuildSpec(srcDir1)
 	spec2 := newScratchBuildSpec(srcDir2)
 
-	img1, err := buildImage(ctx, spec1)
+	img1, _, err := buildImage(ctx, spec1)
 	if err != nil {
 		t.Fatalf("build 1 failed: %v", err)
 	}
-	img2, err := buildImage(ctx, spec2)
+	img2, _, err := buildImage(ctx, spec2)
 	if err != nil {
 		t.Fatalf("build 2 failed: %v", err)
 	}
@@ -289,7 +290,7 @@ func TestReproducibleBuild_WithAnnotationsAndEnv(t *testing.T) {
 	// Build multiple times to catch non-deterministic map iteration
 	var firstDigest string
 	for i := range 5 {
-		img, err := buildImage(ctx, spec)
+		img, _, err := buildImage(ctx, spec)
 		if err != nil {
 			t.Fatalf("build %d failed: %v", i, err)
 		}
@@ -315,11 +316,11 @@ func TestReproducibleBuild_MultipleFilesAndDirs(t *testing.T) {
 	})
 	spec := newScratchBuildSpec(srcDir)
 
-	img1, err := buildImage(ctx, spec)
+	img1, _, err := buildImage(ctx, spec)
 	if err != nil {
 		t.Fatalf("first build failed: %v", err)
 	}
-	img2, err := buildImage(ctx, spec)
+	img2, _, err := buildImage(ctx, spec)
 	if err != nil {
 		t.Fatalf("second build failed: %v", err)
 	}
@@ -345,3 +346,47 @@ func TestReproducibleBuild_MultipleFilesAndDirs(t *testing.T) {
 		t.Fatalf("expected 1 layer, got %d", len(layers))
 	}
 }
+
+func TestScratchBuild_PlatformInConfig(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	srcDir := createTestSourceDir(t, map[string]string{"mybin": "binary"})
+	spec := newScratchBuildSpec(srcDir)
+	spec.InjectLayer.Platform = Platform{OS: "linux", Arch: "arm", Variant: "v7"}
+
+	img, _, err := buildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatalf("failed to get config: %v", err)
+	}
+	if cfg.OS != "linux" || cfg.Architecture != "arm" || cfg.Variant != "v7" {
+		t.Fatalf("config platform = %s/%s/%s, want linux/arm/v7", cfg.OS, cfg.Architecture, cfg.Variant)
+	}
+}
+
+func TestScratchBuild_OCIFormat(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	srcDir := createTestSourceDir(t, map[string]string{"mybin": "binary"})
+	spec := newScratchBuildSpec(srcDir)
+	spec.ScratchFormat = FORMAT_OCI
+
+	img, _, err := buildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("failed to get manifest: %v", err)
+	}
+	if manifest.MediaType != types.OCIManifestSchema1 {
+		t.Fatalf("manifest media type = %s, want %s", manifest.MediaType, types.OCIManifestSchema1)
+	}
+	if manifest.Config.MediaType != types.OCIConfigJSON {
+		t.Fatalf("config media type = %s, want %s", manifest.Config.MediaType, types.OCIConfigJSON)
+	}
+	if manifest.Layers[0].MediaType != types.OCILayer {
+		t.Fatalf("layer media type = %s, want %s", manifest.Layers[0].MediaType, types.OCILayer)
+	}
+}
@@ -0,0 +1,174 @@
+package build
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// BuildResult describes a built image or index and where it was published.
+type BuildResult struct {
+	// Image is set for single-platform builds, Index for multi-platform ones.
+	Image v1.Image      `json:"-"`
+	Index v1.ImageIndex `json:"-"`
+	// Descriptor describes Image or Index.
+	Descriptor v1.Descriptor `json:"-"`
+
+	// Digest is the digest of the image, or of the index for multi-platform builds.
+	Digest    string          `json:"digest"`
+	MediaType types.MediaType `json:"mediaType"`
+	// References lists every tag published, across all targets.
+	References  []string          `json:"references"`
+	Targets     []TargetResult    `json:"targets"`
+	Platforms   []PlatformResult  `json:"platforms"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type TargetResult struct {
+	Type   string   `json:"type"`
+	Repo   string   `json:"repo"`
+	Output string   `json:"output,omitempty"`
+	Tags   []string `json:"tags"`
+	// Error is set when publishing to the target failed.
+	Error string `json:"error,omitempty"`
+}
+
+type PlatformResult struct {
+	Image      v1.Image      `json:"-"`
+	Descriptor v1.Descriptor `json:"-"`
+	// Attachments are published alongside the image by every target.
+	Attachments []Attachment `json:"-"`
+
+	Platform string        `json:"platform"`
+	Digest   string        `json:"digest"`
+	Base     BaseResult    `json:"base"`
+	Layers   []LayerResult `json:"layers"`
+}
+
+type BaseResult struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"`
+}
+
+type LayerResult struct {
+	Digest    string          `json:"digest"`
+	Size      int64           `json:"size"`
+	MediaType types.MediaType `json:"mediaType"`
+}
+
+// Pinned returns the first published repository pinned to the result's digest.
+func (r *BuildResult) Pinned() string {
+	for _, target := range r.Targets {
+		if target.Error == "" {
+			return target.Repo + "@" + r.Digest
+		}
+	}
+	return ""
+}
+
+// newPlatformResult describes a platform image, reading its base from the labels mutateConfig set.
+func newPlatformResult(platform Platform, img v1.Image) (PlatformResult, error) {
+	desc, err := partial.Descriptor(img)
+	if err != nil {
+		return PlatformResult{}, fmt.Errorf("failed to describe image: %w", err)
+	}
+	desc.Platform = platform.ToV1Platform()
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return PlatformResult{}, fmt.Errorf("failed to read image config: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return PlatformResult{}, fmt.Errorf("failed to read image layers: %w", err)
+	}
+
+	result := PlatformResult{
+		Image:      img,
+		Descriptor: *desc,
+		Platform:   platform.String(),
+		Digest:     desc.Digest.String(),
+		Base: BaseResult{
+			Name:   cfg.Config.Labels[baseNameLabel],
+			Digest: cfg.Config.Labels[baseDigestLabel],
+		},
+	}
+	for _, layer := range layers {
+		d, err := layer.Digest()
+		if err != nil {
+			return PlatformResult{}, fmt.Errorf("failed to retrieve layer digest: %w", err)
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return PlatformResult{}, fmt.Errorf("failed to retrieve layer size: %w", err)
+		}
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return PlatformResult{}, fmt.Errorf("failed to retrieve layer media type: %w", err)
+		}
+		result.Layers = append(result.Layers, LayerResult{Digest: d.String(), Size: size, MediaType: mediaType})
+	}
+	return result, nil
+}
+
+// newBuildResult describes an unpublished image or index.
+func newBuildResult(artifact partial.Describable, platforms []PlatformResult, annotations map[string]string) (*BuildResult, error) {
+	desc, err := partial.Descriptor(artifact)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe build result: %w", err)
+	}
+	result := &BuildResult{
+		Descriptor:  *desc,
+		Digest:      desc.Digest.String(),
+		MediaType:   desc.MediaType,
+		References:  []string{},
+		Targets:     []TargetResult{},
+		Platforms:   platforms,
+		Annotations: maps.Clone(annotations),
+	}
+	if result.Annotations == nil {
+		result.Annotations = map[string]string{}
+	}
+	switch a := artifact.(type) {
+	case v1.ImageIndex:
+		result.Index = a
+	case v1.Image:
+		result.Image = a
+	}
+	return result, nil
+}
+
+// addTargets records each target's outcome, given the errors publishTargets returned.
+func (r *BuildResult) addTargets(targets []BuildSpecTarget, errs []error) error {
+	for i, target := range targets {
+		refs, err := target.Refs()
+		if err != nil {
+			return err
+		}
+		tr := TargetResult{
+			Type: target.Type.String(),
+			Repo: refs[0].Context().Name(),
+			Tags: []string{},
+		}
+		if target.Type == LOCAL_FILE || target.Type == OCI_LAYOUT {
+			tr.Output = target.OutputPath()
+		}
+		for _, ref := range refs {
+			tr.Tags = append(tr.Tags, ref.TagStr())
+		}
+		if errs[i] != nil {
+			tr.Error = errs[i].Error()
+		} else {
+			for _, ref := range refs {
+				if !slices.Contains(r.References, ref.Name()) {
+					r.References = append(r.References, ref.Name())
+				}
+			}
+		}
+		r.Targets = append(r.Targets, tr)
+	}
+	return nil
+}
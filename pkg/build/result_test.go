@@ -0,0 +1,122 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestBuildMultiPlatformResult(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	spec := newMultiPlatformTestSpec(t, BuildSpecTarget{Repo: host + "/app:1.0.0", Type: REMOTE, Tags: []string{"1.0.0", "latest"}})
+	spec.Annotations = map[string]string{"org.opencontainers.image.version": "1.0.0"}
+
+	result, err := BuildMultiPlatform(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	index, err := remote.Index(mustParseRef(t, host+"/app:1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Digest != digest.String() {
+		t.Fatalf("expected digest %s, got %s", digest, result.Digest)
+	}
+	if !result.MediaType.IsIndex() {
+		t.Fatalf("expected an index media type, got %s", result.MediaType)
+	}
+	if result.Pinned() != host+"/app@"+digest.String() {
+		t.Fatalf("unexpected pinned reference %s", result.Pinned())
+	}
+	if len(result.References) != 2 || result.References[0] != host+"/app:1.0.0" || result.References[1] != host+"/app:latest" {
+		t.Fatalf("unexpected references %v", result.References)
+	}
+	if result.Annotations["org.opencontainers.image.version"] != "1.0.0" {
+		t.Fatalf("unexpected annotations %v", result.Annotations)
+	}
+
+	images, err := indexImages(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Platforms) != len(images) {
+		t.Fatalf("expected %d platforms, got %d", len(images), len(result.Platforms))
+	}
+	for i, p := range result.Platforms {
+		d, err := images[i].image.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Platform != images[i].platform.String() || p.Digest != d.String() {
+			t.Fatalf("platform %d: got %s@%s, want %s@%s", i, p.Platform, p.Digest, images[i].platform, d)
+		}
+		if p.Base.Name != "scratch" {
+			t.Fatalf("unexpected base %+v", p.Base)
+		}
+		if len(p.Layers) != 1 || p.Layers[0].Size == 0 {
+			t.Fatalf("unexpected layers %+v", p.Layers)
+		}
+	}
+}
+
+func TestBuildImageDoesNotPublish(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "binary"}))
+	spec.Target = BuildSpecTarget{Repo: host + "/app:1.0.0", Type: REMOTE}
+
+	built, err := BuildImage(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if built.Image == nil || built.Index != nil {
+		t.Fatal("expected an image result")
+	}
+	if len(built.Targets) != 0 || len(built.References) != 0 {
+		t.Fatalf("expected no targets, got %v", built.Targets)
+	}
+	if _, err := remote.Head(mustParseRef(t, host+"/app:1.0.0")); err == nil {
+		t.Fatal("BuildImage published the image")
+	}
+
+	// Publishing the same spec yields the image BuildImage returned
+	published, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if published.Descriptor.Digest != built.Descriptor.Digest {
+		t.Fatalf("expected %s, got %s", built.Descriptor.Digest, published.Descriptor.Digest)
+	}
+}
+
+func TestBuildIndexResult(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	spec := newMultiPlatformTestSpec(t, BuildSpecTarget{Repo: "example.com/app", Type: REMOTE})
+
+	result, err := BuildIndex(ctx, spec)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if result.Index == nil || result.Image != nil {
+		t.Fatal("expected an index result")
+	}
+	manifest, err := result.Index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range result.Platforms {
+		if p.Image == nil {
+			t.Fatalf("platform %s has no image", p.Platform)
+		}
+		desc := manifest.Manifests[i]
+		if p.Descriptor.Digest != desc.Digest || p.Descriptor.Size != desc.Size || !p.Descriptor.Platform.Equals(*desc.Platform) {
+			t.Fatalf("platform %s: descriptor %+v does not match index entry %+v", p.Platform, p.Descriptor, desc)
+		}
+	}
+}
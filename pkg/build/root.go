@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
@@ -25,6 +26,15 @@ const (
 	REMOTE TargetType = iota
 	LOCAL_DAEMON
 	LOCAL_FILE
+	OCI_LAYOUT
+)
+
+// ImageFormat selects between Docker and OCI media types where tko has to choose one itself.
+type ImageFormat int
+
+const (
+	FORMAT_DOCKER ImageFormat = iota
+	FORMAT_OCI
 )
 
 type Platform struct {
@@ -72,17 +82,46 @@ type BuildSpecInjectLayer struct {
 type BuildSpecTarget struct {
 	Repo string
 	Type TargetType
+	// Tags are pushed in Repo's repository along with Repo. If Repo names no
+	// tag, only Tags are pushed rather than latest.
+	Tags []string
+	// Output is the tarball (LOCAL_FILE) or OCI image layout directory
+	// (OCI_LAYOUT) written to. Defaults to out.tar and oci-layout.
+	Output string
+	// DaemonPlatform is the platform of a multi-platform build loaded into the
+	// daemon by LOCAL_DAEMON. Nil picks the host's platform.
+	DaemonPlatform *Platform
 }
 
 type BuildSpec struct {
 	BaseRef     string
 	InjectLayer BuildSpecInjectLayer
 	Target      BuildSpecTarget
+	// Targets are published to along with Target, concurrently.
+	Targets []BuildSpecTarget
+	// AllowPartialFailure succeeds as long as one target was published.
+	AllowPartialFailure bool
 
 	Author      string
 	Annotations map[string]string
 	Env         map[string]string
 	RunAs       *string
+
+	// CheckLinking verifies the entrypoint's dynamic dependencies against the base image.
+	CheckLinking bool
+	// SkipPlatformCheck builds even if ELF files in the source were built for
+	// another platform, for trees that ship foreign binaries on purpose.
+	SkipPlatformCheck bool
+
+	// ScratchFormat is the media type family used when BaseRef is "scratch".
+	ScratchFormat ImageFormat
+
+	// SBOM attaches an SBOM of the image in this format when not SBOM_NONE.
+	SBOM SBOMFormat
+	// Provenance attaches SLSA provenance naming the base image and Source.
+	Provenance bool
+	// Source is the git revision being built. Nil when unknown.
+	Source *BuildSource
 }
 
 // MultiPlatformBuildSpec describes a multi-platform build.
@@ -96,11 +135,21 @@ type MultiPlatformBuildSpec struct {
 	DestinationChown bool
 	Entrypoint       string
 
-	Target      BuildSpecTarget
+	Target              BuildSpecTarget
+	Targets             []BuildSpecTarget
+	AllowPartialFailure bool
+
 	Author      string
 	Annotations map[string]string
 	Env         map[string]string
 	RunAs       *string
+
+	CheckLinking      bool
+	SkipPlatformCheck bool
+	ScratchFormat     ImageFormat
+	SBOM              SBOMFormat
+	Provenance        bool
+	Source            *BuildSource
 }
 
 type BuildContext struct {
@@ -109,22 +158,72 @@ type BuildContext struct {
 	Keychain           authn.Keychain
 
 	TempPath string
+
+	// Version of tko, recorded in the documents attached to images.
+	Version string
+
+	// Lock pins base image references to digests. Nil disables pinning.
+	Lock *LockFile
+	// Locked fails the build when a base reference is missing from Lock or has moved since it was locked.
+	Locked bool
+
+	// Cache stores base image manifests, configs and layers on disk. Nil disables caching.
+	Cache *BlobCache
+	// Offline resolves base images from Cache only.
+	Offline bool
+
+	// Mirrors maps a registry to mirror endpoints tried in order before it when pulling base images.
+	Mirrors map[string][]string
+
+	// Verifier requires a valid signature on every registry base image. Nil disables verification.
+	Verifier *SignatureVerifier
+
+	// Policy restricts which base images may be used. Nil allows any.
+	Policy *BasePolicy
+
+	// ProvenanceSigner signs provenance attestations. Nil attaches them unsigned.
+	ProvenanceSigner *ProvenanceSigner
+
+	// DaemonHost is the daemon used by LOCAL_DAEMON targets and daemon: bases
+	// (e.g. unix:///run/podman/podman.sock or ssh://user@host). Empty falls back
+	// to DOCKER_HOST, CONTAINER_HOST, the rootless Podman socket and the Docker default.
+	DaemonHost string
+
+	// FailIfChanged fails publishing to a registry when a tag doesn't already
+	// point at the built digest, instead of pushing it.
+	FailIfChanged bool
+	// ImmutableTags are glob patterns (e.g. v*) of registry tags that may be
+	// created but never moved to a different digest.
+	ImmutableTags []string
 }
 
-func buildImage(ctx BuildContext, spec BuildSpec) (v1.Image, error) {
-	baseImage, baseMetadata, err := getBaseImage(ctx, spec.BaseRef, spec.InjectLayer.Platform, ctx.Keychain)
+// buildImage builds a platform image and returns it with the base it was built on.
+func buildImage(ctx BuildContext, spec BuildSpec) (v1.Image, BaseImageMetadata, error) {
+	if !spec.SkipPlatformCheck {
+		if err := verifySourcePlatform(spec.InjectLayer.SourcePath, spec.InjectLayer.Platform); err != nil {
+			return nil, BaseImageMetadata{}, err
+		}
+	}
+
+	baseImage, baseMetadata, err := getBaseImage(ctx, spec.BaseRef, spec.InjectLayer.Platform, spec.ScratchFormat, ctx.Keychain)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve base image: %w", err)
+		return nil, BaseImageMetadata{}, fmt.Errorf("failed to retrieve base image: %w", err)
+	}
+
+	if spec.CheckLinking {
+		if err := checkDynamicLinking(baseImage, spec.InjectLayer); err != nil {
+			return nil, BaseImageMetadata{}, err
+		}
 	}
 
 	mediaType, err := getMediaType(baseImage)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get media type: %w", err)
+		return nil, BaseImageMetadata{}, fmt.Errorf("failed to get media type: %w", err)
 	}
 
 	newLayer, err := createLayerFromFolder(ctx, spec.InjectLayer, tarball.WithMediaType(mediaType))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create layer from source: %w", err)
+		return nil, BaseImageMetadata{}, fmt.Errorf("failed to create layer from source: %w", err)
 	}
 
 	newImage, err := mutate.Append(baseImage, mutate.Addendum{
@@ -136,50 +235,74 @@ func buildImage(ctx BuildContext, spec BuildSpec) (v1.Image, error) {
 		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to append layer to base image: %w", err)
+		return nil, BaseImageMetadata{}, fmt.Errorf("failed to append layer to base image: %w", err)
 	}
 
 	newImage, err = mutateConfig(newImage, spec, baseMetadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to mutate config: %w", err)
+		return nil, BaseImageMetadata{}, fmt.Errorf("failed to mutate config: %w", err)
 	}
 
-	return newImage, nil
+	return newImage, baseMetadata, nil
 }
 
-func Build(ctx BuildContext, spec BuildSpec) error {
-	image, err := buildImage(ctx, spec)
+// BuildImage builds a single-platform image without publishing it.
+func BuildImage(ctx BuildContext, spec BuildSpec) (*BuildResult, error) {
+	image, base, err := buildImage(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := newPlatformResult(spec.InjectLayer.Platform, image)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return publish(ctx, image, spec.Target)
+	platform.Attachments, err = attachments(ctx, spec, image, base)
+	if err != nil {
+		return nil, err
+	}
+	return newBuildResult(image, []PlatformResult{platform}, spec.Annotations)
 }
 
-// BuildMultiPlatform builds images for multiple platforms and publishes a manifest list.
-func BuildMultiPlatform(ctx BuildContext, spec MultiPlatformBuildSpec) error {
-	if spec.Target.Type != REMOTE {
-		return fmt.Errorf("multi-platform builds only support REMOTE targets")
+// Build builds a single-platform image and publishes it to every target. When
+// publishing fails, the result still describes the image and each target's outcome.
+func Build(ctx BuildContext, spec BuildSpec) (*BuildResult, error) {
+	result, err := BuildImage(ctx, spec)
+	if err != nil {
+		return nil, err
 	}
+	return publishResult(ctx, result, append([]BuildSpecTarget{spec.Target}, spec.Targets...), spec.AllowPartialFailure)
+}
 
+// BuildIndex builds images for multiple platforms and assembles them into an
+// index without publishing it. A single platform yields a plain image instead.
+func BuildIndex(ctx BuildContext, spec MultiPlatformBuildSpec) (*BuildResult, error) {
 	if err := validatePlatformSources(spec); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Single platform: build and publish a regular image (not an index)
 	if len(spec.Platforms) == 1 {
-		resolved := resolvePlatformSpec(spec, spec.Platforms[0])
-		return Build(ctx, resolved)
+		return BuildImage(ctx, resolvePlatformSpec(spec, spec.Platforms[0]))
 	}
 
 	var addenda []mutate.IndexAddendum
+	var platforms []PlatformResult
 	for _, ps := range spec.Platforms {
 		resolved := resolvePlatformSpec(spec, ps)
 		log.Printf("Building for platform %s...", ps.Platform)
 
-		img, err := buildImage(ctx, resolved)
+		img, base, err := buildImage(ctx, resolved)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build image for platform %s: %w", ps.Platform, err)
+		}
+		platform, err := newPlatformResult(ps.Platform, img)
 		if err != nil {
-			return fmt.Errorf("failed to build image for platform %s: %w", ps.Platform, err)
+			return nil, err
+		}
+		platform.Attachments, err = attachments(ctx, resolved, img, base)
+		if err != nil {
+			return nil, err
 		}
+		platforms = append(platforms, platform)
 
 		addenda = append(addenda, mutate.IndexAddendum{
 			Add: img,
@@ -190,8 +313,83 @@ func BuildMultiPlatform(ctx BuildContext, spec MultiPlatformBuildSpec) error {
 	}
 
 	idx := mutate.AppendManifests(empty.Index, addenda...)
+	return newBuildResult(idx, platforms, spec.Annotations)
+}
+
+// BuildMultiPlatform builds images for multiple platforms and publishes a manifest list.
+// Local targets receive the index as an OCI layout, as per-platform tags in a
+// docker archive, or, for the daemon, as the image of a single platform.
+func BuildMultiPlatform(ctx BuildContext, spec MultiPlatformBuildSpec) (*BuildResult, error) {
+	result, err := BuildIndex(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	return publishResult(ctx, result, append([]BuildSpecTarget{spec.Target}, spec.Targets...), spec.AllowPartialFailure)
+}
+
+// publishResult publishes a built image or index to every target and records the outcomes.
+func publishResult(ctx BuildContext, result *BuildResult, targets []BuildSpecTarget, allowPartialFailure bool) (*BuildResult, error) {
+	errs, publishErr := publishTargets(targets, allowPartialFailure, func(target BuildSpecTarget) error {
+		platforms := result.Platforms
+		var written bool
+		var err error
+		switch {
+		case result.Index != nil && target.Type == LOCAL_DAEMON:
+			// The daemon loads a single platform image, so only its attachments are written
+			var selected platformImage
+			selected, err = daemonImage(ctx, result.Index, target)
+			if err != nil {
+				return err
+			}
+			written, err = publish(ctx, selected.image, target)
+			platforms = slices.DeleteFunc(slices.Clone(platforms), func(p PlatformResult) bool {
+				return p.Platform != selected.platform.String()
+			})
+		case result.Index != nil:
+			written, err = publishIndex(ctx, result.Index, target)
+		default:
+			written, err = publish(ctx, result.Image, target)
+		}
+		// Registry tags that were already up to date already have their attachments,
+		// and --fail-if-changed promises to write nothing
+		if err != nil || !written || ctx.FailIfChanged {
+			return err
+		}
+		return publishAttachments(ctx, platforms, target)
+	})
+	if err := result.addTargets(targets, errs); err != nil {
+		return nil, err
+	}
+	return result, publishErr
+}
+
+// attachments generates the documents spec asks for about a platform image.
+func attachments(ctx BuildContext, spec BuildSpec, image v1.Image, base BaseImageMetadata) ([]Attachment, error) {
+	var result []Attachment
+	if spec.SBOM != SBOM_NONE {
+		sbom, err := generateSBOM(ctx, spec.SBOM, imageName(spec.Target), image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate SBOM: %w", err)
+		}
+		result = append(result, sbom)
+	}
+	if spec.Provenance {
+		provenance, err := generateProvenance(ctx, spec, base, image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate provenance: %w", err)
+		}
+		result = append(result, provenance)
+	}
+	return result, nil
+}
 
-	return publishIndex(ctx, idx, spec.Target)
+// imageName is the repository an image is published to, without its tag.
+func imageName(target BuildSpecTarget) string {
+	ref, err := name.NewTag(target.Repo)
+	if err != nil {
+		return target.Repo
+	}
+	return ref.Context().Name()
 }
 
 func PlatformSourcePath(sourceRoot string, p Platform) string {
@@ -235,11 +433,21 @@ func resolvePlatformSpec(top MultiPlatformBuildSpec, ps PlatformSpec) BuildSpec
 			DestinationChown: top.DestinationChown,
 			Entrypoint:       entrypoint,
 		},
-		Target:      top.Target,
+		Target:              top.Target,
+		Targets:             top.Targets,
+		AllowPartialFailure: top.AllowPartialFailure,
+
 		Author:      top.Author,
 		Annotations: top.Annotations,
 		Env:         env,
 		RunAs:       runAs,
+
+		CheckLinking:      top.CheckLinking,
+		SkipPlatformCheck: top.SkipPlatformCheck,
+		ScratchFormat:     top.ScratchFormat,
+		SBOM:              top.SBOM,
+		Provenance:        top.Provenance,
+		Source:            top.Source,
 	}
 }
 
@@ -272,6 +480,17 @@ func mutateConfig(img v1.Image, spec BuildSpec, metadata BaseImageMetadata) (v1.
 	imgCfg.Config.Entrypoint = []string{spec.InjectLayer.Entrypoint}
 	imgCfg.Config.Cmd = nil
 
+	// Scratch (and some hand-built bases) carry no platform; fill in what the image is built for
+	if imgCfg.OS == "" {
+		imgCfg.OS = spec.InjectLayer.Platform.OS
+	}
+	if imgCfg.Architecture == "" {
+		imgCfg.Architecture = spec.InjectLayer.Platform.Arch
+	}
+	if imgCfg.Variant == "" {
+		imgCfg.Variant = spec.InjectLayer.Platform.Variant
+	}
+
 	imgCfg.Created = v1.Time{Time: unixEpoch}
 	imgCfg.Author = spec.Author
 	imgCfg.Container = ""
@@ -289,10 +508,12 @@ func mutateConfig(img v1.Image, spec BuildSpec, metadata BaseImageMetadata) (v1.
 	}
 
 	imgCfg.Config.Labels = map[string]string{}
-	imgCfg.Config.Labels["org.opencontainers.image.base.name"] = metadata.name
+	if metadata.name != "" {
+		imgCfg.Config.Labels[baseNameLabel] = metadata.name
+	}
 
 	if metadata.imageDigest != "" {
-		imgCfg.Config.Labels["org.opencontainers.image.base.digest"] = metadata.imageDigest
+		imgCfg.Config.Labels[baseDigestLabel] = metadata.imageDigest
 	}
 
 	maps.Copy(imgCfg.Config.Labels, spec.Annotations)
@@ -358,6 +579,8 @@ func ParseTargetType(str string) (TargetType, error) {
 		return LOCAL_DAEMON, nil
 	case "LOCAL_FILE":
 		return LOCAL_FILE, nil
+	case "OCI_LAYOUT":
+		return OCI_LAYOUT, nil
 	case "":
 		return REMOTE, nil
 	default:
@@ -365,6 +588,32 @@ func ParseTargetType(str string) (TargetType, error) {
 	}
 }
 
+func (t TargetType) String() string {
+	switch t {
+	case REMOTE:
+		return "REMOTE"
+	case LOCAL_DAEMON:
+		return "LOCAL_DAEMON"
+	case LOCAL_FILE:
+		return "LOCAL_FILE"
+	case OCI_LAYOUT:
+		return "OCI_LAYOUT"
+	default:
+		return fmt.Sprintf("TargetType(%d)", int(t))
+	}
+}
+
+func ParseImageFormat(str string) (ImageFormat, error) {
+	switch str {
+	case "docker", "":
+		return FORMAT_DOCKER, nil
+	case "oci":
+		return FORMAT_OCI, nil
+	default:
+		return -1, fmt.Errorf("invalid image format: %s", str)
+	}
+}
+
 func getMediaType(base v1.Image) (types.MediaType, error) {
 	mt, err := base.MediaType()
 	if err != nil {
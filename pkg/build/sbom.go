@@ -0,0 +1,631 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// SBOMFormat selects the SBOM document generated for each platform image.
+type SBOMFormat int
+
+const (
+	SBOM_NONE SBOMFormat = iota
+	SBOM_SPDX
+	SBOM_CYCLONEDX
+)
+
+const (
+	spdxMediaType      = "application/spdx+json"
+	cycloneDXMediaType = "application/vnd.cyclonedx+json"
+)
+
+// Package databases read from the base image.
+const (
+	dpkgStatusPath    = "/var/lib/dpkg/status"
+	dpkgStatusDirPath = "/var/lib/dpkg/status.d/"
+	apkInstalledPath  = "/lib/apk/db/installed"
+)
+
+func ParseSBOMFormat(str string) (SBOMFormat, error) {
+	switch str {
+	case "none", "":
+		return SBOM_NONE, nil
+	case "spdx":
+		return SBOM_SPDX, nil
+	case "cyclonedx":
+		return SBOM_CYCLONEDX, nil
+	default:
+		return -1, fmt.Errorf("invalid SBOM format: %s", str)
+	}
+}
+
+// sbomFile is a regular file in the layer tko adds, with the packages
+// detected in it when it is a Go or Rust binary.
+type sbomFile struct {
+	Path     string
+	SHA1     string
+	SHA256   string
+	Packages []sbomPackage
+}
+
+type sbomPackage struct {
+	Name    string
+	Version string
+	PURL    string
+	// Main marks the module or crate a binary was built from.
+	Main bool
+}
+
+// sbomInventory is everything an SBOM document lists for one platform image.
+type sbomInventory struct {
+	Name     string
+	Digest   v1.Hash
+	Tool     string
+	Files    []sbomFile
+	Packages []sbomPackage
+}
+
+// generateSBOM inventories img, whose last layer is the one tko added and
+// whose other layers are the base image, as a referrer attachment.
+func generateSBOM(ctx BuildContext, format SBOMFormat, name string, img v1.Image) (Attachment, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to get image digest: %w", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to read image layers: %w", err)
+	}
+	if len(layers) == 0 {
+		return Attachment{}, fmt.Errorf("image has no layers")
+	}
+
+	files, err := catalogLayer(layers[len(layers)-1])
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to catalog injected layer: %w", err)
+	}
+	packages, err := readBasePackages(layers[:len(layers)-1])
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to read base image packages: %w", err)
+	}
+
+	inv := sbomInventory{
+		Name:     name,
+		Digest:   digest,
+		Tool:     "tko-" + toolVersion(ctx),
+		Files:    files,
+		Packages: packages,
+	}
+	switch format {
+	case SBOM_SPDX:
+		data, err := json.MarshalIndent(inv.spdx(), "", "  ")
+		if err != nil {
+			return Attachment{}, err
+		}
+		return Attachment{ArtifactType: spdxMediaType, Data: data, Extension: ".spdx.json"}, nil
+	case SBOM_CYCLONEDX:
+		data, err := json.MarshalIndent(inv.cycloneDX(), "", "  ")
+		if err != nil {
+			return Attachment{}, err
+		}
+		return Attachment{ArtifactType: cycloneDXMediaType, Data: data, Extension: ".cdx.json"}, nil
+	}
+	return Attachment{}, fmt.Errorf("unsupported SBOM format: %d", format)
+}
+
+func toolVersion(ctx BuildContext) string {
+	if ctx.Version == "" {
+		return "dev"
+	}
+	return ctx.Version
+}
+
+// catalogLayer hashes every regular file in layer and reads the build info embedded in binaries.
+func catalogLayer(layer v1.Layer) ([]sbomFile, error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var files []sbomFile
+	reader := tar.NewReader(rc)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		sum1 := sha1.Sum(data)
+		sum256 := sha256.Sum256(data)
+		name := path.Join("/", header.Name)
+		files = append(files, sbomFile{
+			Path:     name,
+			SHA1:     hex.EncodeToString(sum1[:]),
+			SHA256:   hex.EncodeToString(sum256[:]),
+			Packages: readBinaryPackages(data),
+		})
+	}
+	return files, nil
+}
+
+// readBinaryPackages returns the modules of a Go binary or the crates a Rust
+// binary built with cargo-auditable records. Other files have none.
+func readBinaryPackages(data []byte) []sbomPackage {
+	if info, err := buildinfo.Read(bytes.NewReader(data)); err == nil {
+		return goPackages(info)
+	}
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		if packages, ok := rustPackages(data); ok {
+			return packages
+		}
+	}
+	return nil
+}
+
+func goPackages(info *buildinfo.BuildInfo) []sbomPackage {
+	var packages []sbomPackage
+	if info.Main.Path != "" {
+		packages = append(packages, sbomPackage{
+			Name:    info.Main.Path,
+			Version: info.Main.Version,
+			PURL:    purl("golang", info.Main.Path, info.Main.Version, ""),
+			Main:    true,
+		})
+	}
+	packages = append(packages, sbomPackage{
+		Name:    "stdlib",
+		Version: info.GoVersion,
+		PURL:    purl("golang", "stdlib", info.GoVersion, ""),
+	})
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		packages = append(packages, sbomPackage{
+			Name:    dep.Path,
+			Version: dep.Version,
+			PURL:    purl("golang", dep.Path, dep.Version, ""),
+		})
+	}
+	return packages
+}
+
+// rustPackages decodes the zlib-compressed dependency list cargo-auditable
+// embeds in the .dep-v0 section.
+func rustPackages(data []byte) ([]sbomPackage, bool) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	section := f.Section(".dep-v0")
+	if section == nil {
+		return nil, false
+	}
+	compressed, err := section.Data()
+	if err != nil {
+		return nil, false
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+
+	var deps struct {
+		Packages []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Root    bool   `json:"root"`
+		} `json:"packages"`
+	}
+	if err := json.NewDecoder(zr).Decode(&deps); err != nil {
+		return nil, false
+	}
+
+	var packages []sbomPackage
+	for _, p := range deps.Packages {
+		packages = append(packages, sbomPackage{
+			Name:    p.Name,
+			Version: p.Version,
+			PURL:    purl("cargo", p.Name, p.Version, ""),
+			Main:    p.Root,
+		})
+	}
+	return packages, true
+}
+
+// readBasePackages lists the packages recorded in the dpkg and apk databases of the flattened base layers.
+func readBasePackages(layers []v1.Layer) ([]sbomPackage, error) {
+	if len(layers) == 0 {
+		return nil, nil
+	}
+	base, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		return nil, err
+	}
+	rc := mutate.Extract(base)
+	defer rc.Close()
+
+	var osRelease, apkInstalled []byte
+	var dpkgStatus [][]byte
+	reader := tar.NewReader(rc)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Join("/", header.Name)
+		var dst *[]byte
+		switch {
+		case name == "/etc/os-release", name == "/usr/lib/os-release" && osRelease == nil:
+			dst = &osRelease
+		case name == apkInstalledPath:
+			dst = &apkInstalled
+		case name == dpkgStatusPath, strings.HasPrefix(name, dpkgStatusDirPath):
+			dpkgStatus = append(dpkgStatus, nil)
+			dst = &dpkgStatus[len(dpkgStatus)-1]
+		default:
+			continue
+		}
+		if *dst, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	distro := osReleaseID(osRelease)
+	var found []sbomPackage
+	for _, status := range dpkgStatus {
+		found = append(found, parseDpkgStatus(status, distro)...)
+	}
+	found = append(found, parseAPKInstalled(apkInstalled, distro)...)
+
+	// A package may be listed both in status and in status.d
+	var packages []sbomPackage
+	seen := make(map[string]bool)
+	for _, p := range found {
+		if !seen[p.PURL] {
+			seen[p.PURL] = true
+			packages = append(packages, p)
+		}
+	}
+	return packages, nil
+}
+
+func osReleaseID(data []byte) string {
+	for line := range strings.Lines(string(data)) {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "ID="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// parseDpkgStatus reads the installed packages of a dpkg status file. The
+// per-package files distroless images keep in status.d have no Status field.
+func parseDpkgStatus(data []byte, distro string) []sbomPackage {
+	var packages []sbomPackage
+	for _, stanza := range stanzas(data) {
+		fields := make(map[string]string)
+		for _, line := range stanza {
+			if key, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, " ") {
+				fields[key] = strings.TrimSpace(value)
+			}
+		}
+		if fields["Package"] == "" {
+			continue
+		}
+		if status, ok := fields["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			PURL:    purl("deb", path.Join(distro, fields["Package"]), fields["Version"], fields["Architecture"]),
+		})
+	}
+	return packages
+}
+
+// parseAPKInstalled reads the single-letter keyed entries of an apk installed database.
+func parseAPKInstalled(data []byte, distro string) []sbomPackage {
+	var packages []sbomPackage
+	for _, stanza := range stanzas(data) {
+		fields := make(map[string]string)
+		for _, line := range stanza {
+			if key, value, ok := strings.Cut(line, ":"); ok && len(key) == 1 {
+				if _, seen := fields[key]; !seen {
+					fields[key] = value
+				}
+			}
+		}
+		if fields["P"] == "" {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Name:    fields["P"],
+			Version: fields["V"],
+			PURL:    purl("apk", path.Join(distro, fields["P"]), fields["V"], fields["A"]),
+		})
+	}
+	return packages
+}
+
+// stanzas splits data into blank-line separated groups of lines.
+func stanzas(data []byte) [][]string {
+	var result [][]string
+	var current []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if current != nil {
+				result = append(result, current)
+				current = nil
+			}
+			continue
+		}
+		current = append(current, line)
+	}
+	if current != nil {
+		result = append(result, current)
+	}
+	return result
+}
+
+// purl builds a package URL. name may contain a /-separated namespace.
+func purl(typ, name, version, arch string) string {
+	segments := strings.Split(strings.Trim(name, "/"), "/")
+	for i, s := range segments {
+		segments[i] = purlEscape(s)
+	}
+	p := "pkg:" + typ + "/" + strings.Join(segments, "/")
+	if version != "" {
+		p += "@" + purlEscape(version)
+	}
+	if arch != "" {
+		p += "?arch=" + purlEscape(arch)
+	}
+	return p
+}
+
+// purlEscape percent-encodes everything but unreserved characters.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// SPDX 2.3 JSON documents.
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxFile struct {
+	SPDXID    string         `json:"SPDXID"`
+	FileName  string         `json:"fileName"`
+	Checksums []spdxChecksum `json:"checksums"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdx describes the image as the document's package, containing the base
+// image's packages and tko's files, which in turn contain the packages of binaries.
+// The creation time is fixed so that rebuilding an image reproduces its SBOM.
+func (inv sbomInventory) spdx() spdxDocument {
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              inv.Name,
+		DocumentNamespace: "https://github.com/dskiff/tko/spdx/" + inv.Digest.String(),
+		CreationInfo: spdxCreationInfo{
+			Created:  unixEpoch.UTC().Format("2006-01-02T15:04:05Z"),
+			Creators: []string{"Tool: " + inv.Tool},
+		},
+		Packages: []spdxPackage{{
+			SPDXID:                "SPDXRef-Image",
+			Name:                  inv.Name,
+			VersionInfo:           inv.Digest.String(),
+			DownloadLocation:      "NOASSERTION",
+			Checksums:             []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: inv.Digest.Hex}},
+			PrimaryPackagePurpose: "CONTAINER",
+		}},
+		Relationships: []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"}},
+	}
+
+	addPackage := func(p sbomPackage, parent string) {
+		id := fmt.Sprintf("SPDXRef-Package-%d", len(doc.Packages))
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs:     []spdxExternalRef{{"PACKAGE-MANAGER", "purl", p.PURL}},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{parent, "CONTAINS", id})
+	}
+
+	for _, p := range inv.Packages {
+		addPackage(p, "SPDXRef-Image")
+	}
+	for i, f := range inv.Files {
+		id := fmt.Sprintf("SPDXRef-File-%d", i)
+		doc.Files = append(doc.Files, spdxFile{
+			SPDXID:   id,
+			FileName: f.Path,
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA1", ChecksumValue: f.SHA1},
+				{Algorithm: "SHA256", ChecksumValue: f.SHA256},
+			},
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", id})
+		for _, p := range f.Packages {
+			addPackage(p, id)
+		}
+	}
+	return doc
+}
+
+// CycloneDX 1.5 JSON documents.
+
+type cycloneDXDocument struct {
+	BOMFormat   string               `json:"bomFormat"`
+	SpecVersion string               `json:"specVersion"`
+	Version     int                  `json:"version"`
+	Metadata    cycloneDXMetadata    `json:"metadata"`
+	Components  []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Tools struct {
+		Components []cycloneDXComponent `json:"components"`
+	} `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXComponent struct {
+	BOMRef     string               `json:"bom-ref,omitempty"`
+	Type       string               `json:"type"`
+	Name       string               `json:"name"`
+	Version    string               `json:"version,omitempty"`
+	PURL       string               `json:"purl,omitempty"`
+	Hashes     []cycloneDXHash      `json:"hashes,omitempty"`
+	Components []cycloneDXComponent `json:"components,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// cycloneDX nests the packages found in a binary under its file component.
+func (inv sbomInventory) cycloneDX() cycloneDXDocument {
+	doc := cycloneDXDocument{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Components:  []cycloneDXComponent{},
+	}
+	tool, version, _ := strings.Cut(inv.Tool, "-")
+	doc.Metadata.Tools.Components = []cycloneDXComponent{{Type: "application", Name: tool, Version: version}}
+	doc.Metadata.Component = cycloneDXComponent{
+		BOMRef:  inv.Digest.String(),
+		Type:    "container",
+		Name:    inv.Name,
+		Version: inv.Digest.String(),
+		Hashes:  []cycloneDXHash{{Alg: "SHA-256", Content: inv.Digest.Hex}},
+	}
+
+	component := func(p sbomPackage) cycloneDXComponent {
+		typ := "library"
+		if p.Main {
+			typ = "application"
+		}
+		return cycloneDXComponent{BOMRef: p.PURL, Type: typ, Name: p.Name, Version: p.Version, PURL: p.PURL}
+	}
+
+	for _, p := range inv.Packages {
+		doc.Components = append(doc.Components, component(p))
+	}
+	for _, f := range inv.Files {
+		c := cycloneDXComponent{
+			BOMRef: "file:" + f.Path,
+			Type:   "file",
+			Name:   f.Path,
+			Hashes: []cycloneDXHash{
+				{Alg: "SHA-1", Content: f.SHA1},
+				{Alg: "SHA-256", Content: f.SHA256},
+			},
+		}
+		for _, p := range f.Packages {
+			sub := component(p)
+			sub.BOMRef = f.Path + "#" + p.PURL
+			c.Components = append(c.Components, sub)
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	return doc
+}
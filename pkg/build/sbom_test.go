@@ -0,0 +1,267 @@
+package build
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func packagePURLs(packages []sbomPackage) []string {
+	var purls []string
+	for _, p := range packages {
+		purls = append(purls, p.PURL)
+	}
+	return purls
+}
+
+func TestReadBasePackagesDpkg(t *testing.T) {
+	img := imageWithFiles(t, map[string]string{
+		"etc/os-release": "PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nID=debian\n",
+		"var/lib/dpkg/status": "Package: libc6\nStatus: install ok installed\nArchitecture: amd64\nVersion: 2.36-9+deb12u4\nDescription: GNU C Library\n multi-line description\n\n" +
+			"Package: removed\nStatus: deinstall ok config-files\nVersion: 1.0\n",
+		"var/lib/dpkg/status.d/tzdata": "Package: tzdata\nVersion: 2024a-0+deb12u1\nArchitecture: all\n",
+		"var/lib/dpkg/status.d/libc6":  "Package: libc6\nVersion: 2.36-9+deb12u4\nArchitecture: amd64\n",
+	}, nil)
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packages, err := readBasePackages(layers)
+	if err != nil {
+		t.Fatalf("readBasePackages: %v", err)
+	}
+	got := packagePURLs(packages)
+	slices.Sort(got)
+	want := []string{
+		"pkg:deb/debian/libc6@2.36-9%2Bdeb12u4?arch=amd64",
+		"pkg:deb/debian/tzdata@2024a-0%2Bdeb12u1?arch=all",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadBasePackagesAPK(t *testing.T) {
+	img := imageWithFiles(t, map[string]string{
+		"etc/os-release":       "ID=alpine\nVERSION_ID=3.20.0\n",
+		"lib/apk/db/installed": "C:Q1abc=\nP:musl\nV:1.2.5-r0\nA:x86_64\nL:MIT\n\nC:Q1def=\nP:busybox\nV:1.36.1-r28\nA:x86_64\n",
+	}, nil)
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packages, err := readBasePackages(layers)
+	if err != nil {
+		t.Fatalf("readBasePackages: %v", err)
+	}
+	want := []string{
+		"pkg:apk/alpine/musl@1.2.5-r0?arch=x86_64",
+		"pkg:apk/alpine/busybox@1.36.1-r28?arch=x86_64",
+	}
+	if got := packagePURLs(packages); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadBinaryPackagesGo(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packages := readBinaryPackages(data)
+	if !slices.ContainsFunc(packages, func(p sbomPackage) bool { return p.Name == "stdlib" }) {
+		t.Fatalf("expected the Go standard library among %v", packages)
+	}
+	if !slices.ContainsFunc(packages, func(p sbomPackage) bool { return p.PURL == "pkg:golang/github.com/google/go-containerregistry@v0.21.7" }) {
+		t.Fatalf("expected go-containerregistry among %v", packagePURLs(packages))
+	}
+}
+
+// rustTestBinary builds an ELF file whose only contents are a cargo-auditable .dep-v0 section.
+func rustTestBinary(t *testing.T, deps string) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := io.WriteString(zw, deps); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	shstrtab := []byte("\x00.shstrtab\x00.dep-v0\x00")
+	shstrtabOff := uint64(64)
+	depOff := shstrtabOff + uint64(len(shstrtab))
+	shOff := depOff + uint64(compressed.Len())
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	write := func(v any) {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(elf.Header64{
+		Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_X86_64), Version: uint32(elf.EV_CURRENT),
+		Shoff: shOff, Ehsize: 64, Shentsize: 64, Shnum: 3, Shstrndx: 1,
+	})
+	buf.Write(shstrtab)
+	buf.Write(compressed.Bytes())
+	write(elf.Section64{})
+	write(elf.Section64{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1})
+	write(elf.Section64{Name: 11, Type: uint32(elf.SHT_PROGBITS), Off: depOff, Size: uint64(compressed.Len()), Addralign: 1})
+	return buf.Bytes()
+}
+
+func TestReadBinaryPackagesRust(t *testing.T) {
+	data := rustTestBinary(t, `{"packages":[{"name":"app","version":"0.1.0","source":"local","dependencies":[1],"root":true},{"name":"serde","version":"1.0.203","source":"crates.io"}]}`)
+
+	packages := readBinaryPackages(data)
+	want := []sbomPackage{
+		{Name: "app", Version: "0.1.0", PURL: "pkg:cargo/app@0.1.0", Main: true},
+		{Name: "serde", Version: "1.0.203", PURL: "pkg:cargo/serde@1.0.203"},
+	}
+	if !slices.Equal(packages, want) {
+		t.Fatalf("got %+v, want %+v", packages, want)
+	}
+
+	if packages := readBinaryPackages([]byte("#!/bin/sh\n")); packages != nil {
+		t.Fatalf("expected no packages in a script, got %+v", packages)
+	}
+}
+
+func TestBuildSBOMReferrer(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	ctx.Version = "1.2.3"
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "hello"}))
+	spec.Target = BuildSpecTarget{Repo: newTestRegistry(t) + "/app:latest", Type: REMOTE}
+	spec.SBOM = SBOM_SPDX
+
+	result, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	subject, err := name.NewDigest(result.Pinned())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := remote.Referrers(subject)
+	if err != nil {
+		t.Fatalf("Referrers: %v", err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 1 || manifest.Manifests[0].ArtifactType != spdxMediaType {
+		t.Fatalf("expected one SPDX referrer, got %+v", manifest.Manifests)
+	}
+
+	referrer, err := remote.Image(subject.Context().Digest(manifest.Manifests[0].Digest.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := referrer.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layers[0].Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var doc spdxDocument
+	if err := json.NewDecoder(rc).Decode(&doc); err != nil {
+		t.Fatalf("failed to decode SPDX document: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("hello"))
+	if len(doc.Files) != 1 || doc.Files[0].FileName != "/app/mybin" || doc.Files[0].Checksums[1].ChecksumValue != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected files: %+v", doc.Files)
+	}
+	if doc.Packages[0].VersionInfo != result.Digest || doc.CreationInfo.Creators[0] != "Tool: tko-1.2.3" {
+		t.Fatalf("unexpected document: %+v", doc)
+	}
+}
+
+func TestBuildSBOMLocalFile(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "image.tar")
+	spec := newMultiPlatformTestSpec(t, BuildSpecTarget{Repo: "app:latest", Type: LOCAL_FILE, Output: out})
+	spec.SBOM = SBOM_CYCLONEDX
+
+	if _, err := BuildMultiPlatform(newTestBuildContext(t), spec); err != nil {
+		t.Fatalf("BuildMultiPlatform: %v", err)
+	}
+
+	for _, suffix := range []string{".linux-amd64.cdx.json", ".linux-arm64.cdx.json"} {
+		data, err := os.ReadFile(out + suffix)
+		if err != nil {
+			t.Fatalf("expected SBOM file: %v", err)
+		}
+		var doc cycloneDXDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.BOMFormat != "CycloneDX" || len(doc.Components) != 1 || doc.Components[0].Type != "file" {
+			t.Fatalf("unexpected document: %s", data)
+		}
+	}
+}
+
+func TestBuildSBOMNotAttachedWhenUpToDate(t *testing.T) {
+	ctx := newTestBuildContext(t)
+	spec := newScratchBuildSpec(createTestSourceDir(t, map[string]string{"mybin": "hello"}))
+	spec.Target = BuildSpecTarget{Repo: newTestRegistry(t) + "/app:latest", Type: REMOTE}
+	spec.SBOM = SBOM_SPDX
+	if _, err := Build(ctx, spec); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	// The SBOM format doesn't change the image, so its tag is already up to date
+	spec.SBOM = SBOM_CYCLONEDX
+	result, err := Build(ctx, spec)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	subject, err := name.NewDigest(result.Pinned())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := remote.Referrers(subject)
+	if err != nil {
+		t.Fatalf("Referrers: %v", err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 1 || manifest.Manifests[0].ArtifactType != spdxMediaType {
+		t.Fatalf("expected only the first SPDX referrer, got %+v", manifest.Manifests)
+	}
+}
@@ -0,0 +1,162 @@
+package build
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// semver is a parsed semantic version. The optional v prefix is kept so aliases match it.
+type semver struct {
+	prefix              string
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+func parseSemver(str string) (semver, bool) {
+	var v semver
+	if rest, ok := strings.CutPrefix(str, "v"); ok {
+		v.prefix, str = "v", rest
+	}
+	str, _, _ = strings.Cut(str, "+")
+	core, pre, hasPre := strings.Cut(str, "-")
+	if hasPre {
+		if pre == "" {
+			return semver{}, false
+		}
+		v.prerelease = strings.Split(pre, ".")
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	nums := make([]uint64, 3)
+	for i, p := range parts {
+		if p == "" || (len(p) > 1 && p[0] == '0') {
+			return semver{}, false
+		}
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func (v semver) isPrerelease() bool { return len(v.prerelease) > 0 }
+
+// compare orders versions by semver precedence.
+func (v semver) compare(o semver) int {
+	if c := cmp.Compare(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.patch, o.patch); c != 0 {
+		return c
+	}
+	// A release ranks above its pre-releases
+	switch {
+	case !v.isPrerelease() && !o.isPrerelease():
+		return 0
+	case !v.isPrerelease():
+		return 1
+	case !o.isPrerelease():
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := comparePrereleaseIdent(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(v.prerelease), len(o.prerelease))
+}
+
+func comparePrereleaseIdent(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return cmp.Compare(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// semverAliasTags returns the tags a build of version should push: the
+// version itself, plus MAJOR.MINOR, MAJOR and latest for each series in
+// which no existing tag is a higher version. Pre-releases, both the build's
+// and existing ones, are left out unless includePrerelease is set.
+func semverAliasTags(version string, existing []string, includePrerelease bool) ([]string, error) {
+	v, ok := parseSemver(version)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a semantic version", version)
+	}
+	if v.isPrerelease() && !includePrerelease {
+		return []string{version}, nil
+	}
+
+	highestMinor, highestMajor, highest := true, true, true
+	for _, tag := range existing {
+		t, ok := parseSemver(tag)
+		if !ok || t.prefix != v.prefix || (t.isPrerelease() && !includePrerelease) {
+			continue
+		}
+		if t.compare(v) <= 0 {
+			continue
+		}
+		highest = false
+		if t.major == v.major {
+			highestMajor = false
+			if t.minor == v.minor {
+				highestMinor = false
+			}
+		}
+	}
+
+	tags := []string{version}
+	if highestMinor {
+		tags = append(tags, fmt.Sprintf("%s%d.%d", v.prefix, v.major, v.minor))
+	}
+	if highestMajor {
+		tags = append(tags, fmt.Sprintf("%s%d", v.prefix, v.major))
+	}
+	if highest {
+		tags = append(tags, "latest")
+	}
+	return tags, nil
+}
+
+// SemverAliasTags lists the tags in repo and returns those a build of version
+// should push; see semverAliasTags.
+func SemverAliasTags(ctx BuildContext, repo string, version string, includePrerelease bool) ([]string, error) {
+	ref, err := name.NewTag(repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target repo: %w", err)
+	}
+	existing, err := remote.List(ref.Context(), remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain))
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("failed to list tags of %s: %w", ref.Context(), err)
+	}
+
+	tags, err := semverAliasTags(version, existing, includePrerelease)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 1 {
+		log.Printf("%s is not the highest version in any series; not moving aliases", version)
+	}
+	return tags, nil
+}
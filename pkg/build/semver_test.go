@@ -0,0 +1,95 @@
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestSemverCompare(t *testing.T) {
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.2.0", "1.10.0", "2.0.0"}
+	for i := 0; i+1 < len(ordered); i++ {
+		a, ok := parseSemver(ordered[i])
+		if !ok {
+			t.Fatalf("failed to parse %s", ordered[i])
+		}
+		b, ok := parseSemver(ordered[i+1])
+		if !ok {
+			t.Fatalf("failed to parse %s", ordered[i+1])
+		}
+		if a.compare(b) >= 0 || b.compare(a) <= 0 {
+			t.Fatalf("expected %s < %s", ordered[i], ordered[i+1])
+		}
+	}
+
+	for _, invalid := range []string{"1.4", "1.4.2.1", "01.4.2", "1.4.x", "latest", "1.4.2-"} {
+		if _, ok := parseSemver(invalid); ok {
+			t.Fatalf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestSemverAliasTags(t *testing.T) {
+	existing := []string{"latest", "main", "1.3.9", "1.4.1", "1.5.0", "2.0.0-rc.1", "v9.0.0"}
+	cases := []struct {
+		version    string
+		prerelease bool
+		want       []string
+	}{
+		{"1.4.2", false, []string{"1.4.2", "1.4"}},
+		{"1.5.1", false, []string{"1.5.1", "1.5", "1", "latest"}},
+		{"1.3.10", false, []string{"1.3.10", "1.3"}},
+		{"1.4.0", false, []string{"1.4.0"}},
+		{"1.9.0", true, []string{"1.9.0", "1.9", "1"}},
+		{"2.0.0-rc.2", false, []string{"2.0.0-rc.2"}},
+		{"2.0.0-rc.2", true, []string{"2.0.0-rc.2", "2.0", "2", "latest"}},
+		{"1.4.2-dirty", false, []string{"1.4.2-dirty"}},
+		{"v9.0.1", false, []string{"v9.0.1", "v9.0", "v9", "latest"}},
+	}
+	for _, c := range cases {
+		got, err := semverAliasTags(c.version, existing, c.prerelease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Fatalf("%s (prerelease %v): got %v, want %v", c.version, c.prerelease, got, c.want)
+		}
+	}
+
+	if _, err := semverAliasTags("snapshot-abc", existing, false); err == nil {
+		t.Fatal("expected a non-semver version to fail")
+	}
+}
+
+func TestSemverAliasTagsFromRegistry(t *testing.T) {
+	host := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+
+	// A repository that doesn't exist yet owns every alias
+	tags, err := SemverAliasTags(ctx, host+"/app", "1.4.2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, " ") != "1.4.2 1.4 1 latest" {
+		t.Fatalf("unexpected tags for an empty repository: %v", tags)
+	}
+
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"1.4.3", "1.5.0"} {
+		if err := remote.Write(mustParseRef(t, host+"/app:"+tag), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tags, err = SemverAliasTags(ctx, host+"/app", "1.4.2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, " ") != "1.4.2" {
+		t.Fatalf("expected no aliases below 1.4.3, got %v", tags)
+	}
+}
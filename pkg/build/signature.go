@@ -0,0 +1,273 @@
+package build
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Media types and annotations of cosign signatures. Signatures are stored
+// either as an image tagged sha256-<hex>.sig next to the signed manifest, or
+// as an OCI referrer of it with the cosign artifact type. Each layer of the
+// signature image is a simple signing payload, signed in its annotation.
+const (
+	cosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureArtifactType  = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	cosignSignatureAnnotation    = "dev.cosignproject.cosign/signature"
+)
+
+// SignatureVerifier checks base image signatures against a set of public keys.
+type SignatureVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// NewSignatureVerifier loads PEM encoded public keys. Each entry is either a
+// path to a key file or the PEM text itself.
+func NewSignatureVerifier(keys []string) (*SignatureVerifier, error) {
+	v := &SignatureVerifier{}
+	for _, k := range keys {
+		data := []byte(k)
+		if !strings.HasPrefix(strings.TrimSpace(k), "-----BEGIN") {
+			var err error
+			data, err = os.ReadFile(k)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read signature key: %w", err)
+			}
+		}
+		pub, err := parsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signature key %s: %w", k, err)
+		}
+		v.keys = append(v.keys, pub)
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("no signature keys configured")
+	}
+	return v, nil
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+func (v *SignatureVerifier) verifyPayload(payload, sig []byte) bool {
+	digest := sha256.Sum256(payload)
+	for _, key := range v.keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, digest[:], sig) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// simpleSigningPayload is the part of the cosign payload that binds a signature to a manifest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifyBaseSignature succeeds when any of digests in repo carries a valid
+// signature from one of the configured keys. Candidates are the platform
+// manifest and, for multi-platform bases, the index it was selected from.
+// Signatures verified online are kept in the cache, which is all offline
+// builds check.
+func verifyBaseSignature(ctx BuildContext, repo name.Repository, digests []v1.Hash) error {
+	if ctx.Offline && ctx.Cache == nil {
+		return fmt.Errorf("cannot verify signatures of %s offline without a cache", repo)
+	}
+
+	for _, d := range digests {
+		ok, err := ctx.Verifier.verifyDigest(ctx, repo.Digest(d.String()), ctx.Keychain)
+		if err != nil {
+			return fmt.Errorf("failed to verify signature of %s@%s: %w", repo, d, err)
+		}
+		if ok {
+			log.Printf("Verified signature of base image %s@%s", repo, d)
+			return nil
+		}
+	}
+	if ctx.Offline {
+		return fmt.Errorf("no valid signature cached for base image %s@%s; run an online build once to cache it", repo, digests[len(digests)-1])
+	}
+	return fmt.Errorf("no valid signature found for base image %s@%s", repo, digests[len(digests)-1])
+}
+
+func (v *SignatureVerifier) verifyDigest(ctx BuildContext, ref name.Digest, keychain authn.Keychain) (bool, error) {
+	h, err := v1.NewHash(ref.DigestStr())
+	if err != nil {
+		return false, err
+	}
+
+	var sigs []v1.Image
+	if ctx.Offline {
+		sigs, err = ctx.Cache.signatures(h)
+	} else {
+		sigs, err = findSignatures(ctx, ref, keychain)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, sig := range sigs {
+		ok, err := v.verifySignatureImage(sig, ref)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		if ctx.Cache != nil && !ctx.Offline {
+			if err := ctx.Cache.putSignature(h, sig); err != nil {
+				return false, fmt.Errorf("failed to cache signature: %w", err)
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// findSignatures returns the signature images for ref from the .sig tag and
+// the referrers API, read through the registry's mirrors like the base itself.
+func findSignatures(ctx BuildContext, ref name.Digest, keychain authn.Keychain) ([]v1.Image, error) {
+	var sigs []v1.Image
+
+	sigTag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + ".sig")
+	desc, found, err := remoteGetOptional(ctx, sigTag, keychain)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, img)
+	}
+
+	index, err := remoteReferrers(ctx, ref, keychain, remote.WithFilter("artifactType", cosignSignatureArtifactType))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.ArtifactType != cosignSignatureArtifactType {
+			continue
+		}
+		sigDesc, err := remoteGet(ctx, ref.Context().Digest(desc.Digest.String()), keychain)
+		if err != nil {
+			return nil, err
+		}
+		img, err := sigDesc.Image()
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, img)
+	}
+	return sigs, nil
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	return terr.StatusCode == 404
+}
+
+// verifySignatureImage checks each simple signing layer of sig for a payload
+// naming ref's digest and signed by one of the keys.
+func (v *SignatureVerifier) verifySignatureImage(sig v1.Image, ref name.Digest) (bool, error) {
+	manifest, err := sig.Manifest()
+	if err != nil {
+		return false, err
+	}
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != types.MediaType(cosignSimpleSigningMediaType) {
+			continue
+		}
+		encoded, ok := desc.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+
+		layer, err := sig.LayerByDigest(desc.Digest)
+		if err != nil {
+			return false, err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return false, err
+		}
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(rc)
+		rc.Close()
+		if err != nil {
+			return false, err
+		}
+		payload := buf.Bytes()
+
+		var p simpleSigningPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			continue
+		}
+		if p.Critical.Image.DockerManifestDigest != ref.DigestStr() {
+			continue
+		}
+		if v.verifyPayload(payload, signature) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
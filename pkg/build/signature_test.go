@@ -0,0 +1,223 @@
+package build
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func newTestSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return key, path
+}
+
+// signatureImage builds a cosign signature image for digest, signed by key.
+func signatureImage(t *testing.T, key *ecdsa.PrivateKey, ref name.Digest) v1.Image {
+	t.Helper()
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`,
+		ref.Context().Name(), ref.DigestStr()))
+	digest := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, cosignSignatureArtifactType)
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer:       static.NewLayer(payload, cosignSimpleSigningMediaType),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func pushSignatureTag(t *testing.T, key *ecdsa.PrivateKey, ref name.Digest) {
+	t.Helper()
+	tag := ref.Context().Tag(strings.Replace(ref.DigestStr(), ":", "-", 1) + ".sig")
+	if err := remote.Write(tag, signatureImage(t, key, ref)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pushSignatureReferrer(t *testing.T, key *ecdsa.PrivateKey, ref name.Digest, subject v1.Descriptor) {
+	t.Helper()
+	img, ok := mutate.Subject(signatureImage(t, key, ref), subject).(v1.Image)
+	if !ok {
+		t.Fatal("subject image is not an image")
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref.Context().Digest(digest.String()), img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBaseSignatureTag(t *testing.T) {
+	ref, _ := pushTestBase(t, newTestRegistry(t))
+	key, keyPath := newTestSigningKey(t)
+
+	ctx := newTestBuildContext(t)
+	verifier, err := NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Verifier = verifier
+
+	amd64 := Platform{OS: "linux", Arch: "amd64"}
+	_, _, err = getBaseImage(ctx, ref.String(), amd64, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil || !strings.Contains(err.Error(), "no valid signature") {
+		t.Fatalf("expected unsigned base to fail, got %v", err)
+	}
+
+	// A signature from another key is not accepted
+	other, _ := newTestSigningKey(t)
+	pushSignatureTag(t, other, ref)
+	_, _, err = getBaseImage(ctx, ref.String(), amd64, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil {
+		t.Fatal("expected signature from an unknown key to fail")
+	}
+
+	pushSignatureTag(t, key, ref)
+	if _, _, err := getBaseImage(ctx, ref.String(), amd64, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("expected signed index to verify, got %v", err)
+	}
+}
+
+func TestVerifyBaseSignatureReferrer(t *testing.T) {
+	ref, img := pushTestBase(t, newTestRegistry(t))
+	key, keyPath := newTestSigningKey(t)
+
+	ctx := newTestBuildContext(t)
+	verifier, err := NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Verifier = verifier
+
+	// Sign the platform manifest rather than the index
+	desc, err := partial.Descriptor(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushSignatureReferrer(t, key, ref.Context().Digest(desc.Digest.String()), *desc)
+
+	if _, _, err := getBaseImage(ctx, ref.String(), Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("expected referrer signature to verify, got %v", err)
+	}
+}
+
+func TestVerifyBaseSignatureLocalBase(t *testing.T) {
+	_, keyPath := newTestSigningKey(t)
+	ctx := newTestBuildContext(t)
+	verifier, err := NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Verifier = verifier
+
+	dir, _ := writeTestLayout(t)
+	_, _, err = getBaseImage(ctx, "oci-layout:"+dir, Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil {
+		t.Fatal("expected local base to fail verification")
+	}
+}
+
+func TestVerifyBaseSignatureOffline(t *testing.T) {
+	ref, _ := pushTestBase(t, newTestRegistry(t))
+	key, keyPath := newTestSigningKey(t)
+	pushSignatureTag(t, key, ref)
+
+	ctx := newTestBuildContext(t)
+	verifier, err := NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Verifier = verifier
+	ctx.Cache, err = NewBlobCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amd64 := Platform{OS: "linux", Arch: "amd64"}
+	if _, _, err := getBaseImage(ctx, ref.String(), amd64, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("expected signed base to verify online, got %v", err)
+	}
+
+	ctx.Offline = true
+	if _, _, err := getBaseImage(ctx, ref.String(), amd64, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("expected cached signature to verify offline, got %v", err)
+	}
+
+	_, otherPath := newTestSigningKey(t)
+	ctx.Verifier, err = NewSignatureVerifier([]string{otherPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = getBaseImage(ctx, ref.String(), amd64, FORMAT_DOCKER, ctx.Keychain)
+	if err == nil || !strings.Contains(err.Error(), "no valid signature cached") {
+		t.Fatalf("expected a signature from another key to fail offline, got %v", err)
+	}
+}
+
+func TestVerifyBaseSignatureFromMirror(t *testing.T) {
+	upstreamHost := newTestRegistry(t)
+	mirrorHost := newTestRegistry(t)
+
+	ref, _ := pushTestBase(t, upstreamHost)
+	mirrored, _ := pushTestBase(t, mirrorHost)
+	key, keyPath := newTestSigningKey(t)
+	other, _ := newTestSigningKey(t)
+
+	// Only the referrer on the mirror carries a signature from the trusted key
+	pushSignatureTag(t, other, mirrored)
+	desc, err := remote.Get(mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushSignatureReferrer(t, key, mirrored, desc.Descriptor)
+
+	ctx := newTestBuildContext(t)
+	ctx.Mirrors = map[string][]string{upstreamHost: {mirrorHost}}
+	ctx.Verifier, err = NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := getBaseImage(ctx, ref.String(), Platform{OS: "linux", Arch: "amd64"}, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("expected signature on the mirror to verify, got %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+package build
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// cosignTagSuffixes are the tags cosign stores signatures, attestations and SBOMs under.
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// VendorSpec describes copying a base image into another repository.
+type VendorSpec struct {
+	// Source is the base image reference to copy.
+	Source string
+	// Repo is the repository to copy it to. The source tag, if any, is kept.
+	Repo string
+	// Platforms restricts which platform images of an index are copied. Empty copies all.
+	// When any are left out, the copy is an index listing only the copied manifests,
+	// which has a digest of its own.
+	Platforms []Platform
+}
+
+// VendorResult is where the vendored copy can be found.
+type VendorResult struct {
+	// Tag is the vendored tag, or nil when the source had no tag.
+	Tag *name.Tag
+	// Digest is the digest-pinned reference of the copy.
+	Digest name.Digest
+}
+
+// Pinned returns the copy's reference as repo[:tag]@digest.
+func (r VendorResult) Pinned() string {
+	if r.Tag != nil {
+		return r.Tag.Name() + "@" + r.Digest.DigestStr()
+	}
+	return r.Digest.Name()
+}
+
+// Vendor copies a base image, its signatures and its referrers to another repository.
+func Vendor(ctx BuildContext, spec VendorSpec) (VendorResult, error) {
+	src, err := name.ParseReference(spec.Source)
+	if err != nil {
+		return VendorResult{}, fmt.Errorf("failed to parse source reference: %w", err)
+	}
+	dst, err := name.NewRepository(spec.Repo)
+	if err != nil {
+		return VendorResult{}, fmt.Errorf("failed to parse target repository: %w", err)
+	}
+
+	opts := []remote.Option{remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain)}
+	desc, err := remoteGet(ctx, src, ctx.Keychain)
+	if err != nil {
+		return VendorResult{}, fmt.Errorf("failed to retrieve %s: %w", spec.Source, err)
+	}
+
+	// Manifests whose signatures and referrers are copied along
+	copied := []v1.Hash{desc.Digest}
+	var root remote.Taggable = desc
+	rootDigest := desc.Digest
+
+	switch {
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return VendorResult{}, err
+		}
+		if err := remote.Write(dst.Digest(desc.Digest.String()), img, opts...); err != nil {
+			return VendorResult{}, fmt.Errorf("failed to copy image: %w", err)
+		}
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return VendorResult{}, err
+		}
+		children, err := vendorPlatforms(ctx, index, dst, spec.Platforms)
+		if err != nil {
+			return VendorResult{}, err
+		}
+		copied = append(copied, children...)
+
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return VendorResult{}, err
+		}
+		// The original index would refer to manifests that were not copied
+		if len(children) < len(manifest.Manifests) {
+			filtered, err := filterIndex(index, children)
+			if err != nil {
+				return VendorResult{}, err
+			}
+			root = filtered
+			if rootDigest, err = filtered.Digest(); err != nil {
+				return VendorResult{}, err
+			}
+			log.Printf("Rewrote index for %d platform(s): %s", len(children), rootDigest)
+		}
+	default:
+		return VendorResult{}, fmt.Errorf("unsupported media type: %s", desc.MediaType)
+	}
+
+	result := VendorResult{Digest: dst.Digest(rootDigest.String())}
+	if err := remote.Put(result.Digest, root, opts...); err != nil {
+		return VendorResult{}, fmt.Errorf("failed to copy manifest: %w", err)
+	}
+	if tag, ok := src.(name.Tag); ok {
+		t := dst.Tag(tag.TagStr())
+		result.Tag = &t
+		if err := remote.Put(t, root, opts...); err != nil {
+			return VendorResult{}, fmt.Errorf("failed to tag %s: %w", t, err)
+		}
+	}
+
+	for _, d := range copied {
+		artifacts, err := findArtifacts(ctx, src.Context().Digest(d.String()))
+		if err != nil {
+			return VendorResult{}, err
+		}
+		// Signatures name the digest they sign, which the rewritten index doesn't have
+		if d == desc.Digest && rootDigest != desc.Digest {
+			if len(artifacts) > 0 {
+				log.Printf("WARNING: %d signature(s) and attestation(s) of the index %s can't carry over to the rewritten index %s; only those of its platform images were copied", len(artifacts), d, rootDigest)
+			}
+			continue
+		}
+		if err := vendorArtifacts(ctx, artifacts, dst); err != nil {
+			return VendorResult{}, err
+		}
+	}
+
+	log.Printf("Vendored %s to %s", spec.Source, result.Pinned())
+	return result, nil
+}
+
+// vendorPlatforms copies the platform images of index that match platforms and
+// returns their digests. Manifests without a platform, such as attestations, are
+// copied when they refer to a copied image.
+func vendorPlatforms(ctx BuildContext, index v1.ImageIndex, dst name.Repository, platforms []Platform) ([]v1.Hash, error) {
+	opts := []remote.Option{remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain)}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range platforms {
+		if _, err := getDigestForPlatform(index, p); err != nil {
+			return nil, err
+		}
+	}
+
+	var copied []v1.Hash
+	for _, m := range manifest.Manifests {
+		if len(platforms) == 0 || m.Platform != nil && slices.Contains(platforms, Platform{OS: m.Platform.OS, Arch: m.Platform.Architecture, Variant: m.Platform.Variant}) {
+			copied = append(copied, m.Digest)
+		}
+	}
+	// buildx attestation manifests name the image they describe in an annotation
+	for _, m := range manifest.Manifests {
+		subject := m.Annotations["vnd.docker.reference.digest"]
+		if subject != "" && !slices.Contains(copied, m.Digest) && slices.ContainsFunc(copied, func(h v1.Hash) bool { return h.String() == subject }) {
+			copied = append(copied, m.Digest)
+		}
+	}
+
+	for _, d := range copied {
+		i := slices.IndexFunc(manifest.Manifests, func(m v1.Descriptor) bool { return m.Digest == d })
+		m := manifest.Manifests[i]
+		log.Printf("Copying %s (%s)", d, platformString(m.Platform))
+		switch {
+		case m.MediaType.IsImage():
+			img, err := index.Image(d)
+			if err != nil {
+				return nil, err
+			}
+			err = remote.Write(dst.Digest(d.String()), img, opts...)
+		case m.MediaType.IsIndex():
+			child, err := index.ImageIndex(d)
+			if err != nil {
+				return nil, err
+			}
+			err = remote.WriteIndex(dst.Digest(d.String()), child, opts...)
+		default:
+			err = fmt.Errorf("unsupported media type: %s", m.MediaType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", d, err)
+		}
+	}
+	return copied, nil
+}
+
+func platformString(p *v1.Platform) string {
+	if p == nil {
+		return "no platform"
+	}
+	return p.String()
+}
+
+// filterIndex returns index with only the manifests in keep, preserving their descriptors.
+func filterIndex(index v1.ImageIndex, keep []v1.Hash) (v1.ImageIndex, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var addenda []mutate.IndexAddendum
+	for _, m := range manifest.Manifests {
+		if !slices.Contains(keep, m.Digest) {
+			continue
+		}
+		var add mutate.Appendable
+		if m.MediaType.IsIndex() {
+			add, err = index.ImageIndex(m.Digest)
+		} else {
+			add, err = index.Image(m.Digest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, mutate.IndexAddendum{Add: add, Descriptor: m})
+	}
+	filtered := mutate.IndexMediaType(mutate.AppendManifests(empty.Index, addenda...), manifest.MediaType)
+	if len(manifest.Annotations) > 0 {
+		filtered = mutate.Annotations(filtered, manifest.Annotations).(v1.ImageIndex)
+	}
+	return filtered, nil
+}
+
+// artifact is a cosign tag or OCI referrer attached to a manifest.
+type artifact struct {
+	// ref is the cosign tag, or the referrer's digest reference
+	ref  name.Reference
+	desc *remote.Descriptor
+	// artifactType is set for referrers
+	artifactType string
+}
+
+// findArtifacts returns the cosign tags and OCI referrers attached to src,
+// looking them up through mirrors like the manifest itself.
+func findArtifacts(ctx BuildContext, src name.Digest) ([]artifact, error) {
+	var artifacts []artifact
+	prefix := strings.Replace(src.DigestStr(), ":", "-", 1)
+	for _, suffix := range cosignTagSuffixes {
+		tag := src.Context().Tag(prefix + suffix)
+		desc, found, err := remoteGetOptional(ctx, tag, ctx.Keychain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve %s: %w", tag, err)
+		}
+		if found {
+			artifacts = append(artifacts, artifact{ref: tag, desc: desc})
+		}
+	}
+
+	referrers, err := remoteReferrers(ctx, src, ctx.Keychain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers of %s: %w", src, err)
+	}
+	manifest, err := referrers.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifest.Manifests {
+		ref := src.Context().Digest(m.Digest.String())
+		desc, err := remoteGet(ctx, ref, ctx.Keychain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve referrer %s: %w", m.Digest, err)
+		}
+		artifacts = append(artifacts, artifact{ref: ref, desc: desc, artifactType: m.ArtifactType})
+	}
+	return artifacts, nil
+}
+
+// vendorArtifacts copies artifacts to dst under the same tag or digest.
+func vendorArtifacts(ctx BuildContext, artifacts []artifact, dst name.Repository) error {
+	opts := []remote.Option{remote.WithContext(ctx.Context), remote.WithAuthFromKeychain(ctx.Keychain)}
+	for _, a := range artifacts {
+		tag, isTag := a.ref.(name.Tag)
+		if !isTag {
+			if err := copyDescriptor(a.desc, dst.Digest(a.ref.Identifier()), opts); err != nil {
+				return fmt.Errorf("failed to copy referrer %s: %w", a.ref.Identifier(), err)
+			}
+			log.Printf("Copied referrer %s (%s)", a.ref.Identifier(), a.artifactType)
+			continue
+		}
+		if err := copyDescriptor(a.desc, dst.Tag(tag.TagStr()), opts); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", tag, err)
+		}
+		log.Printf("Copied %s", tag.TagStr())
+	}
+	return nil
+}
+
+func copyDescriptor(desc *remote.Descriptor, dst name.Reference, opts []remote.Option) error {
+	switch {
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		return remote.Write(dst, img, opts...)
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		return remote.WriteIndex(dst, index, opts...)
+	}
+	return fmt.Errorf("unsupported media type: %s", desc.MediaType)
+}
@@ -0,0 +1,248 @@
+package build
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestVendorAllPlatforms(t *testing.T) {
+	srcHost := newTestRegistry(t)
+	dstHost := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+
+	idx := pushLayeredBase(t, srcHost+"/base:1", "v1")
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRepo, err := name.NewRepository(srcHost + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign the index through a .sig tag and the amd64 image through a referrer
+	key, keyPath := newTestSigningKey(t)
+	pushSignatureTag(t, key, srcRepo.Digest(idxDigest.String()))
+	amd64, arm64 := rebasePlatforms[0], rebasePlatforms[1]
+	amd64Img, err := getImageForPlatform(idx, amd64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64Desc, err := partial.Descriptor(amd64Img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushSignatureReferrer(t, key, srcRepo.Digest(amd64Desc.Digest.String()), *amd64Desc)
+
+	// Selecting every platform of the index keeps it as it is
+	result, err := Vendor(ctx, VendorSpec{
+		Source:    srcHost + "/base:1",
+		Repo:      dstHost + "/vendored/base",
+		Platforms: []Platform{amd64, arm64},
+	})
+	if err != nil {
+		t.Fatalf("vendor failed: %v", err)
+	}
+
+	if result.Digest.DigestStr() != idxDigest.String() {
+		t.Fatalf("vendored digest %s, want the source index digest %s", result.Digest.DigestStr(), idxDigest)
+	}
+	if want := dstHost + "/vendored/base:1@" + idxDigest.String(); result.Pinned() != want {
+		t.Fatalf("pinned ref %s, want %s", result.Pinned(), want)
+	}
+
+	dstRepo, err := name.NewRepository(dstHost + "/vendored/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Head(dstRepo.Digest(amd64Desc.Digest.String())); err != nil {
+		t.Fatalf("amd64 image was not copied: %v", err)
+	}
+	arm64Digest, err := getDigestForPlatform(idx, arm64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Head(dstRepo.Digest(arm64Digest.String())); err != nil {
+		t.Fatalf("arm64 image was not copied: %v", err)
+	}
+
+	referrers, err := remote.Referrers(dstRepo.Digest(amd64Desc.Digest.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := referrers.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 1 {
+		t.Fatalf("expected the referrer to be copied, got %d", len(manifest.Manifests))
+	}
+
+	// The copy verifies with the same key
+	verifier, err := NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Verifier = verifier
+	if _, _, err := getBaseImage(ctx, result.Pinned(), amd64, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("vendored base failed verification: %v", err)
+	}
+}
+
+func TestVendorPlatformSubset(t *testing.T) {
+	srcHost := newTestRegistry(t)
+	dstHost := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+
+	idx := pushLayeredBase(t, srcHost+"/base:1", "v1")
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Vendor(ctx, VendorSpec{
+		Source:    srcHost + "/base:1",
+		Repo:      dstHost + "/base",
+		Platforms: []Platform{rebasePlatforms[1]},
+	})
+	if err != nil {
+		t.Fatalf("vendor failed: %v", err)
+	}
+	if result.Digest.DigestStr() == idxDigest.String() {
+		t.Fatal("expected a rewritten index to have a new digest")
+	}
+
+	vendored, err := remote.Index(result.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := vendored.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 1 || manifest.Manifests[0].Platform.Architecture != "arm64" {
+		t.Fatalf("unexpected rewritten index: %+v", manifest.Manifests)
+	}
+
+	if _, err := Vendor(ctx, VendorSpec{Source: srcHost + "/base:1", Repo: dstHost + "/base", Platforms: []Platform{{OS: "linux", Arch: "s390x"}}}); err == nil || !strings.Contains(err.Error(), "no manifest") {
+		t.Fatalf("expected missing platform to fail, got %v", err)
+	}
+}
+
+func TestVendorSignedIndexPlatformSubset(t *testing.T) {
+	srcHost := newTestRegistry(t)
+	dstHost := newTestRegistry(t)
+	ctx := newTestBuildContext(t)
+
+	idx := pushLayeredBase(t, srcHost+"/base:1", "v1")
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRepo, err := name.NewRepository(srcHost + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64 := rebasePlatforms[1]
+	arm64Digest, err := getDigestForPlatform(idx, arm64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign both the index and the arm64 image
+	key, keyPath := newTestSigningKey(t)
+	pushSignatureTag(t, key, srcRepo.Digest(idxDigest.String()))
+	pushSignatureTag(t, key, srcRepo.Digest(arm64Digest.String()))
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	result, err := Vendor(ctx, VendorSpec{
+		Source:    srcHost + "/base:1",
+		Repo:      dstHost + "/base",
+		Platforms: []Platform{arm64},
+	})
+	if err != nil {
+		t.Fatalf("vendor failed: %v", err)
+	}
+	if result.Digest.DigestStr() == idxDigest.String() {
+		t.Fatal("expected a rewritten index to have a new digest")
+	}
+	if !strings.Contains(logs.String(), "can't carry over to the rewritten index") {
+		t.Fatalf("expected a warning about the index signature, got %q", logs.String())
+	}
+
+	dstRepo, err := name.NewRepository(dstHost + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Head(dstRepo.Tag(strings.Replace(arm64Digest.String(), ":", "-", 1) + ".sig")); err != nil {
+		t.Fatalf("arm64 signature was not copied: %v", err)
+	}
+	if _, err := remote.Head(dstRepo.Tag(strings.Replace(idxDigest.String(), ":", "-", 1) + ".sig")); err == nil {
+		t.Fatal("expected the signature of the original index not to be copied")
+	}
+
+	// The rewritten index verifies through the signature of its platform image
+	ctx.Verifier, err = NewSignatureVerifier([]string{keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := getBaseImage(ctx, result.Pinned(), arm64, FORMAT_DOCKER, ctx.Keychain); err != nil {
+		t.Fatalf("vendored base failed verification: %v", err)
+	}
+}
+
+func TestVendorArtifactsFromMirror(t *testing.T) {
+	upstreamHost := newTestRegistry(t)
+	mirrorHost := newTestRegistry(t)
+	dstHost := newTestRegistry(t)
+
+	idx := pushLayeredBase(t, upstreamHost+"/base:1", "v1")
+	mirrored := pushLayeredBase(t, mirrorHost+"/base:1", "v1")
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := mirrored.Digest(); err != nil || d != idxDigest {
+		t.Fatalf("mirrored index digest %s, want %s (%v)", d, idxDigest, err)
+	}
+
+	// Only the mirror carries the signature
+	mirrorRepo, err := name.NewRepository(mirrorHost + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := newTestSigningKey(t)
+	pushSignatureTag(t, key, mirrorRepo.Digest(idxDigest.String()))
+
+	ctx := newTestBuildContext(t)
+	ctx.Mirrors = map[string][]string{upstreamHost: {mirrorHost}}
+	if _, err := Vendor(ctx, VendorSpec{Source: upstreamHost + "/base:1", Repo: dstHost + "/base"}); err != nil {
+		t.Fatalf("vendor failed: %v", err)
+	}
+
+	dstRepo, err := name.NewRepository(dstHost + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Head(dstRepo.Tag(strings.Replace(idxDigest.String(), ":", "-", 1) + ".sig")); err != nil {
+		t.Fatalf("signature on the mirror was not copied: %v", err)
+	}
+}
+
+func TestLockFileReplace(t *testing.T) {
+	lock := &LockFile{Version: lockFileVersion, Bases: []LockedBase{{Ref: "b"}, {Ref: "old"}}}
+	lock.Replace("old", LockedBase{Ref: "a"})
+	if len(lock.Bases) != 2 || lock.Bases[0].Ref != "a" || lock.Bases[1].Ref != "b" {
+		t.Fatalf("unexpected bases: %+v", lock.Bases)
+	}
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dskiff/tko/pkg/build"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ExitCodeUpdateAvailable is returned by `tko base outdated` when a base image tag has moved.
+const ExitCodeUpdateAvailable = 3
+
+type BaseCmd struct {
+	Outdated BaseOutdatedCmd `cmd:"" help:"Check whether the base image tag has moved since it was pinned."`
+	Vendor   BaseVendorCmd   `cmd:"" help:"Copy a base image with its signatures and referrers into another repository."`
+}
+
+type BaseOutdatedCmd struct {
+	Image     string `arg:"" optional:"" help:"Published image to read the base image labels from. Defaults to the base image in .tko.yml."`
+	BaseRef   string `short:"b" help:"Base image reference. Defaults to build.base-ref from .tko.yml. With an image, supplies the tag its labels do not record." env:"TKO_BASE_REF"`
+	Platforms string `short:"p" help:"Platform(s) to check, comma-separated. Defaults to build.platforms from .tko.yml." env:"TKO_PLATFORMS"`
+	Lockfile  string `help:"Lockfile the base image tag is pinned in. Defaults to build.lockfile from .tko.yml, then tko.lock." env:"TKO_LOCKFILE"`
+	Verbose   bool   `short:"v" help:"Enable verbose output"`
+}
+
+func (o *BaseOutdatedCmd) Run(cliCtx *CliCtx) error {
+	cfg, err := readBuildConfig()
+	if err != nil {
+		return err
+	}
+	baseRef := firstNonEmpty(o.BaseRef, cfg.BaseRef, defaultBaseRef)
+
+	enableRegistryLogs(o.Verbose)
+
+	keychain, err := newKeychain("", "", "")
+	if err != nil {
+		return err
+	}
+	lock, err := build.ReadLockFileIfExists(firstNonEmpty(o.Lockfile, cfg.Lockfile, defaultLockfile))
+	if err != nil {
+		return err
+	}
+	ctx := build.BuildContext{
+		Context:            cliCtx.Context,
+		ExitCleanupWatcher: cliCtx.ExitCleanWatcher,
+		Keychain:           keychain,
+		Lock:               lock,
+		Mirrors:            splitMirrors(cfg.RegistryMirrors),
+	}
+
+	var current build.BaseDigests
+	if o.Image != "" {
+		current, err = build.PublishedBaseDigests(ctx, o.Image)
+	} else {
+		platforms := firstNonEmpty(o.Platforms, cfg.Platforms, defaultPlatforms)
+		if platforms == "auto" {
+			return fmt.Errorf("cannot check inferred platforms; pass --platforms explicitly")
+		}
+		var platformSpecs []build.PlatformSpec
+		platformSpecs, err = build.ParsePlatformSpecs(platforms)
+		if err != nil {
+			return err
+		}
+		var ps []build.Platform
+		for _, spec := range platformSpecs {
+			ps = append(ps, spec.Platform)
+		}
+		current, err = build.PinnedBaseDigests(ctx, baseRef, ps)
+	}
+	if err != nil {
+		return err
+	}
+
+	tag, err := baseTag(current.Name, baseRef)
+	if err != nil {
+		return err
+	}
+
+	report, err := build.CheckOutdated(ctx, tag, current)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	if report.Outdated {
+		return &ExitError{Code: ExitCodeUpdateAvailable, Err: fmt.Errorf("base image %s has been updated", report.Base)}
+	}
+	return nil
+}
+
+// baseTag returns the tag to check for updates. Base name labels record the
+// repository only, so its tag is taken from baseRef when they refer to the same repository.
+func baseTag(baseName, baseRef string) (name.Tag, error) {
+	if tag, ok := build.TagOf(baseName); ok {
+		return tag, nil
+	}
+	if tag, ok := build.TagOf(baseRef); ok && sameRepository(tag.Context().Name(), baseName) {
+		return tag, nil
+	}
+	return name.Tag{}, fmt.Errorf("base image %s has no tag to check for updates; pass --base-ref with the tag", baseName)
+}
+
+func sameRepository(a, b string) bool {
+	repoA, errA := name.NewRepository(a)
+	repoB, errB := name.NewRepository(b)
+	return errA == nil && errB == nil && repoA.Name() == repoB.Name()
+}
+
+type BaseVendorCmd struct {
+	Ref          string `arg:"" help:"Base image to copy."`
+	To           string `required:"" help:"Repository to copy the base image to. The source tag is kept."`
+	Platforms    string `short:"p" help:"Platform(s) to copy, comma-separated, or 'all'. Defaults to build.platforms from .tko.yml." env:"TKO_PLATFORMS"`
+	UpdateConfig bool   `help:"Point build.base-ref in .tko.yml, and its lockfile entry, at the vendored copy."`
+	Lockfile     string `help:"Lockfile to update. Defaults to build.lockfile from .tko.yml, then tko.lock." env:"TKO_LOCKFILE"`
+
+	RegistryUser string `help:"Registry user. Used for the destination registry. You can use standard docker config for more complex auth." env:"TKO_REGISTRY_USER"`
+	RegistryPass string `help:"Registry password. Used for the destination registry. You can use standard docker config for more complex auth." env:"TKO_REGISTRY_PASS"`
+
+	Verbose bool `short:"v" help:"Enable verbose output"`
+}
+
+func (v *BaseVendorCmd) Run(cliCtx *CliCtx) error {
+	cfg, err := readBuildConfig()
+	if err != nil {
+		return err
+	}
+
+	var platforms []build.Platform
+	switch p := firstNonEmpty(v.Platforms, cfg.Platforms, defaultPlatforms); p {
+	case "all":
+	case "auto":
+		return fmt.Errorf("cannot vendor inferred platforms; pass --platforms explicitly")
+	default:
+		specs, err := build.ParsePlatformSpecs(p)
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			platforms = append(platforms, spec.Platform)
+		}
+	}
+
+	enableRegistryLogs(v.Verbose)
+
+	keychain, err := newKeychain(v.RegistryUser, v.RegistryPass, v.To)
+	if err != nil {
+		return err
+	}
+	ctx := build.BuildContext{
+		Context:            cliCtx.Context,
+		ExitCleanupWatcher: cliCtx.ExitCleanWatcher,
+		Keychain:           keychain,
+		Mirrors:            splitMirrors(cfg.RegistryMirrors),
+	}
+
+	result, err := build.Vendor(ctx, build.VendorSpec{
+		Source:    v.Ref,
+		Repo:      v.To,
+		Platforms: platforms,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(result.Pinned())
+
+	if !v.UpdateConfig {
+		return nil
+	}
+	return v.updateConfig(ctx, cfg, result, platforms)
+}
+
+// updateConfig points the project at the vendored copy. A base pinned through
+// the lockfile stays a tag with a new lockfile entry; otherwise the digest-pinned
+// reference goes into .tko.yml.
+func (v *BaseVendorCmd) updateConfig(ctx build.BuildContext, cfg buildConfig, result build.VendorResult, platforms []build.Platform) error {
+	if cfg.BaseRef != "" && cfg.BaseRef != v.Ref {
+		log.Printf("WARNING: build.base-ref is %s, not %s; updating it anyway", cfg.BaseRef, v.Ref)
+	}
+
+	lockfile := firstNonEmpty(v.Lockfile, cfg.Lockfile, defaultLockfile)
+	lock, err := build.ReadLockFileIfExists(lockfile)
+	if err != nil {
+		return err
+	}
+
+	newRef := result.Pinned()
+	if lock != nil && result.Tag != nil {
+		newRef = result.Tag.String()
+		if len(platforms) == 0 {
+			platforms, err = lockedPlatforms(lock, v.Ref)
+			if err != nil {
+				return err
+			}
+		}
+		resolved, err := build.ResolveLockFile(ctx, map[string][]build.Platform{newRef: platforms})
+		if err != nil {
+			return err
+		}
+		lock.Replace(v.Ref, resolved.Bases...)
+		if err := build.WriteLockFile(lockfile, lock); err != nil {
+			return fmt.Errorf("failed to write lockfile: %w", err)
+		}
+		log.Printf("Updated %s", lockfile)
+	}
+
+	path, err := setConfigBaseRef(newRef)
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated build.base-ref in %s to %s", path, newRef)
+	return nil
+}
+
+// lockedPlatforms returns the platforms locked for ref, used when vendoring all platforms.
+func lockedPlatforms(lock *build.LockFile, ref string) ([]build.Platform, error) {
+	var platforms []build.Platform
+	for _, b := range lock.Bases {
+		if b.Ref != ref {
+			continue
+		}
+		for p := range b.Platforms {
+			platform, err := build.ParsePlatform(p)
+			if err != nil {
+				return nil, err
+			}
+			platforms = append(platforms, platform)
+		}
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("%s is not in the lockfile; pass --platforms", ref)
+	}
+	return platforms, nil
+}
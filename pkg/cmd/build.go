@@ -5,21 +5,22 @@ import (
 	"log"
 	"maps"
 	"os"
+	"path"
 	"regexp"
+	"slices"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 
 	"github.com/dskiff/tko/pkg/build"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/authn/github"
 	"github.com/google/go-containerregistry/pkg/logs"
-	"github.com/google/go-containerregistry/pkg/v1/google"
 )
 
 type BuildCmd struct {
-	BaseRef string `short:"b" help:"Base image reference" env:"TKO_BASE_REF" default:"ubuntu:jammy"`
+	BaseRef       string `short:"b" help:"Base image reference. Also accepts oci-layout:PATH[:TAG|@DIGEST], docker-archive:PATH[:REF] and daemon:REF" env:"TKO_BASE_REF" default:"ubuntu:jammy"`
+	ScratchFormat string `help:"Manifest format to use when the base image is scratch" env:"TKO_SCRATCH_FORMAT" default:"docker" enum:"docker,oci"`
 
-	Platforms string `short:"p" help:"Platform(s) to build for, comma-separated (e.g. linux/amd64,linux/arm64)" env:"TKO_PLATFORMS" default:"linux/amd64"`
+	Platforms string `short:"p" help:"Platform(s) to build for, comma-separated (e.g. linux/amd64,linux/arm64), or 'auto' to infer them from the ELF binaries in the source path" env:"TKO_PLATFORMS" default:"linux/amd64"`
 	Platform  string `help:"Deprecated: use --platforms instead" env:"TKO_PLATFORM" hidden:""`
 
 	SourcePath       string `arg:"" help:"Path to artifacts to embed" type:"path" env:"TKO_SOURCE_PATH"`
@@ -27,8 +28,15 @@ type BuildCmd struct {
 	DestinationChown bool   `help:"Whether to chown the destination path to root:root" default:"true"`
 	Entrypoint       string `help:"Entrypoint for the embedded artifacts" env:"TKO_ENTRYPOINT" default:"/tko-app/app"`
 
-	TargetRepo string `short:"t" help:"Target repository" env:"TKO_TARGET_REPO" required:"true"`
-	TargetType string `short:"T" help:"Target type" env:"TKO_TARGET_TYPE" default:"REMOTE" enum:"REMOTE,LOCAL_DAEMON,LOCAL_FILE"`
+	TargetRepo          []string `short:"t" help:"Target repository. Repeat to publish to several targets concurrently. REPO,type=TYPE,output=PATH overrides --target-type and --output for one target." env:"TKO_TARGET_REPO" required:"true" sep:"none"`
+	AllowPartialFailure bool     `help:"Succeed as long as one target was published" env:"TKO_ALLOW_PARTIAL_FAILURE"`
+	Tags                []string `name:"tag" help:"Tags to push in the target repository, besides the tag in --target-repo. When --target-repo has no tag, only these are pushed and latest is not implied. Go templates over .Git (Commit, ShortCommit, Branch, Tag, Dirty), .Env and .Platform (OS, Arch, Variant; single-platform builds only), e.g. sha-{{.Git.ShortCommit}}" env:"TKO_TAGS"`
+	SemverAliases       bool     `help:"Also move the MAJOR.MINOR, MAJOR and latest tags to a MAJOR.MINOR.PATCH version build, for each series in which the target repository has no higher version" env:"TKO_SEMVER_ALIASES"`
+	SemverPrerelease    bool     `help:"Let pre-release versions take part in --semver-aliases" env:"TKO_SEMVER_PRERELEASE"`
+	TargetType          string   `short:"T" help:"Target type" env:"TKO_TARGET_TYPE" default:"REMOTE" enum:"REMOTE,LOCAL_DAEMON,LOCAL_FILE,OCI_LAYOUT"`
+	Output              string   `help:"Tarball (LOCAL_FILE) or OCI image layout directory (OCI_LAYOUT) to write to. Defaults to out.tar and oci-layout." env:"TKO_OUTPUT"`
+	DaemonPlatform      string   `help:"Platform of a multi-platform build to load with LOCAL_DAEMON. Defaults to the daemon's." env:"TKO_DAEMON_PLATFORM"`
+	DaemonHost          string   `help:"Docker or Podman daemon for LOCAL_DAEMON and daemon: base images (unix://, tcp:// or ssh://). Defaults to DOCKER_HOST, CONTAINER_HOST, then the rootless Podman socket if there is no Docker socket." env:"TKO_DAEMON_HOST"`
 
 	Author                string            `help:"Author of the build" env:"TKO_AUTHOR" default:"github.com/dskiff/tko"`
 	DefaultAnnotations    map[string]string `short:"A" help:"Default annotations to apply to the image" env:"TKO_DEFAULT_ANNOTATIONS" default:"" mapsep:"," sep:"="`
@@ -36,10 +44,32 @@ type BuildCmd struct {
 	AutoVersionAnnotation string            `help:"Automatically apply version annotations" env:"TKO_AUTO_VERSION_ANNOTATION" default:"none" enum:"git,none"`
 	Env                   map[string]string `short:"e" help:"Environment variables to set in the build" env:"TKO_ENV_VARS" default:"" mapsep:"," sep:"="`
 	RunAs                 *string           `help:"Override the user/group to run as" env:"TKO_RUN_AS"`
+	CheckLinking          bool              `help:"Verify the entrypoint's ELF interpreter and shared libraries exist in the base image" env:"TKO_CHECK_LINKING"`
+	SkipPlatformCheck     bool              `help:"Build even if ELF files in the source were built for a different platform than the image" env:"TKO_SKIP_PLATFORM_CHECK"`
+	SBOM                  string            `name:"sbom" help:"Generate an SBOM of each image, attached as a referrer in registries and written next to the output of local targets" env:"TKO_SBOM" default:"none" enum:"none,spdx,cyclonedx"`
+	Provenance            bool              `help:"Attach SLSA provenance naming the tko version, base image digest, git commit and build parameters to each image" env:"TKO_PROVENANCE"`
+	ProvenanceKey         string            `help:"Private key (PEM file or inline PEM) to sign provenance with, as a DSSE envelope" env:"TKO_PROVENANCE_KEY"`
 
 	RegistryUser string `help:"Registry user. Used for target registry url. You can use standard docker config for more complex auth." env:"TKO_REGISTRY_USER"`
 	RegistryPass string `help:"Registry password. Used for target registry url. You can use standard docker config for more complex auth." env:"TKO_REGISTRY_PASS"`
 
+	RegistryMirrors map[string][]string `help:"Mirrors to pull base images through, tried in order before falling back to the registry itself (e.g. docker.io=mirror.corp/dockerhub)" env:"TKO_REGISTRY_MIRRORS" mapsep:";" sep:"="`
+
+	PolicyFile    string   `help:"Base image policy file. Defaults to the policy section of .tko.yml." env:"TKO_POLICY_FILE" type:"existingfile"`
+	SignatureKeys []string `help:"Public keys (PEM files or inline PEM) base images must carry a cosign signature from" env:"TKO_SIGNATURE_KEYS"`
+
+	Lockfile string `help:"Lockfile pinning base image tags to digests. Used when present." env:"TKO_LOCKFILE" default:"tko.lock"`
+	Locked   bool   `help:"Fail if the lockfile is missing a base image or a base image tag has moved" env:"TKO_LOCKED"`
+
+	CacheDir     string `help:"Directory to cache base image manifests, configs and layers in" env:"TKO_CACHE_DIR"`
+	CacheMaxSize string `help:"Evict least recently used cache entries beyond this size (e.g. 512MiB, 10GiB). 0 disables eviction." env:"TKO_CACHE_MAX_SIZE" default:"10GiB"`
+	Offline      bool   `help:"Resolve base images from the cache only. Base refs must be digest-pinned or locked." env:"TKO_OFFLINE"`
+
+	ImmutableTags []string `help:"Patterns of tags that may be pushed but never moved to a different digest (e.g. v*). * protects every tag." env:"TKO_IMMUTABLE_TAGS"`
+	FailIfChanged bool     `help:"Fail instead of pushing when a target tag doesn't already point at the built digest, to verify a rebuild reproduces a published image" env:"TKO_FAIL_IF_CHANGED"`
+	DryRun        bool     `help:"Build and validate everything, then print the digests and tags that would be published instead of publishing" env:"TKO_DRY_RUN"`
+	ResultFile    string   `help:"Write the digests, tags, platforms, layers, base images and annotations of the build to this file as JSON" env:"TKO_RESULT_FILE" type:"path"`
+
 	Tmp     string `help:"Path where tko can write temporary files. Defaults to golang's tmp logic." env:"TKO_TMP" default:""`
 	Verbose bool   `short:"v" help:"Enable verbose output"`
 }
@@ -60,27 +90,92 @@ func (b *BuildCmd) Run(cliCtx *CliCtx) error {
 	if err != nil {
 		return err
 	}
+	if b.Output != "" && targetType != build.LOCAL_FILE && targetType != build.OCI_LAYOUT {
+		return fmt.Errorf("--output requires a LOCAL_FILE or OCI_LAYOUT target")
+	}
+	var daemonPlatform *build.Platform
+	if b.DaemonPlatform != "" {
+		p, err := build.ParsePlatform(b.DaemonPlatform)
+		if err != nil {
+			return err
+		}
+		daemonPlatform = &p
+	}
+	targets, err := parseTargets(b.TargetRepo, build.BuildSpecTarget{
+		Type:           targetType,
+		Output:         b.Output,
+		DaemonPlatform: daemonPlatform,
+	})
+	if err != nil {
+		return err
+	}
+	for _, pattern := range b.ImmutableTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid immutable tag pattern %q: %w", pattern, err)
+		}
+	}
+	if b.FailIfChanged && !slices.ContainsFunc(targets, func(t build.BuildSpecTarget) bool { return t.Type == build.REMOTE }) {
+		return fmt.Errorf("--fail-if-changed requires a REMOTE target")
+	}
+	if daemonPlatform != nil && !slices.ContainsFunc(targets, func(t build.BuildSpecTarget) bool { return t.Type == build.LOCAL_DAEMON }) {
+		return fmt.Errorf("--daemon-platform requires a LOCAL_DAEMON target")
+	}
+
+	scratchFormat, err := build.ParseImageFormat(b.ScratchFormat)
+	if err != nil {
+		return err
+	}
+	sbomFormat, err := build.ParseSBOMFormat(b.SBOM)
+	if err != nil {
+		return err
+	}
+	if b.ProvenanceKey != "" && !b.Provenance {
+		return fmt.Errorf("--provenance-key requires --provenance")
+	}
 
-	platformSpecs, err := build.ParsePlatformSpecs(b.Platforms)
+	tagTemplates, err := parseTagTemplates(b.Tags)
 	if err != nil {
 		return err
 	}
 
-	keychains := []authn.Keychain{
-		authn.DefaultKeychain,
-		google.Keychain,
-		github.Keychain,
+	var platformSpecs []build.PlatformSpec
+	if b.Platforms == "auto" {
+		platformSpecs, err = build.InferPlatformSpecs(b.SourcePath)
+		if err != nil {
+			return err
+		}
+		inferred := make([]string, len(platformSpecs))
+		for i, ps := range platformSpecs {
+			inferred[i] = ps.Platform.String()
+		}
+		log.Printf("Inferred platforms from binaries: %s", strings.Join(inferred, ","))
+	} else {
+		platformSpecs, err = build.ParsePlatformSpecs(b.Platforms)
+		if err != nil {
+			return err
+		}
 	}
 
-	if b.RegistryUser != "" && b.RegistryPass != "" {
-		k, err := newSimpleKeychain(b.RegistryUser, b.RegistryPass, b.TargetRepo)
+	var tags []string
+	if len(tagTemplates) > 0 {
+		var gitInfo *GitInfo
+		if usesGit(tagTemplates) {
+			gitInfo, err = getGitInfo(b.SourcePath)
+			if err != nil {
+				return fmt.Errorf("failed to get git info for tags: %w", err)
+			}
+		}
+		tags, err = renderTags(tagTemplates, newTagTemplateData(gitInfo, platformSpecs))
 		if err != nil {
-			return fmt.Errorf("failed to create keychain: %w", err)
+			return err
 		}
+		log.Printf("Tags: %s", strings.Join(tags, ", "))
+	}
 
-		keychains = append([]authn.Keychain{k.toKeychain()}, keychains...)
+	keychain, err := newKeychain(b.RegistryUser, b.RegistryPass, firstRemoteRepo(targets))
+	if err != nil {
+		return err
 	}
-	keychain := authn.NewMultiKeychain(keychains...)
 
 	annotations := make(map[string]string)
 	if b.AutoVersionAnnotation == "git" {
@@ -124,41 +219,147 @@ func (b *BuildCmd) Run(cliCtx *CliCtx) error {
 	maps.Copy(annotations, b.DefaultAnnotations)
 	maps.Copy(annotations, b.Annotations)
 
+	lock, err := build.ReadLockFileIfExists(b.Lockfile)
+	if err != nil {
+		return err
+	}
+	if lock == nil && b.Locked {
+		return fmt.Errorf("--locked requires a lockfile, but %s does not exist; run `tko lock update`", b.Lockfile)
+	}
+
+	var cache *build.BlobCache
+	if b.CacheDir != "" {
+		maxSize, err := build.ParseByteSize(b.CacheMaxSize)
+		if err != nil {
+			return err
+		}
+		cache, err = build.NewBlobCache(b.CacheDir, maxSize)
+		if err != nil {
+			return err
+		}
+	} else if b.Offline {
+		return fmt.Errorf("--offline requires --cache-dir")
+	}
+
+	var verifier *build.SignatureVerifier
+	if len(b.SignatureKeys) > 0 {
+		verifier, err = build.NewSignatureVerifier(b.SignatureKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	var provenanceSigner *build.ProvenanceSigner
+	if b.ProvenanceKey != "" {
+		provenanceSigner, err = build.NewProvenanceSigner(b.ProvenanceKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	var source *build.BuildSource
+	if b.Provenance {
+		gitInfo, err := getGitInfo(b.SourcePath)
+		if err != nil {
+			log.Printf("No git revision recorded in provenance: %v", err)
+		} else {
+			source = &build.BuildSource{Repository: gitInfo.Remote, Commit: gitInfo.CommitHash, Dirty: gitInfo.Dirty}
+		}
+	}
+
+	policy, err := readBasePolicy(b.PolicyFile)
+	if err != nil {
+		return err
+	}
+
 	buildCtx := build.BuildContext{
 		Context:            cliCtx.Context,
 		ExitCleanupWatcher: cliCtx.ExitCleanWatcher,
 		Keychain:           keychain,
 		TempPath:           b.Tmp,
+		Version:            cliCtx.TkoBuildVersion,
+		Lock:               lock,
+		Locked:             b.Locked,
+		Cache:              cache,
+		Offline:            b.Offline,
+		Mirrors:            splitMirrors(b.RegistryMirrors),
+		Verifier:           verifier,
+		Policy:             policy,
+		ProvenanceSigner:   provenanceSigner,
+		DaemonHost:         b.DaemonHost,
+		FailIfChanged:      b.FailIfChanged,
+		ImmutableTags:      b.ImmutableTags,
 	}
 
-	// Enable go-containerregistry logging
-	logs.Warn.SetOutput(os.Stderr)
-	logs.Progress.SetOutput(os.Stderr)
-	if b.Verbose {
-		logs.Debug.SetOutput(os.Stderr)
+	enableRegistryLogs(b.Verbose)
+
+	for i := range targets {
+		targets[i].Tags = tags
 	}
 
-	target := build.BuildSpecTarget{
-		Repo: b.TargetRepo,
-		Type: targetType,
+	if b.SemverAliases {
+		version, ok := annotations["org.opencontainers.image.version"]
+		if !ok {
+			return fmt.Errorf("--semver-aliases requires a version; use --auto-version-annotation git or set org.opencontainers.image.version")
+		}
+		if !slices.ContainsFunc(targets, func(t build.BuildSpecTarget) bool { return t.Type == build.REMOTE }) {
+			return fmt.Errorf("--semver-aliases requires a REMOTE target")
+		}
+		if strings.HasPrefix(version, "snapshot-") {
+			log.Printf("Version %s is not a release; not moving semver aliases", version)
+		} else {
+			// Each registry has its own tags, so each decides which aliases this build owns
+			for i, target := range targets {
+				if target.Type != build.REMOTE {
+					continue
+				}
+				aliases, err := build.SemverAliasTags(buildCtx, target.Repo, version, b.SemverPrerelease)
+				if err != nil {
+					return err
+				}
+				targetTags := slices.Clone(tags)
+				for _, alias := range aliases {
+					if !slices.Contains(targetTags, alias) {
+						targetTags = append(targetTags, alias)
+					}
+				}
+				targets[i].Tags = targetTags
+				log.Printf("Semver tags for %s: %s", target.Repo, strings.Join(aliases, ", "))
+			}
+		}
 	}
 
 	// Single-platform: use the original Build() path
 	if len(platformSpecs) == 1 {
+		// An inferred <os>/<arch>/ layout with a single platform still builds from its directory
+		sourcePath := b.SourcePath
+		if platformSpecs[0].SourcePath != "" {
+			sourcePath = platformSpecs[0].SourcePath
+		}
 		cfg := build.BuildSpec{
 			BaseRef: b.BaseRef,
 			InjectLayer: build.BuildSpecInjectLayer{
 				Platform:         platformSpecs[0].Platform,
-				SourcePath:       b.SourcePath,
+				SourcePath:       sourcePath,
 				DestinationPath:  b.DestinationPath,
 				DestinationChown: b.DestinationChown,
 				Entrypoint:       b.Entrypoint,
 			},
-			Target:      target,
+			Target:              targets[0],
+			Targets:             targets[1:],
+			AllowPartialFailure: b.AllowPartialFailure,
+
 			Author:      b.Author,
 			Annotations: annotations,
 			Env:         b.Env,
 			RunAs:       b.RunAs,
+
+			CheckLinking:      b.CheckLinking,
+			SkipPlatformCheck: b.SkipPlatformCheck,
+			ScratchFormat:     scratchFormat,
+			SBOM:              sbomFormat,
+			Provenance:        b.Provenance,
+			Source:            source,
 		}
 
 		out, err := yaml.Marshal(cfg)
@@ -167,22 +368,37 @@ func (b *BuildCmd) Run(cliCtx *CliCtx) error {
 		}
 		log.Print("Build configuration:", "\n"+string(out))
 
-		return build.Build(buildCtx, cfg)
+		if b.DryRun {
+			result, err := build.BuildImage(buildCtx, cfg)
+			if err == nil {
+				err = logDryRun(buildCtx, result, targets)
+			}
+			return b.report(result, err)
+		}
+		return b.report(build.Build(buildCtx, cfg))
 	}
 
 	// Multi-platform: use BuildMultiPlatform()
 	multiSpec := build.MultiPlatformBuildSpec{
-		BaseRef:          b.BaseRef,
-		Platforms:        platformSpecs,
-		SourceRoot:       b.SourcePath,
-		DestinationPath:  b.DestinationPath,
-		DestinationChown: b.DestinationChown,
-		Entrypoint:       b.Entrypoint,
-		Target:           target,
-		Author:           b.Author,
-		Annotations:      annotations,
-		Env:              b.Env,
-		RunAs:            b.RunAs,
+		BaseRef:             b.BaseRef,
+		Platforms:           platformSpecs,
+		SourceRoot:          b.SourcePath,
+		DestinationPath:     b.DestinationPath,
+		DestinationChown:    b.DestinationChown,
+		Entrypoint:          b.Entrypoint,
+		Target:              targets[0],
+		Targets:             targets[1:],
+		AllowPartialFailure: b.AllowPartialFailure,
+		Author:              b.Author,
+		Annotations:         annotations,
+		Env:                 b.Env,
+		RunAs:               b.RunAs,
+		CheckLinking:        b.CheckLinking,
+		SkipPlatformCheck:   b.SkipPlatformCheck,
+		ScratchFormat:       scratchFormat,
+		SBOM:                sbomFormat,
+		Provenance:          b.Provenance,
+		Source:              source,
 	}
 
 	out, err := yaml.Marshal(multiSpec)
@@ -191,5 +407,33 @@ func (b *BuildCmd) Run(cliCtx *CliCtx) error {
 	}
 	log.Print("Multi-platform build configuration:", "\n"+string(out))
 
-	return build.BuildMultiPlatform(buildCtx, multiSpec)
+	if b.DryRun {
+		result, err := build.BuildIndex(buildCtx, multiSpec)
+		if err == nil {
+			err = logDryRun(buildCtx, result, targets)
+		}
+		return b.report(result, err)
+	}
+	return b.report(build.BuildMultiPlatform(buildCtx, multiSpec))
+}
+
+// splitMirrors splits comma-separated endpoints from the command line
+// (docker.io=a,b); yaml lists arrive already split.
+func splitMirrors(mirrors map[string][]string) map[string][]string {
+	split := make(map[string][]string, len(mirrors))
+	for registry, endpoints := range mirrors {
+		for _, e := range endpoints {
+			split[registry] = append(split[registry], strings.Split(e, ",")...)
+		}
+	}
+	return split
+}
+
+// enableRegistryLogs routes go-containerregistry logging to stderr.
+func enableRegistryLogs(verbose bool) {
+	logs.Warn.SetOutput(os.Stderr)
+	logs.Progress.SetOutput(os.Stderr)
+	if verbose {
+		logs.Debug.SetOutput(os.Stderr)
+	}
 }
@@ -15,6 +15,15 @@ type CliCtx struct {
 	ExitCleanWatcher *build.ExitCleanupWatcher
 }
 
+// ExitError is an error that ends tko with a specific exit code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+func (e *ExitError) Unwrap() error { return e.Err }
+
 type VersionCmd struct{}
 
 func (v *VersionCmd) Run(cliCtx *CliCtx) error {
@@ -25,5 +34,8 @@ func (v *VersionCmd) Run(cliCtx *CliCtx) error {
 type CLI struct {
 	Version VersionCmd `cmd:"" help:"Show version."`
 
-	Build BuildCmd `cmd:"" help:"Build and publish a container image."`
+	Build  BuildCmd  `cmd:"" help:"Build and publish a container image."`
+	Lock   LockCmd   `cmd:"" help:"Manage the base image lockfile."`
+	Base   BaseCmd   `cmd:"" help:"Inspect base images."`
+	Rebase RebaseCmd `cmd:"" help:"Swap the base image under a published image without rebuilding."`
 }
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/dskiff/tko/pkg/build"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFiles are the project configuration files kong reads flag values from.
+var ConfigFiles = []string{"./.tko.yaml", "./.tko.yml"}
+
+// Defaults shared between `tko build` and the commands that inspect its base images.
+const (
+	defaultBaseRef   = "ubuntu:jammy"
+	defaultPlatforms = "linux/amd64"
+	defaultLockfile  = "tko.lock"
+)
+
+// buildConfig holds the `build` settings from the project configuration
+// that other commands need to agree with `tko build` on.
+type buildConfig struct {
+	BaseRef   string `yaml:"base-ref"`
+	Platforms string `yaml:"platforms"`
+	Lockfile  string `yaml:"lockfile"`
+
+	RegistryMirrors map[string][]string `yaml:"registry-mirrors"`
+	SignatureKeys   []string            `yaml:"signature-keys"`
+}
+
+// projectConfig is the part of the project configuration read outside of kong.
+type projectConfig struct {
+	Build  buildConfig       `yaml:"build"`
+	Policy *build.BasePolicy `yaml:"policy"`
+}
+
+func readProjectConfig() (projectConfig, error) {
+	for _, path := range ConfigFiles {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return projectConfig{}, err
+		}
+
+		var cfg projectConfig
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return projectConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return cfg, nil
+	}
+	return projectConfig{}, nil
+}
+
+func readBuildConfig() (buildConfig, error) {
+	cfg, err := readProjectConfig()
+	return cfg.Build, err
+}
+
+// readBasePolicy loads the base image policy from policyFile, falling back
+// to the policy section of the project configuration. It returns nil when
+// neither is set.
+func readBasePolicy(policyFile string) (*build.BasePolicy, error) {
+	if policyFile != "" {
+		return build.ReadBasePolicy(policyFile)
+	}
+	cfg, err := readProjectConfig()
+	if err != nil || cfg.Policy == nil {
+		return nil, err
+	}
+	if err := cfg.Policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid base image policy: %w", err)
+	}
+	return cfg.Policy, nil
+}
+
+// firstNonEmpty returns the first non-empty value, used to layer flags over config over defaults.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// setConfigBaseRef rewrites build.base-ref in the project configuration,
+// keeping the rest of the file and its comments. It returns the file written.
+func setConfigBaseRef(baseRef string) (string, error) {
+	for _, path := range ConfigFiles {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return "", fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			return "", fmt.Errorf("%s is not a mapping", path)
+		}
+		buildNode := mappingValue(doc.Content[0], "build")
+		if buildNode == nil {
+			buildNode = &yaml.Node{Kind: yaml.MappingNode}
+			doc.Content[0].Content = append(doc.Content[0].Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "build"}, buildNode)
+		}
+		if value := mappingValue(buildNode, "base-ref"); value != nil {
+			value.Value = baseRef
+		} else {
+			buildNode.Content = append(buildNode.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: "base-ref"},
+				&yaml.Node{Kind: yaml.ScalarNode, Value: baseRef})
+		}
+
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return "", err
+		}
+		return path, os.WriteFile(path, buf.Bytes(), 0o644)
+	}
+	return "", fmt.Errorf("no configuration file found (%s)", strings.Join(ConfigFiles, ", "))
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
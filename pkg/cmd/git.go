@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"net/url"
 	"os/exec"
 	"strings"
 )
@@ -9,7 +10,10 @@ import (
 type GitInfo struct {
 	Dirty      bool
 	CommitHash string
+	Branch     string
 	Tag        []string
+	// Empty without an origin remote
+	Remote string
 }
 
 func getGitInfo(path string) (*GitInfo, error) {
@@ -39,13 +43,41 @@ func getGitInfo(path string) (*GitInfo, error) {
 		tags = tags[:len(tags)-1]
 	}
 
+	// Empty on a detached HEAD, as is usual in CI
+	output, err = run(path, "git", "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get branch: %w", err)
+	}
+	branch := strings.TrimSpace(output)
+	if branch == "HEAD" {
+		branch = ""
+	}
+
+	remote := ""
+	output, err = run(path, "git", "remote", "get-url", "origin")
+	if err == nil {
+		remote = redactURL(strings.TrimSpace(output))
+	}
+
 	return &GitInfo{
 		Dirty:      dirty,
 		CommitHash: sha,
+		Branch:     branch,
 		Tag:        tags,
+		Remote:     remote,
 	}, nil
 }
 
+// redactURL drops credentials CI checkouts often embed in the remote URL.
+func redactURL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+	u.User = nil
+	return u.String()
+}
+
 func run(path string, args ...string) (string, error) {
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Dir = path
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/dskiff/tko/pkg/build"
+)
+
+type LockCmd struct {
+	Update LockUpdateCmd `cmd:"" help:"Resolve base images and write their digests to the lockfile."`
+}
+
+type LockUpdateCmd struct {
+	BaseRef   string `short:"b" help:"Base image reference to update. Defaults to every entry in the lockfile and build.base-ref from .tko.yml." env:"TKO_BASE_REF"`
+	Platforms string `short:"p" help:"Platform(s) to lock, comma-separated. Defaults to build.platforms from .tko.yml." env:"TKO_PLATFORMS"`
+	Lockfile  string `help:"Lockfile to update. Defaults to build.lockfile from .tko.yml, then tko.lock." env:"TKO_LOCKFILE"`
+
+	RegistryMirrors map[string][]string `help:"Mirrors to resolve base images through, tried in order before falling back to the registry itself. Defaults to build.registry-mirrors from .tko.yml." env:"TKO_REGISTRY_MIRRORS" mapsep:";" sep:"="`
+
+	Verbose bool `short:"v" help:"Enable verbose output"`
+}
+
+func (l *LockUpdateCmd) Run(cliCtx *CliCtx) error {
+	cfg, err := readBuildConfig()
+	if err != nil {
+		return err
+	}
+	baseRef := firstNonEmpty(l.BaseRef, cfg.BaseRef, defaultBaseRef)
+	lockfile := firstNonEmpty(l.Lockfile, cfg.Lockfile, defaultLockfile)
+
+	platforms := firstNonEmpty(l.Platforms, cfg.Platforms, defaultPlatforms)
+	if platforms == "auto" {
+		return fmt.Errorf("cannot lock inferred platforms; pass --platforms explicitly")
+	}
+	platformSpecs, err := build.ParsePlatformSpecs(platforms)
+	if err != nil {
+		return err
+	}
+
+	enableRegistryLogs(l.Verbose)
+
+	keychain, err := newKeychain("", "", "")
+	if err != nil {
+		return err
+	}
+
+	mirrors := l.RegistryMirrors
+	if len(mirrors) == 0 {
+		mirrors = cfg.RegistryMirrors
+	}
+
+	old, err := build.ReadLockFileIfExists(lockfile)
+	if err != nil {
+		return err
+	}
+
+	// A named base only updates its own entry; otherwise every locked base is refreshed
+	// for the platforms it was locked with, along with the configured base.
+	bases := make(map[string][]build.Platform)
+	if l.BaseRef == "" && old != nil {
+		for _, b := range old.Bases {
+			bases[b.Ref], err = lockedPlatforms(old, b.Ref)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	bases[baseRef] = nil
+	for _, ps := range platformSpecs {
+		bases[baseRef] = append(bases[baseRef], ps.Platform)
+	}
+
+	resolved, err := build.ResolveLockFile(build.BuildContext{
+		Context:            cliCtx.Context,
+		ExitCleanupWatcher: cliCtx.ExitCleanWatcher,
+		Keychain:           keychain,
+		Mirrors:            splitMirrors(mirrors),
+	}, bases)
+	if err != nil {
+		return err
+	}
+
+	lock := resolved
+	if old != nil {
+		updated := *old
+		updated.Bases = slices.Clone(old.Bases)
+		for _, b := range resolved.Bases {
+			updated.Replace(b.Ref, b)
+		}
+		lock = &updated
+	}
+
+	diff := build.DiffLockFiles(old, lock)
+	if len(diff) == 0 {
+		log.Printf("%s is up to date", lockfile)
+		return nil
+	}
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+
+	if err := build.WriteLockFile(lockfile, lock); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	log.Printf("Updated %s", lockfile)
+	return nil
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/dskiff/tko/pkg/build"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+type RebaseCmd struct {
+	Image      string `arg:"" help:"Published image or index to rebase."`
+	NewBase    string `help:"Base image to rebase onto. Defaults to the current tag of the recorded base image." env:"TKO_NEW_BASE"`
+	TargetRepo string `short:"t" help:"Where to push the rebased image. Defaults to the image itself, which must then be a tag." env:"TKO_TARGET_REPO"`
+
+	RegistryUser string `help:"Registry user. Used for target registry url. You can use standard docker config for more complex auth." env:"TKO_REGISTRY_USER"`
+	RegistryPass string `help:"Registry password. Used for target registry url. You can use standard docker config for more complex auth." env:"TKO_REGISTRY_PASS"`
+
+	Verbose bool `short:"v" help:"Enable verbose output"`
+}
+
+func (r *RebaseCmd) Run(cliCtx *CliCtx) error {
+	log.Printf("tko %s (%s) built on %s\n", cliCtx.TkoBuildVersion, cliCtx.TkoBuildCommit, cliCtx.TkoBuildDate)
+
+	cfg, err := readBuildConfig()
+	if err != nil {
+		return err
+	}
+	target := firstNonEmpty(r.TargetRepo, r.Image)
+	if ref, err := name.ParseReference(r.Image); err == nil && r.TargetRepo == "" {
+		if _, ok := ref.(name.Digest); ok {
+			return fmt.Errorf("%s is pinned by digest, which the rebased image can't be pushed to; pass --target-repo", r.Image)
+		}
+	}
+
+	enableRegistryLogs(r.Verbose)
+
+	keychain, err := newKeychain(r.RegistryUser, r.RegistryPass, target)
+	if err != nil {
+		return err
+	}
+	policy, err := readBasePolicy("")
+	if err != nil {
+		return err
+	}
+	var verifier *build.SignatureVerifier
+	if len(cfg.SignatureKeys) > 0 {
+		verifier, err = build.NewSignatureVerifier(cfg.SignatureKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := build.BuildContext{
+		Context:            cliCtx.Context,
+		ExitCleanupWatcher: cliCtx.ExitCleanWatcher,
+		Keychain:           keychain,
+		Mirrors:            splitMirrors(cfg.RegistryMirrors),
+		Verifier:           verifier,
+		Policy:             policy,
+	}
+
+	newBase := r.NewBase
+	if newBase == "" {
+		current, err := build.PublishedBaseDigests(ctx, r.Image)
+		if err != nil {
+			return err
+		}
+		tag, err := baseTag(current.Name, firstNonEmpty(cfg.BaseRef, defaultBaseRef))
+		if err != nil {
+			return err
+		}
+		newBase = tag.String()
+	}
+	log.Printf("Rebasing %s onto %s", r.Image, newBase)
+
+	return build.Rebase(ctx, build.RebaseSpec{
+		Image:   r.Image,
+		NewBase: newBase,
+		Target:  build.BuildSpecTarget{Repo: target, Type: build.REMOTE},
+	})
+}
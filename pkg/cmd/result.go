@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dskiff/tko/pkg/build"
+)
+
+// report writes the build result wherever it was asked for, then passes the build error on.
+func (b *BuildCmd) report(result *build.BuildResult, buildErr error) error {
+	if result == nil {
+		return buildErr
+	}
+
+	var errs []error
+	if b.ResultFile != "" {
+		errs = append(errs, writeResultFile(b.ResultFile, result))
+	}
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		errs = append(errs, writeGitHubOutputs(result))
+	}
+	return errors.Join(append([]error{buildErr}, errs...)...)
+}
+
+// logDryRun prints what a build would have published, after making the
+// read-only checks publishing would make against each target.
+func logDryRun(ctx build.BuildContext, result *build.BuildResult, targets []build.BuildSpecTarget) error {
+	log.Println("Dry run: nothing was published")
+	log.Printf("Digest: %s (%s, %d bytes)", result.Digest, result.MediaType, result.Descriptor.Size)
+	for _, p := range result.Platforms {
+		var size int64
+		for _, layer := range p.Layers {
+			size += layer.Size
+		}
+		base := p.Base.Name
+		if p.Base.Digest != "" {
+			base += "@" + p.Base.Digest
+		}
+		log.Printf("  %s: %s, %d layers (%d bytes), base %s", p.Platform, p.Digest, len(p.Layers), size, base)
+	}
+	var errs []error
+	for _, target := range targets {
+		refs, err := build.CheckPublish(ctx, result, target)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", target, err))
+			continue
+		}
+		if len(refs) == 0 {
+			log.Printf("%s is up to date", target)
+			continue
+		}
+		tags := make([]string, len(refs))
+		for i, ref := range refs {
+			tags[i] = ref.TagStr()
+		}
+		log.Printf("Would publish to %s as %s", target, strings.Join(tags, ", "))
+	}
+	return errors.Join(errs...)
+}
+
+func writeResultFile(path string, result *build.BuildResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal build result: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write result file: %w", err)
+	}
+	log.Printf("Wrote build result to %s", path)
+	return nil
+}
+
+// writeGitHubOutputs sets the digest and image step outputs and adds a job summary.
+func writeGitHubOutputs(result *build.BuildResult) error {
+	if path := os.Getenv("GITHUB_OUTPUT"); path != "" {
+		outputs := fmt.Sprintf("digest=%s\n", result.Digest)
+		// Nothing is published in a dry run
+		if image := result.Pinned(); image != "" {
+			outputs += fmt.Sprintf("image=%s\n", image)
+		}
+		if err := appendFile(path, outputs); err != nil {
+			return fmt.Errorf("failed to write GitHub outputs: %w", err)
+		}
+	}
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		if err := appendFile(path, stepSummary(result)); err != nil {
+			return fmt.Errorf("failed to write GitHub step summary: %w", err)
+		}
+	}
+	return nil
+}
+
+func stepSummary(result *build.BuildResult) string {
+	var sb strings.Builder
+	sb.WriteString("### tko build\n\n")
+	fmt.Fprintf(&sb, "Digest: `%s`\n\n", result.Digest)
+
+	sb.WriteString("| Target | Tags | Status |\n| --- | --- | --- |\n")
+	for _, target := range result.Targets {
+		name := target.Repo
+		if target.Output != "" {
+			name += " (" + target.Output + ")"
+		}
+		status := "published"
+		if target.Error != "" {
+			status = "failed: " + strings.ReplaceAll(target.Error, "|", `\|`)
+		}
+		fmt.Fprintf(&sb, "| %s %s | %s | %s |\n", target.Type, name, strings.Join(target.Tags, ", "), status)
+	}
+
+	sb.WriteString("\n| Platform | Digest | Base |\n| --- | --- | --- |\n")
+	for _, p := range result.Platforms {
+		base := p.Base.Name
+		if p.Base.Digest != "" {
+			base += "@" + p.Base.Digest
+		}
+		fmt.Fprintf(&sb, "| %s | `%s` | %s |\n", p.Platform, p.Digest, base)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func appendFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -7,7 +7,9 @@ import (
 	"strings"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/authn/github"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
 )
 
 type SimpleKeychain struct {
@@ -55,3 +57,23 @@ func (s *SimpleKeychain) Get(serverURL string) (string, string, error) {
 	log.Println("Using provided credentials for", s.Registry)
 	return s.Username, s.Password, nil
 }
+
+// newKeychain returns the default keychains, preceded by explicit credentials for
+// the target registry when both user and password are given.
+func newKeychain(registryUser, registryPass, targetRepo string) (authn.Keychain, error) {
+	keychains := []authn.Keychain{
+		authn.DefaultKeychain,
+		google.Keychain,
+		github.Keychain,
+	}
+
+	if registryUser != "" && registryPass != "" {
+		k, err := newSimpleKeychain(registryUser, registryPass, targetRepo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create keychain: %w", err)
+		}
+
+		keychains = append([]authn.Keychain{k.toKeychain()}, keychains...)
+	}
+	return authn.NewMultiKeychain(keychains...), nil
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/dskiff/tko/pkg/build"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// tagTemplateData is what tag templates are rendered with, e.g.
+// sha-{{.Git.ShortCommit}} or {{.Env.BRANCH}}-{{.Platform.Arch}}.
+type tagTemplateData struct {
+	Git      tagGitData
+	Env      map[string]string
+	Platform *build.Platform
+}
+
+type tagGitData struct {
+	Commit      string
+	ShortCommit string
+	Branch      string
+	Tag         string
+	Dirty       bool
+}
+
+// parseTagTemplates parses every tag up front, so a typo fails before anything is built.
+func parseTagTemplates(tags []string) ([]*template.Template, error) {
+	var templates []*template.Template
+	for _, tag := range tags {
+		tmpl, err := template.New(tag).Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag template %q: %w", tag, err)
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+// usesGit reports whether any of the templates refers to .Git, which needs a repository.
+func usesGit(templates []*template.Template) bool {
+	for _, tmpl := range templates {
+		if usesField(tmpl, "Git") {
+			return true
+		}
+	}
+	return false
+}
+
+// usesField reports whether tmpl refers to the top-level field of tagTemplateData,
+// as in {{.Git.Tag}}, {{with .Git}} or {{$.Git}}.
+func usesField(tmpl *template.Template, field string) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeUsesField(t.Tree.Root, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeUsesField(node parse.Node, field string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesField(child, field) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesField(n.Pipe, field)
+	case *parse.TemplateNode:
+		return nodeUsesField(n.Pipe, field)
+	case *parse.IfNode:
+		return nodeUsesField(&n.BranchNode, field)
+	case *parse.RangeNode:
+		return nodeUsesField(&n.BranchNode, field)
+	case *parse.WithNode:
+		return nodeUsesField(&n.BranchNode, field)
+	case *parse.BranchNode:
+		return nodeUsesField(n.Pipe, field) || nodeUsesField(n.List, field) || nodeUsesField(n.ElseList, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesField(cmd, field) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesField(arg, field) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesField(n.Node, field)
+	case *parse.FieldNode:
+		return n.Ident[0] == field
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == field
+	}
+	return false
+}
+
+func newTagTemplateData(gitInfo *GitInfo, platforms []build.PlatformSpec) tagTemplateData {
+	data := tagTemplateData{Env: make(map[string]string)}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		data.Env[k] = v
+	}
+	// Only single-platform builds have a platform to name tags after
+	if len(platforms) == 1 {
+		data.Platform = &platforms[0].Platform
+	}
+	if gitInfo != nil {
+		data.Git = tagGitData{
+			Commit:      gitInfo.CommitHash,
+			ShortCommit: gitInfo.CommitHash[:min(7, len(gitInfo.CommitHash))],
+			Branch:      gitInfo.Branch,
+			Dirty:       gitInfo.Dirty,
+		}
+		if len(gitInfo.Tag) > 0 {
+			data.Git.Tag = gitInfo.Tag[0]
+		}
+	}
+	return data
+}
+
+// renderTags renders each template and checks the result is a valid tag.
+func renderTags(templates []*template.Template, data tagTemplateData) ([]string, error) {
+	var tags []string
+	for _, tmpl := range templates {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, data); err != nil {
+			if data.Platform == nil && usesField(tmpl, "Platform") {
+				return nil, fmt.Errorf("failed to render tag %q: .Platform is only available in single-platform builds: %w", tmpl.Name(), err)
+			}
+			return nil, fmt.Errorf("failed to render tag %q: %w", tmpl.Name(), err)
+		}
+		tag := sb.String()
+		if _, err := name.NewTag("example.com/repo:"+tag, name.StrictValidation); err != nil {
+			return nil, fmt.Errorf("tag %q rendered to %q, which is not a valid tag", tmpl.Name(), tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
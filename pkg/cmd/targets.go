@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dskiff/tko/pkg/build"
+)
+
+// parseTargets turns --target-repo values into build targets. A plain value is
+// a repository published as the default target. REPO,type=TYPE,output=PATH
+// gives a target its own type and output.
+func parseTargets(values []string, defaults build.BuildSpecTarget) ([]build.BuildSpecTarget, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("at least one --target-repo is required")
+	}
+
+	outputs := make(map[string]string)
+	var targets []build.BuildSpecTarget
+	for _, value := range values {
+		target, err := parseTarget(value, defaults)
+		if err != nil {
+			return nil, err
+		}
+		if target.Output != "" && target.Type != build.LOCAL_FILE && target.Type != build.OCI_LAYOUT {
+			return nil, fmt.Errorf("target %s: output requires a LOCAL_FILE or OCI_LAYOUT target", value)
+		}
+		if target.Type == build.LOCAL_FILE || target.Type == build.OCI_LAYOUT {
+			output := target.OutputPath()
+			if other, ok := outputs[output]; ok {
+				return nil, fmt.Errorf("targets %s and %s write to the same output; give one of them output=PATH", other, value)
+			}
+			outputs[output] = value
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func parseTarget(value string, defaults build.BuildSpecTarget) (build.BuildSpecTarget, error) {
+	target := defaults
+	repo, options, hasOptions := strings.Cut(value, ",")
+	target.Repo = repo
+	if !hasOptions {
+		return target, nil
+	}
+
+	// Per-target options replace the defaults rather than adding to them
+	target.Output = ""
+	for option := range strings.SplitSeq(options, ",") {
+		key, val, ok := strings.Cut(option, "=")
+		if !ok {
+			return build.BuildSpecTarget{}, fmt.Errorf("invalid target option %q in %s (expected key=value)", option, value)
+		}
+		switch key {
+		case "type":
+			t, err := build.ParseTargetType(val)
+			if err != nil {
+				return build.BuildSpecTarget{}, fmt.Errorf("invalid target %s: %w", value, err)
+			}
+			target.Type = t
+		case "output":
+			target.Output = val
+		default:
+			return build.BuildSpecTarget{}, fmt.Errorf("unknown target option %q in %s (expected type or output)", key, value)
+		}
+	}
+	return target, nil
+}
+
+// firstRemoteRepo returns the first registry target, for credentials given on the command line.
+func firstRemoteRepo(targets []build.BuildSpecTarget) string {
+	for _, target := range targets {
+		if target.Type == build.REMOTE {
+			return target.Repo
+		}
+	}
+	return targets[0].Repo
+}